@@ -2,46 +2,649 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
 	"database/sql"
+	"embed"
+	"encoding/hex"
 	json "encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"io"
 	"log"
+	"log/slog"
+	"math"
+	"mime"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"net/netip"
 	"os"
+	"os/signal"
 	"regexp"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/singleflight"
 )
 
+// UserID identifies a user: the decimal SERIAL id by default, or the
+// lowercase UUID text with ID_TYPE=uuid. Integer IDs still encode as JSON
+// numbers, so clients of the default mode see no change.
+type UserID string
+
+// isIntegerID reports whether s is an integer in canonical decimal form.
+func isIntegerID(s string) bool {
+	n, err := strconv.ParseInt(s, 10, 64)
+	return err == nil && strconv.FormatInt(n, 10) == s
+}
+
+func (id UserID) MarshalJSON() ([]byte, error) {
+	if isIntegerID(string(id)) {
+		return []byte(id), nil
+	}
+	return json.Marshal(string(id))
+}
+
+// UnmarshalJSON accepts an integer or a string, mode checks are left to
+// validUserID.
+func (id *UserID) UnmarshalJSON(data []byte) error {
+	raw := string(data)
+	if raw == "null" {
+		return nil
+	}
+	if strings.HasPrefix(raw, `"`) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*id = UserID(s)
+		return nil
+	}
+	if !isIntegerID(raw) {
+		return fmt.Errorf("invalid user ID %s", raw)
+	}
+	*id = UserID(raw)
+	return nil
+}
+
+// Scan reads an id column of either type.
+func (id *UserID) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case int64:
+		*id = UserID(strconv.FormatInt(v, 10))
+	case []byte:
+		*id = UserID(v)
+	case string:
+		*id = UserID(v)
+	default:
+		return fmt.Errorf("unsupported user ID type %T", src)
+	}
+	return nil
+}
+
 type User struct {
-	ID       int    `json:"id"`
+	ID       UserID `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Bio      string `json:"bio"`
+	Created  string `json:"created"`
+	Updated  string `json:"updated,omitempty"`
+	Active   bool   `json:"active"`
+}
+
+// userKeyAliases maps the alternative spellings clients send on input to
+// User's canonical JSON keys. Output always uses the canonical form.
+// encoding/json already matches keys case-insensitively, so "userName" needs
+// no entry; only spellings that differ by more than case are listed.
+var userKeyAliases = map[string]string{
+	"user_name":  "username",
+	"createdAt":  "created",
+	"created_at": "created",
+	"updatedAt":  "updated",
+	"updated_at": "updated",
+	"isActive":   "active",
+	"is_active":  "active",
+}
+
+// renameAliases moves aliased members to their canonical keys, reporting
+// whether any were found. A canonical key sent alongside its alias wins.
+func renameAliases(members map[string]json.RawMessage) bool {
+	renamed := false
+	for alias, canonical := range userKeyAliases {
+		value, ok := members[alias]
+		if !ok {
+			continue
+		}
+		if _, set := members[canonical]; !set {
+			members[canonical] = value
+		}
+		delete(members, alias)
+		renamed = true
+	}
+	return renamed
+}
+
+// canonicalKeys rewrites aliased members of a JSON object to their
+// canonical keys. Input without aliases, or that isn't an object, is
+// returned unchanged for the regular decoder to handle.
+func canonicalKeys(data []byte) ([]byte, error) {
+	var members map[string]json.RawMessage
+	if json.Unmarshal(data, &members) != nil || !renameAliases(members) {
+		return data, nil
+	}
+	return json.Marshal(members)
+}
+
+func (user *User) UnmarshalJSON(data []byte) error {
+	data, err := canonicalKeys(data)
+	if err != nil {
+		return err
+	}
+	type plainUser User
+	return json.Unmarshal(data, (*plainUser)(user))
+}
+
+func (patch *UserPatch) UnmarshalJSON(data []byte) error {
+	data, err := canonicalKeys(data)
+	if err != nil {
+		return err
+	}
+	type plainPatch UserPatch
+	return json.Unmarshal(data, (*plainPatch)(patch))
+}
+
+// stringIDUser mirrors User but encodes the ID as a JSON string, for
+// JavaScript clients that would lose precision on IDs above 2^53.
+type stringIDUser struct {
+	ID       string `json:"id"`
 	Username string `json:"username"`
 	Email    string `json:"email"`
 	Bio      string `json:"bio"`
 	Created  string `json:"created"`
+	Updated  string `json:"updated,omitempty"`
+	Active   bool   `json:"active"`
+}
+
+type stringIDUserList struct {
+	Data     []stringIDUser `json:"data"`
+	Count    int            `json:"count"`
+	Warnings []string       `json:"warnings,omitempty"`
+}
+
+// stringIDBatchResult is a BatchResult with its IDs encoded as strings.
+type stringIDBatchResult struct {
+	ID     string        `json:"id"`
+	Status int           `json:"status"`
+	User   *stringIDUser `json:"user,omitempty"`
+	Error  string        `json:"error,omitempty"`
+	Code   string        `json:"code,omitempty"`
+	Errors []FieldError  `json:"errors,omitempty"`
+}
+
+func (user User) withStringID() stringIDUser {
+	return stringIDUser{
+		ID:       string(user.ID),
+		Username: user.Username,
+		Email:    user.Email,
+		Bio:      user.Bio,
+		Created:  user.Created,
+		Updated:  user.Updated,
+		Active:   user.Active,
+	}
+}
+
+// UserList is the enveloped ListUsers response. Clients opt in with
+// ?envelope=true during the migration away from the legacy bare array;
+// setting LIST_ENVELOPE=true makes it the default, and ?envelope=false
+// keeps returning the bare array either way, marked deprecated (see
+// markBareArrayDeprecated).
+type UserList struct {
+	Data     []User   `json:"data"`
+	Count    int      `json:"count"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// UserPatch carries a partial update. A nil field was absent from the
+// request and is left unchanged, while a non-nil field is applied as given,
+// so {"bio": ""} clears the bio but omitting "bio" keeps it. Plain JSON
+// treats null like an absent field; merge patches (decodeMergePatch) treat
+// it as a clear.
+type UserPatch struct {
+	Username *string `json:"username"`
+	Email    *string `json:"email"`
+	Bio      *string `json:"bio"`
+}
+
+// apply copies the patch's non-nil fields onto user.
+func (patch UserPatch) apply(user *User) {
+	if patch.Username != nil {
+		user.Username = *patch.Username
+	}
+	if patch.Email != nil {
+		user.Email = *patch.Email
+	}
+	if patch.Bio != nil {
+		user.Bio = *patch.Bio
+	}
+}
+
+// BatchUpdate is one item of a POST /users/update-batch request.
+type BatchUpdate struct {
+	ID     UserID    `json:"id"`
+	Fields UserPatch `json:"fields"`
+}
+
+// BatchResult reports the outcome of one BatchUpdate, with Status using
+// the code the single-user PATCH would have answered.
+type BatchResult struct {
+	ID     UserID       `json:"id"`
+	Status int          `json:"status"`
+	User   *User        `json:"user,omitempty"`
+	Error  string       `json:"error,omitempty"`
+	Code   string       `json:"code,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// Cache stores users by ID. Implementations must be safe for concurrent use.
+type Cache interface {
+	Get(id UserID) (*User, bool)
+	Set(user *User)
+	Delete(id UserID)
+	// SetMany and DeleteMany apply a bulk write at once, so backends can
+	// do it in one lock acquisition or round-trip
+	SetMany(users []User)
+	DeleteMany(ids []UserID)
+	Clear()
+	Len() int
+	// Inspect returns an entry's metadata without counting as a use
+	Inspect(id UserID) (CacheEntryInfo, bool)
+	// Ping reports whether the backend is reachable
+	Ping(ctx context.Context) error
+	// Close releases the backend, it is called once during shutdown
+	Close() error
+}
+
+// CacheEntryInfo describes a cached user for debugging. Expires is zero
+// when the backend doesn't expire entries by time.
+type CacheEntryInfo struct {
+	User    *User
+	Stored  time.Time
+	Expires time.Time
 }
 
+// memoryCache is the in-process Cache backend. Entries are kept in LRU
+// order so that, when maxBytes is set, the least recently used users are
+// evicted once the approximate total size exceeds it.
+type memoryCache struct {
+	mutex    sync.Mutex
+	users    map[UserID]*list.Element
+	order    *list.List
+	bytes    int64
+	maxBytes int64
+}
+
+// memoryEntry is the value of each memoryCache list element.
+type memoryEntry struct {
+	user   *User
+	stored time.Time
+}
+
+// cacheEntryOverhead approximates the map, list and struct bookkeeping for
+// one entry on top of its string contents.
+const cacheEntryOverhead = 128
+
+// entrySize approximates a cached user's footprint from its field lengths.
+func entrySize(user *User) int64 {
+	return int64(cacheEntryOverhead + len(user.ID) + len(user.Username) + len(user.Email) +
+		len(user.Bio) + len(user.Created) + len(user.Updated))
+}
+
+// newMemoryCache returns an empty cache. maxBytes of 0 disables byte-based
+// eviction.
+func newMemoryCache(maxBytes int64) *memoryCache {
+	return &memoryCache{
+		users:    make(map[UserID]*list.Element),
+		order:    list.New(),
+		maxBytes: maxBytes,
+	}
+}
+
+func (mc *memoryCache) Get(id UserID) (*User, bool) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	element, ok := mc.users[id]
+	if !ok {
+		return nil, false
+	}
+	mc.order.MoveToFront(element)
+	return element.Value.(*memoryEntry).user, true
+}
+
+func (mc *memoryCache) Set(user *User) {
+	mc.mutex.Lock()
+	mc.store(user, time.Now())
+	mc.evict()
+	mc.updateMetrics()
+	mc.mutex.Unlock()
+}
+
+// SetMany stores copies of users, so the caller may reuse the slice.
+func (mc *memoryCache) SetMany(users []User) {
+	mc.mutex.Lock()
+	now := time.Now()
+	for i := range users {
+		user := users[i]
+		mc.store(&user, now)
+	}
+	mc.evict()
+	mc.updateMetrics()
+	mc.mutex.Unlock()
+}
+
+// store inserts or replaces an entry. The caller must hold mc.mutex.
+func (mc *memoryCache) store(user *User, stored time.Time) {
+	entry := &memoryEntry{user: user, stored: stored}
+	if element, ok := mc.users[user.ID]; ok {
+		mc.bytes -= entrySize(element.Value.(*memoryEntry).user)
+		element.Value = entry
+		mc.order.MoveToFront(element)
+	} else {
+		mc.users[user.ID] = mc.order.PushFront(entry)
+	}
+	mc.bytes += entrySize(user)
+}
+
+// evict drops least recently used entries until the cache fits maxBytes.
+// The caller must hold mc.mutex.
+func (mc *memoryCache) evict() {
+	for mc.maxBytes > 0 && mc.bytes > mc.maxBytes {
+		mc.remove(mc.order.Back())
+	}
+}
+
+func (mc *memoryCache) Delete(id UserID) {
+	mc.DeleteMany([]UserID{id})
+}
+
+func (mc *memoryCache) DeleteMany(ids []UserID) {
+	mc.mutex.Lock()
+	for _, id := range ids {
+		if element, ok := mc.users[id]; ok {
+			mc.remove(element)
+		}
+	}
+	mc.updateMetrics()
+	mc.mutex.Unlock()
+}
+
+// Inspect leaves the LRU order alone. Entries live until evicted or
+// invalidated, so Expires is always zero.
+func (mc *memoryCache) Inspect(id UserID) (CacheEntryInfo, bool) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	element, ok := mc.users[id]
+	if !ok {
+		return CacheEntryInfo{}, false
+	}
+	entry := element.Value.(*memoryEntry)
+	return CacheEntryInfo{User: entry.user, Stored: entry.stored}, true
+}
+
+// remove drops an entry. The caller must hold mc.mutex.
+func (mc *memoryCache) remove(element *list.Element) {
+	user := mc.order.Remove(element).(*memoryEntry).user
+	delete(mc.users, user.ID)
+	mc.bytes -= entrySize(user)
+}
+
+// updateMetrics publishes the cache gauges. The caller must hold mc.mutex.
+func (mc *memoryCache) updateMetrics() {
+	cacheSize.Set(float64(len(mc.users)))
+	cacheBytes.Set(float64(mc.bytes))
+}
+
+func (mc *memoryCache) Clear() {
+	mc.mutex.Lock()
+	mc.users = make(map[UserID]*list.Element)
+	mc.order.Init()
+	mc.bytes = 0
+	mc.updateMetrics()
+	mc.mutex.Unlock()
+}
+
+func (mc *memoryCache) Len() int {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	return len(mc.users)
+}
+
+// Ping always succeeds, the in-memory backend can't be unreachable.
+func (mc *memoryCache) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close drops all entries, there is nothing else to release.
+func (mc *memoryCache) Close() error {
+	mc.Clear()
+	return nil
+}
+
+// UserService locks are all leaves: mutex, the cache's internal lock,
+// responseMutex, staleMutex, ipMutex, reindex.mutex and the SSE hub's lock
+// are each released before calling anything that could take another, and
+// none is ever held across a DB call. Keep it that way rather than defining an
+// order; if two locks must nest, take mutex first and the cache lock last.
+//
+// Users returned by the cache are shared between requests and must be
+// treated as read-only; processUserData works on a copy for this reason.
 type UserService struct {
-	db       *sql.DB
-	cache    map[int]*User
-	mutex    sync.RWMutex
+	db     *sql.DB
+	config *Config
+	cache  Cache
+	mutex  sync.RWMutex
+
+	// Expiry times of IDs recently found missing, guarded by mutex
+	notFound map[UserID]time.Time
 	listStmt *sql.Stmt
+
+	// Unix nanoseconds of the most recent successful write, seeded with the
+	// start time since writes before startup are unknown
+	lastMutation atomic.Int64
+
+	// Set when shutdown begins, /readyz fails from then on
+	shuttingDown atomic.Bool
+
+	// Drain steps for background subsystems, run during graceful shutdown
+	shutdownHooks []func(ctx context.Context)
+
+	reindex reindexJob
+
+	// Whole GET responses, keyed by responseCacheKey
+	responseMutex sync.Mutex
+	responses     map[string]*cachedResponse
+
+	// Bulkhead slots for DB-bound handlers, nil when unlimited
+	dbSlots chan struct{}
+
+	events *sseHub
+
+	// Last good search results, guarded by staleMutex
+	staleMutex    sync.Mutex
+	staleSearches map[string]staleSearchResult
+
+	// Coalesce identical in-flight searches and GetUser cache misses
+	searches singleflight.Group
+	lookups  singleflight.Group
+
+	// Per-route deadline overrides set by withTimeout. Only written while
+	// routes are registered, before serving starts, so reads need no lock.
+	routeTimeouts map[*mux.Route]time.Duration
+
+	// Routes switched off by DISABLED_ROUTES, swapped whole on SIGHUP
+	disabledRoutes atomic.Pointer[map[string]bool]
+
+	// In-flight requests per client IP, guarded by ipMutex. Entries are
+	// removed when their count drops to zero, so idle clients cost nothing.
+	ipMutex    sync.Mutex
+	ipInFlight map[string]int
+}
+
+type Config struct {
+	Port              string
+	FuzzyThreshold    float64
+	SearchMinLength   int
+	SearchMaxResults  int
+	SearchMaxCount    int
+	SearchPageSize    int
+	SearchFields      []string
+	SearchMaxDuration time.Duration
+	ListPageSize      int
+	ListMaxPageSize   int
+	RenderMarkdown    bool
+	ListEnvelope      bool
+	ListSunset        time.Time
+	TrustedProxies    []netip.Prefix
+	DuplicatePrecheck bool
+	NegativeCacheTTL  time.Duration
+	AdminToken        string
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	RequestTimeout    time.Duration
+	SlowRouteTimeout  time.Duration
+	StatementTimeout  time.Duration
+	LogLevel          slog.Level
+	LogFormat         string
+	Isolation         sql.IsolationLevel
+	BioWhitespace     string
+	CacheRebuildLimit int
+	IDChunkSize       int
+	MaxBodyBytes      int64
+	CacheMaxBytes     int64
+	CacheWarmLimit    int
+	CacheWarmBatch    int
+	CacheWarmDelay    time.Duration
+	WebhookURL        string
+	WebhookAttempts   int
+	WebhookBackoff    time.Duration
+	WebhookInterval   time.Duration
+	WebhookTimeout    time.Duration
+	APIToken          string
+	CORSOrigins       []string
+	MethodOverride    bool
+	ListSort          string
+	InvalidUTF8       string
+	IDType            string
+	ShutdownTimeout   time.Duration
+	ShutdownDelay     time.Duration
+	ResponseCacheTTL  time.Duration
+	DBMaxConcurrency  int
+	DBQueueTimeout    time.Duration
+	PerIPConcurrency  int
+	SSEMaxSubscribers int
+	SSEBuffer         int
+	RequestIDHeader   string
+	EscapeHTML        bool
+	AllowPrettyJSON   bool
+	TrimIdentifiers   bool
+	ServeStaleOnError bool
+	StaleSearchTTL    time.Duration
+
+	// TLS is served when both files are set. TLSCipherSuites only applies
+	// to TLS 1.2, Go does not allow configuring 1.3 suites.
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSMinVersion   uint16
+	TLSCipherSuites []uint16
+
+	// Soft-deleted rows older than this are removed by /admin/purge-deleted
+	SoftDeleteRetention time.Duration
+	PurgeBatchSize      int
+
+	// Paths served without API_TOKEN, see exemptPath for the pattern syntax
+	ExemptPaths []string
+
+	// Routes answered with DisabledRouteStatus, see middlewareFeatureFlags.
+	// DisabledRoutesFile is re-read on SIGHUP and adds to DisabledRoutes.
+	DisabledRoutes      []string
+	DisabledRoutesFile  string
+	DisabledRouteStatus int
+
+	// Lowercased email domains accepted at registration, empty allows all
+	AllowedEmailDomains []string
+
+	// Lowercased usernames regular users can't claim
+	ReservedUsernames map[string]bool
+
+	// Loaded from DISPOSABLE_EMAIL_DOMAINS_FILE when REJECT_DISPOSABLE_EMAILS is set
+	DisposableEmailDomains map[string]bool
 }
 
 var (
 	emailRegex    *regexp.Regexp
 	usernameRegex *regexp.Regexp
-	globalUsers   []User
-	requestCount  int
-	counterMutex  sync.Mutex
+	uuidRegex     *regexp.Regexp
+
+	routeVariablePattern *regexp.Regexp
+
+	markdownCode   *regexp.Regexp
+	markdownBold   *regexp.Regexp
+	markdownItalic *regexp.Regexp
+	markdownLink   *regexp.Regexp
+
+	// Per-route request counts, route label to *atomic.Int64
+	requestCounts sync.Map
+
+	// Overridden at build time via -ldflags "-X main.version=..."
+	version   = "dev"
+	gitCommit = "dev"
+	buildTime = "dev"
+
+	// Default for SHUTDOWN_TIMEOUT, how long in-flight requests get to finish
+	// once a shutdown signal arrives
+	shutdownTimeout = 15 * time.Second
+
+	// Upper bound on closing the cache and the DB pool during shutdown
+	closeTimeout = 5 * time.Second
+
+	// Size at which expired negative cache entries are swept
+	maxNotFoundEntries = 10000
+
+	// Size at which the response cache is flushed
+	maxCachedResponses = 1000
+
+	// Upper bound on each dependency check made by /readyz
+	readinessTimeout = 2 * time.Second
+
+	// Upper bound on the whole /selftest round-trip
+	selfTestTimeout = 5 * time.Second
+
+	// How often the connection pool gauges are refreshed
+	dbStatsInterval = 5 * time.Second
+
+	// Set by initDB when the pg_trgm extension could be enabled
+	trigramAvailable bool
 
 	// Prometheus metrics
 	httpDuration = prometheus.NewHistogramVec(
@@ -51,6 +654,13 @@ var (
 		},
 		[]string{"path", "method"},
 	)
+	getUserDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "get_user_duration_seconds",
+			Help: "Duration of GetUser requests by whether the cache or the DB answered.",
+		},
+		[]string{"source"},
+	)
 	httpRequests = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "http_requests_total",
@@ -64,335 +674,4317 @@ var (
 			Help: "Number of active database connections.",
 		},
 	)
+	dbConnectionsIdle = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "database_connections_idle",
+			Help: "Number of idle database connections.",
+		},
+	)
+	dbConnectionsInUse = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "database_connections_in_use",
+			Help: "Number of database connections currently in use.",
+		},
+	)
+	dbWaitCount = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "database_wait_count",
+			Help: "Total number of connections waited for since startup.",
+		},
+	)
+	cacheHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_hits_total",
+			Help: "Number of user lookups served from cache.",
+		},
+	)
+	cacheMisses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_misses_total",
+			Help: "Number of user lookups that missed the cache.",
+		},
+	)
 	cacheSize = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "cache_entries_total",
 			Help: "Number of entries in cache.",
 		},
 	)
+	dbQueued = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "db_bulkhead_queued",
+			Help: "Number of requests waiting for a DB concurrency slot.",
+		},
+	)
+	requestsCoalesced = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "request_coalesced_total",
+			Help: "Number of requests served from another request's in-flight query.",
+		},
+		[]string{"operation"},
+	)
+	sseSubscribers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sse_subscribers",
+			Help: "Number of connected event stream subscribers.",
+		},
+	)
+	sseDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sse_events_dropped_total",
+			Help: "Number of events dropped because a subscriber's buffer was full.",
+		},
+	)
+	cacheBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cache_bytes",
+			Help: "Approximate size of cached entries in bytes.",
+		},
+	)
 )
 
-func init() {
-	emailRegex = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
-	usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9_]{3,20}$`)
+func init() {
+	emailRegex = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
+	usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9_]{3,20}$`)
+	uuidRegex = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+	routeVariablePattern = regexp.MustCompile(`\{([^}:]+):[^}]*\}`)
+
+	markdownCode = regexp.MustCompile("`([^`]+)`")
+	markdownBold = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	markdownItalic = regexp.MustCompile(`\*([^*]+)\*`)
+	markdownLink = regexp.MustCompile(`\[([^\]]+)\]\((https?://[^\s()]+)\)`)
+
+	prometheus.MustRegister(httpDuration)
+	prometheus.MustRegister(httpRequests)
+	prometheus.MustRegister(getUserDuration)
+	prometheus.MustRegister(dbConnections)
+	prometheus.MustRegister(dbConnectionsIdle)
+	prometheus.MustRegister(dbConnectionsInUse)
+	prometheus.MustRegister(dbWaitCount)
+	prometheus.MustRegister(dbQueued)
+	prometheus.MustRegister(requestsCoalesced)
+	prometheus.MustRegister(sseSubscribers)
+	prometheus.MustRegister(sseDropped)
+	prometheus.MustRegister(cacheSize)
+	prometheus.MustRegister(cacheBytes)
+	prometheus.MustRegister(cacheHits)
+	prometheus.MustRegister(cacheMisses)
+}
+
+// Bio whitespace normalization modes accepted by BIO_WHITESPACE
+const (
+	bioWhitespaceCollapse         = "collapse"
+	bioWhitespacePreserveNewlines = "preserve-newlines"
+)
+
+// Transaction isolation levels accepted by DB_ISOLATION
+var isolationLevels = map[string]sql.IsolationLevel{
+	"read-committed":  sql.LevelReadCommitted,
+	"repeatable-read": sql.LevelRepeatableRead,
+	"serializable":    sql.LevelSerializable,
+}
+
+func loadConfig() *Config {
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := applyConfigFile(path); err != nil {
+			log.Fatal("Failed to load CONFIG_FILE:", err)
+		}
+	}
+
+	cfg := &Config{
+		Port:              "8080",
+		FuzzyThreshold:    0.3,
+		SearchMinLength:   2,
+		SearchMaxResults:  100,
+		SearchPageSize:    100,
+		ListPageSize:      20,
+		ListMaxPageSize:   100,
+		RenderMarkdown:    true,
+		DuplicatePrecheck: true,
+		ReadTimeout:       15 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		SlowRouteTimeout:  2 * time.Minute,
+		LogLevel:          slog.LevelInfo,
+		LogFormat:         "json",
+		Isolation:         sql.LevelReadCommitted,
+		BioWhitespace:     bioWhitespaceCollapse,
+		CacheRebuildLimit: 1000,
+		IDChunkSize:       1000,
+		MaxBodyBytes:      1 << 20,
+		CacheWarmBatch:    100,
+		CacheWarmDelay:    100 * time.Millisecond,
+		WebhookAttempts:   5,
+		WebhookBackoff:    time.Second,
+		WebhookInterval:   2 * time.Second,
+		WebhookTimeout:    5 * time.Second,
+		ExemptPaths:       defaultExemptPaths,
+		ListSort:          "desc",
+		InvalidUTF8:       invalidUTF8Replace,
+		SearchFields:      searchableFields,
+		SearchMaxDuration: 10 * time.Second,
+		SearchMaxCount:    10000,
+		IDType:            idTypeInteger,
+		ShutdownTimeout:   shutdownTimeout,
+		DBQueueTimeout:    time.Second,
+		SSEMaxSubscribers: 100,
+		SSEBuffer:         16,
+		RequestIDHeader:   "X-Request-ID",
+		TLSMinVersion:     tls.VersionTLS12,
+		TrimIdentifiers:   true,
+		AllowPrettyJSON:   true,
+		StaleSearchTTL:    5 * time.Minute,
+
+		SoftDeleteRetention: 30 * 24 * time.Hour,
+		PurgeBatchSize:      1000,
+		DisabledRouteStatus: http.StatusServiceUnavailable,
+	}
+
+	if port := os.Getenv("PORT"); port != "" {
+		cfg.Port = port
+	}
+
+	if threshold := os.Getenv("FUZZY_THRESHOLD"); threshold != "" {
+		value, err := strconv.ParseFloat(threshold, 64)
+		if err != nil || value < 0 || value > 1 {
+			log.Fatal("Invalid FUZZY_THRESHOLD, expected a value between 0 and 1:", threshold)
+		}
+		cfg.FuzzyThreshold = value
+	}
+
+	cfg.SearchMinLength = envInt("SEARCH_MIN_LENGTH", cfg.SearchMinLength)
+	cfg.SearchMaxResults = envInt("SEARCH_MAX_RESULTS", cfg.SearchMaxResults)
+	cfg.SearchPageSize = envInt("SEARCH_PAGE_SIZE", min(cfg.SearchPageSize, cfg.SearchMaxResults))
+	cfg.SearchMaxDuration = envDuration("SEARCH_MAX_DURATION", cfg.SearchMaxDuration)
+	cfg.SearchMaxCount = envInt("SEARCH_MAX_COUNT", cfg.SearchMaxCount)
+	cfg.ListMaxPageSize = envInt("LIST_MAX_PAGE_SIZE", cfg.ListMaxPageSize)
+	cfg.ListPageSize = envInt("LIST_PAGE_SIZE", min(cfg.ListPageSize, cfg.ListMaxPageSize))
+	if cfg.ListPageSize > cfg.ListMaxPageSize || cfg.SearchPageSize > cfg.SearchMaxResults {
+		log.Fatal("Page sizes must not exceed their maximums (LIST_MAX_PAGE_SIZE, SEARCH_MAX_RESULTS)")
+	}
+	cfg.CacheRebuildLimit = envInt("CACHE_REBUILD_LIMIT", cfg.CacheRebuildLimit)
+	cfg.IDChunkSize = envInt("ID_CHUNK_SIZE", cfg.IDChunkSize)
+	if cfg.IDChunkSize < 1 {
+		log.Fatal("Invalid ID_CHUNK_SIZE, expected at least 1:", cfg.IDChunkSize)
+	}
+	cfg.MaxBodyBytes = int64(envInt("MAX_BODY_BYTES", int(cfg.MaxBodyBytes)))
+	cfg.CacheMaxBytes = int64(envInt("CACHE_MAX_BYTES", int(cfg.CacheMaxBytes)))
+	cfg.CacheWarmLimit = envInt("CACHE_WARM_LIMIT", cfg.CacheWarmLimit)
+	cfg.CacheWarmBatch = envInt("CACHE_WARM_BATCH_SIZE", cfg.CacheWarmBatch)
+	cfg.CacheWarmDelay = envDuration("CACHE_WARM_BATCH_DELAY", cfg.CacheWarmDelay)
+	cfg.WebhookURL = os.Getenv("WEBHOOK_URL")
+	cfg.WebhookAttempts = envInt("WEBHOOK_MAX_ATTEMPTS", cfg.WebhookAttempts)
+	cfg.WebhookBackoff = envDuration("WEBHOOK_BACKOFF", cfg.WebhookBackoff)
+	cfg.WebhookInterval = envDuration("WEBHOOK_POLL_INTERVAL", cfg.WebhookInterval)
+	cfg.WebhookTimeout = envDuration("WEBHOOK_TIMEOUT", cfg.WebhookTimeout)
+	cfg.RenderMarkdown = envBool("RENDER_MARKDOWN", cfg.RenderMarkdown)
+	cfg.EscapeHTML = envBool("JSON_ESCAPE_HTML", cfg.EscapeHTML)
+	cfg.AllowPrettyJSON = envBool("JSON_ALLOW_PRETTY", cfg.AllowPrettyJSON)
+	cfg.TrimIdentifiers = envBool("TRIM_IDENTIFIERS", cfg.TrimIdentifiers)
+	cfg.ServeStaleOnError = envBool("SERVE_STALE_ON_ERROR", cfg.ServeStaleOnError)
+	cfg.StaleSearchTTL = envDuration("STALE_SEARCH_TTL", cfg.StaleSearchTTL)
+	cfg.ListEnvelope = envBool("LIST_ENVELOPE", cfg.ListEnvelope)
+	if sunset := os.Getenv("LIST_SUNSET"); sunset != "" {
+		date, err := time.Parse(time.DateOnly, sunset)
+		if err != nil {
+			log.Fatal("Invalid LIST_SUNSET, expected a YYYY-MM-DD date:", sunset)
+		}
+		cfg.ListSunset = date
+	}
+	cfg.DuplicatePrecheck = envBool("DUPLICATE_PRECHECK", cfg.DuplicatePrecheck)
+	if isolation := os.Getenv("DB_ISOLATION"); isolation != "" {
+		level, ok := isolationLevels[isolation]
+		if !ok {
+			log.Fatal("Invalid DB_ISOLATION, expected read-committed, repeatable-read or serializable:", isolation)
+		}
+		cfg.Isolation = level
+	}
+
+	if os.Getenv("SEARCH_FIELDS") != "" {
+		cfg.SearchFields = envList("SEARCH_FIELDS")
+		for _, field := range cfg.SearchFields {
+			if !slices.Contains(searchableFields, field) {
+				log.Fatal("Invalid SEARCH_FIELDS entry, expected username, email or bio:", field)
+			}
+		}
+		// Fuzzy search needs a column other than bio to score
+		if !slices.Contains(cfg.SearchFields, "username") && !slices.Contains(cfg.SearchFields, "email") {
+			log.Fatal("SEARCH_FIELDS must include username or email")
+		}
+	}
+
+	if sort := strings.ToLower(os.Getenv("LIST_SORT")); sort != "" {
+		if sort != "asc" && sort != "desc" {
+			log.Fatal("Invalid LIST_SORT, expected asc or desc:", sort)
+		}
+		cfg.ListSort = sort
+	}
+
+	if mode := os.Getenv("INVALID_UTF8"); mode != "" {
+		if mode != invalidUTF8Replace && mode != invalidUTF8Reject {
+			log.Fatal("Invalid INVALID_UTF8, expected replace or reject:", mode)
+		}
+		cfg.InvalidUTF8 = mode
+	}
+
+	if idType := strings.ToLower(os.Getenv("ID_TYPE")); idType != "" {
+		if idType != idTypeInteger && idType != idTypeUUID {
+			log.Fatal("Invalid ID_TYPE, expected integer or uuid:", idType)
+		}
+		cfg.IDType = idType
+	}
+
+	if mode := os.Getenv("BIO_WHITESPACE"); mode != "" {
+		if mode != bioWhitespaceCollapse && mode != bioWhitespacePreserveNewlines {
+			log.Fatal("Invalid BIO_WHITESPACE, expected collapse or preserve-newlines:", mode)
+		}
+		cfg.BioWhitespace = mode
+	}
+
+	cfg.NegativeCacheTTL = envDuration("NEGATIVE_CACHE_TTL", cfg.NegativeCacheTTL)
+	cfg.AdminToken = os.Getenv("ADMIN_TOKEN")
+	cfg.APIToken = os.Getenv("API_TOKEN")
+	cfg.CORSOrigins = envList("CORS_ALLOWED_ORIGINS")
+	cfg.PerIPConcurrency = envInt("PER_IP_MAX_CONCURRENCY", cfg.PerIPConcurrency)
+	cfg.DisabledRoutes = envList("DISABLED_ROUTES")
+	cfg.DisabledRoutesFile = os.Getenv("DISABLED_ROUTES_FILE")
+	cfg.DisabledRouteStatus = envInt("DISABLED_ROUTE_STATUS", cfg.DisabledRouteStatus)
+	if cfg.DisabledRouteStatus != http.StatusNotFound && cfg.DisabledRouteStatus != http.StatusServiceUnavailable {
+		log.Fatal("Invalid DISABLED_ROUTE_STATUS, expected 404 or 503:", cfg.DisabledRouteStatus)
+	}
+	cfg.MethodOverride = envBool("METHOD_OVERRIDE", false)
+	if os.Getenv("AUTH_EXEMPT_PATHS") != "" {
+		cfg.ExemptPaths = envList("AUTH_EXEMPT_PATHS")
+	}
+	cfg.ReadTimeout = envDuration("READ_TIMEOUT", cfg.ReadTimeout)
+	cfg.ReadHeaderTimeout = envDuration("READ_HEADER_TIMEOUT", cfg.ReadHeaderTimeout)
+	cfg.WriteTimeout = envDuration("WRITE_TIMEOUT", cfg.WriteTimeout)
+	cfg.RequestTimeout = envDuration("REQUEST_TIMEOUT", cfg.RequestTimeout)
+	cfg.SlowRouteTimeout = envDuration("SLOW_ROUTE_TIMEOUT", cfg.SlowRouteTimeout)
+	// A statement_timeout under a route's own timeout would kill queries the
+	// route still allows, so it defaults to the longest and can't be lower
+	longestRoute := max(cfg.RequestTimeout, cfg.SlowRouteTimeout)
+	cfg.StatementTimeout = envDuration("STATEMENT_TIMEOUT", longestRoute)
+	if cfg.StatementTimeout > 0 && cfg.StatementTimeout < longestRoute {
+		log.Fatalf("Invalid STATEMENT_TIMEOUT, expected 0 or at least the longest route timeout (%s): %s", longestRoute, cfg.StatementTimeout)
+	}
+	cfg.IdleTimeout = envDuration("IDLE_TIMEOUT", cfg.IdleTimeout)
+	cfg.ShutdownTimeout = envDuration("SHUTDOWN_TIMEOUT", cfg.ShutdownTimeout)
+	cfg.ShutdownDelay = envDuration("SHUTDOWN_READINESS_DELAY", cfg.ShutdownDelay)
+	cfg.ResponseCacheTTL = envDuration("RESPONSE_CACHE_TTL", cfg.ResponseCacheTTL)
+	cfg.DBMaxConcurrency = envInt("DB_MAX_CONCURRENCY", cfg.DBMaxConcurrency)
+	cfg.DBQueueTimeout = envDuration("DB_QUEUE_TIMEOUT", cfg.DBQueueTimeout)
+	cfg.SSEMaxSubscribers = envInt("SSE_MAX_SUBSCRIBERS", cfg.SSEMaxSubscribers)
+	cfg.SSEBuffer = envInt("SSE_BUFFER", cfg.SSEBuffer)
+	cfg.TLSCertFile = os.Getenv("TLS_CERT_FILE")
+	cfg.TLSKeyFile = os.Getenv("TLS_KEY_FILE")
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if version := os.Getenv("TLS_MIN_VERSION"); version != "" {
+		minVersion, ok := tlsVersions[version]
+		if !ok {
+			log.Fatal("Invalid TLS_MIN_VERSION, expected 1.2 or 1.3:", version)
+		}
+		cfg.TLSMinVersion = minVersion
+	}
+	if suites := os.Getenv("TLS_CIPHER_SUITES"); suites != "" {
+		ids, err := parseCipherSuites(suites)
+		if err != nil {
+			log.Fatal("Invalid TLS_CIPHER_SUITES: ", err)
+		}
+		cfg.TLSCipherSuites = ids
+	}
+
+	if header := os.Getenv("REQUEST_ID_HEADER"); header != "" {
+		cfg.RequestIDHeader = http.CanonicalHeaderKey(header)
+	}
+	cfg.SoftDeleteRetention = envDuration("SOFT_DELETE_RETENTION", cfg.SoftDeleteRetention)
+	cfg.PurgeBatchSize = envInt("PURGE_BATCH_SIZE", cfg.PurgeBatchSize)
+	cfg.AllowedEmailDomains = envList("ALLOWED_EMAIL_DOMAINS")
+	reserved := defaultReservedUsernames
+	if _, set := os.LookupEnv("RESERVED_USERNAMES"); set {
+		// Set but empty reserves nothing
+		reserved = envList("RESERVED_USERNAMES")
+	}
+	cfg.ReservedUsernames = make(map[string]bool, len(reserved))
+	for _, name := range reserved {
+		cfg.ReservedUsernames[name] = true
+	}
+
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		if err := cfg.LogLevel.UnmarshalText([]byte(level)); err != nil {
+			log.Fatal("Invalid LOG_LEVEL, expected debug, info, warn or error:", level)
+		}
+	}
+	if format := os.Getenv("LOG_FORMAT"); format != "" {
+		if format != "json" && format != "text" {
+			log.Fatal("Invalid LOG_FORMAT, expected json or text:", format)
+		}
+		cfg.LogFormat = format
+	}
+
+	if envBool("REJECT_DISPOSABLE_EMAILS", false) {
+		path := os.Getenv("DISPOSABLE_EMAIL_DOMAINS_FILE")
+		if path == "" {
+			log.Fatal("REJECT_DISPOSABLE_EMAILS requires DISPOSABLE_EMAIL_DOMAINS_FILE")
+		}
+		domains, err := loadListFile(path)
+		if err != nil {
+			log.Fatal("Failed to load disposable email domains:", err)
+		}
+		cfg.DisposableEmailDomains = domains
+	}
+
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		for _, entry := range strings.Split(proxies, ",") {
+			prefix, err := parsePrefix(strings.TrimSpace(entry))
+			if err != nil {
+				log.Fatalf("Invalid TRUSTED_PROXIES entry %q: %v", entry, err)
+			}
+			cfg.TrustedProxies = append(cfg.TrustedProxies, prefix)
+		}
+	}
+
+	return cfg
+}
+
+// applyConfigFile seeds settings from a JSON file mapping environment
+// variable names to values, e.g. {"PORT": 8080, "LOG_FORMAT": "text"}. A
+// variable already set in the environment wins over the file, and the
+// merged settings then go through the same parsing and validation as plain
+// env vars. A missing file is logged and ignored so the defaults apply.
+func applyConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Warn("CONFIG_FILE not found, using environment and defaults", "path", path)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Numbers are kept as written: float64 would turn 10000000 into 1e+07,
+	// which envInt can't parse
+	var settings map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&settings); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return fmt.Errorf("%s: unexpected data after the settings object", path)
+	}
+	for name, value := range settings {
+		if _, set := os.LookupEnv(name); set {
+			continue
+		}
+		var text string
+		switch v := value.(type) {
+		case string:
+			text = v
+		case json.Number:
+			text = v.String()
+		case bool:
+			text = strconv.FormatBool(v)
+		case []interface{}:
+			// Lists such as TRUSTED_PROXIES become comma-separated
+			parts := make([]string, len(v))
+			for i, part := range v {
+				parts[i] = fmt.Sprint(part)
+			}
+			text = strings.Join(parts, ",")
+		default:
+			return fmt.Errorf("%s: unsupported value for %s", path, name)
+		}
+		os.Setenv(name, text)
+	}
+	return nil
+}
+
+// tlsVersions accepted by TLS_MIN_VERSION. Anything older than 1.2 is
+// rejected as weak.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseCipherSuites resolves a comma-separated list of Go cipher suite names
+// such as TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. Suites Go classes as
+// insecure are refused rather than silently accepted.
+func parseCipherSuites(value string) ([]uint16, error) {
+	secure := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite.ID
+	}
+	insecure := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if insecure[name] {
+			return nil, fmt.Errorf("%s is insecure", name)
+		}
+		id, ok := secure[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// loadListFile reads a lowercased set with one entry per line, ignoring
+// blank lines and lines starting with #.
+func loadListFile(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries[line] = true
+	}
+	return entries, scanner.Err()
+}
+
+// parsePrefix accepts either a CIDR or a bare address, which is treated as a
+// single-host prefix.
+func parsePrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		return netip.ParsePrefix(value)
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// envList reads a comma-separated setting as lowercased, trimmed entries.
+func envList(name string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.ToLower(strings.TrimSpace(value)); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func envBool(name string, defaultValue bool) bool {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return defaultValue
+	}
+
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		log.Fatalf("Invalid %s, expected true or false: %s", name, raw)
+	}
+	return value
+}
+
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return defaultValue
+	}
+
+	value, err := time.ParseDuration(raw)
+	if err != nil || value < 0 {
+		log.Fatalf("Invalid %s, expected a duration such as 30s: %s", name, raw)
+	}
+	return value
+}
+
+// envInt reads a positive integer setting, exiting on malformed values so
+// misconfiguration is caught at startup rather than on first use.
+func envInt(name string, defaultValue int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return defaultValue
+	}
+
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < 1 {
+		log.Fatalf("Invalid %s, expected a positive integer: %s", name, raw)
+	}
+	return value
+}
+
+func newLogger(cfg *Config, out io.Writer) *slog.Logger {
+	options := &slog.HandlerOptions{Level: cfg.LogLevel}
+	if cfg.LogFormat == "text" {
+		return slog.New(slog.NewTextHandler(out, options))
+	}
+	return slog.New(slog.NewJSONHandler(out, options))
+}
+
+// listOrderBy orders listings by creation time in the LIST_SORT direction,
+// with id as a tiebreaker so rows sharing a timestamp (bulk inserts) keep a
+// stable order across pages.
+func listOrderBy(sort string) string {
+	direction := "DESC"
+	if sort == "asc" {
+		direction = "ASC"
+	}
+	return "ORDER BY created " + direction + ", id " + direction
+}
+
+func NewUserService(db *sql.DB, config *Config) *UserService {
+	listStmt, err := db.Prepare("SELECT " + userColumns + " FROM users WHERE active AND deleted_at IS NULL " + listOrderBy(config.ListSort) + " LIMIT $1 OFFSET $2")
+	if err != nil {
+		log.Fatal("Failed to prepare statement:", err)
+	}
+
+	us := &UserService{
+		db:            db,
+		config:        config,
+		cache:         newMemoryCache(config.CacheMaxBytes),
+		notFound:      make(map[UserID]time.Time),
+		responses:     make(map[string]*cachedResponse),
+		staleSearches: make(map[string]staleSearchResult),
+		ipInFlight:    make(map[string]int),
+		routeTimeouts: make(map[*mux.Route]time.Duration),
+		events:        newSSEHub(config.SSEMaxSubscribers, config.SSEBuffer),
+		listStmt:      listStmt,
+	}
+	if config.DBMaxConcurrency > 0 {
+		us.dbSlots = make(chan struct{}, config.DBMaxConcurrency)
+	}
+	if err := us.reloadDisabledRoutes(); err != nil {
+		log.Fatal("Failed to load DISABLED_ROUTES_FILE:", err)
+	}
+	us.recordMutation()
+	return us
+}
+
+// reloadDisabledRoutes rebuilds the disabled route set from DISABLED_ROUTES
+// and DISABLED_ROUTES_FILE. On error the previous set stays in effect.
+func (us *UserService) reloadDisabledRoutes() error {
+	disabled := make(map[string]bool)
+	if us.config.DisabledRoutesFile != "" {
+		entries, err := loadListFile(us.config.DisabledRoutesFile)
+		if err != nil {
+			return err
+		}
+		disabled = entries
+	}
+	for _, route := range us.config.DisabledRoutes {
+		disabled[route] = true
+	}
+	us.disabledRoutes.Store(&disabled)
+	return nil
+}
+
+// reloadOnHangup re-reads DISABLED_ROUTES_FILE on each SIGHUP until ctx is
+// done, so routes can be switched off during an incident without a restart.
+func (us *UserService) reloadOnHangup(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			if err := us.reloadDisabledRoutes(); err != nil {
+				slog.Error("Failed to reload DISABLED_ROUTES_FILE, keeping previous routes", "error", err)
+				continue
+			}
+			slog.Info("Reloaded disabled routes", "count", len(*us.disabledRoutes.Load()))
+		}
+	}
+}
+
+// beginTx starts a write transaction at the configured DB_ISOLATION level.
+func (us *UserService) beginTx(ctx context.Context) (*sql.Tx, error) {
+	return us.db.BeginTx(ctx, &sql.TxOptions{Isolation: us.config.Isolation})
+}
+
+func (us *UserService) recordMutation() {
+	us.lastMutation.Store(time.Now().UnixNano())
+}
+
+// OnShutdown registers a drain step for a background subsystem. Hooks run
+// alongside the HTTP server shutdown, so long-lived streams can be closed
+// while the server waits for them, and must return once ctx expires.
+func (us *UserService) OnShutdown(hook func(ctx context.Context)) {
+	us.shutdownHooks = append(us.shutdownHooks, hook)
+}
+
+func (us *UserService) drain(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, hook := range us.shutdownHooks {
+		wg.Add(1)
+		go func(hook func(ctx context.Context)) {
+			defer wg.Done()
+			hook(ctx)
+		}(hook)
+	}
+	wg.Wait()
+}
+
+func (us *UserService) CreateUser(w http.ResponseWriter, r *http.Request) {
+	var user User
+	if err := us.decodeUserJSON(r, &user); err != nil {
+		respondWithDecodeError(w, err, "Invalid JSON")
+		return
+	}
+
+	if errs := us.validateUserFields(&user, nil); len(errs) > 0 {
+		us.respondWithValidationErrors(w, errs)
+		return
+	}
+
+	if us.config.DuplicatePrecheck {
+		field, err := us.findDuplicate(r.Context(), user.Username, user.Email)
+		if err != nil {
+			respondWithDBError(w, r, err)
+			return
+		}
+		if field != "" {
+			respondWithError(w, http.StatusConflict, duplicateCodes[field], fmt.Sprintf("A user with this %s already exists", field))
+			return
+		}
+	}
+
+	// ON CONFLICT makes a racing duplicate come back as no row rather than an
+	// error, so concurrent creates resolve to exactly one 201
+	query := `
+		INSERT INTO users (username, email, bio) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+		RETURNING ` + userColumns
+
+	// created, updated and active come from the column defaults, so the
+	// response carries the DB's clock rather than ours and ignores any
+	// values the client sent for them
+	user, err := scanUser(us.db.QueryRowContext(r.Context(), query, user.Username, user.Email, user.Bio))
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusConflict, codeDuplicateUser, "User already exists")
+		return
+	} else if err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+
+	us.recordMutation()
+	us.publishEvent(r.Context(), "user.created", user)
+
+	us.cache.Set(&user)
+	us.mutex.Lock()
+	delete(us.notFound, user.ID)
+	us.mutex.Unlock()
+
+	w.Header().Set("Location", userLocation(user.ID))
+	us.respondWithUser(w, r, http.StatusCreated, user)
+}
+
+// DeactivateUser hides a user from listings and searches without deleting
+// the record. ActivateUser reverses it.
+func (us *UserService) DeactivateUser(w http.ResponseWriter, r *http.Request) {
+	us.setActive(w, r, false)
+}
+
+func (us *UserService) ActivateUser(w http.ResponseWriter, r *http.Request) {
+	us.setActive(w, r, true)
+}
+
+func (us *UserService) setActive(w http.ResponseWriter, r *http.Request, active bool) {
+	id, err := us.parseUserID(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, codeInvalidUserID, err.Error())
+		return
+	}
+
+	user, err := scanUser(us.db.QueryRowContext(r.Context(),
+		"UPDATE users SET active = $1, updated = CURRENT_TIMESTAMP WHERE id = $2 AND deleted_at IS NULL RETURNING "+userColumns, active, id))
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, codeUserNotFound, "User not found")
+		return
+	} else if err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+
+	us.recordMutation()
+	us.publishEvent(r.Context(), "user.updated", user)
+	us.cache.Delete(id)
+
+	us.respondWithUser(w, r, http.StatusOK, user)
+}
+
+// duplicateCodes maps findDuplicate's field to its error code.
+var duplicateCodes = map[string]string{
+	"username": codeDuplicateUsername,
+	"email":    codeDuplicateEmail,
+}
+
+// findDuplicate reports which of username or email is already taken, or ""
+// if neither is. The unique constraints remain authoritative, this only
+// avoids issuing an insert that is known to fail. Soft-deleted users don't
+// count, the unique indexes only cover live rows so a deleted user's
+// username and email are free again straight away.
+func (us *UserService) findDuplicate(ctx context.Context, username, email string) (string, error) {
+	var field string
+	err := us.db.QueryRowContext(ctx, `
+		SELECT CASE WHEN username = $1 THEN 'username' ELSE 'email' END
+		FROM users
+		WHERE (username = $1 OR LOWER(email) = LOWER($2)) AND deleted_at IS NULL
+		LIMIT 1`, username, email).Scan(&field)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return field, err
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+func (us *UserService) GetUser(w http.ResponseWriter, r *http.Request) {
+	// Requests rejected before a lookup leave source empty and aren't observed
+	start := time.Now()
+	source := ""
+	defer func() {
+		if source != "" {
+			getUserDuration.WithLabelValues(source).Observe(time.Since(start).Seconds())
+		}
+	}()
+
+	id, err := us.parseUserID(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, codeInvalidUserID, err.Error())
+		return
+	}
+
+	fields, err := parseFields(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, codeInvalidFields, err.Error())
+		return
+	}
+
+	lookupStart := time.Now()
+	cachedUser, exists := us.cache.Get(id)
+	recordTiming(r.Context(), timingCache, lookupStart)
+	if exists {
+		source = "cache"
+		cacheHits.Inc()
+		processedUser := us.processUserData(cachedUser, wantsHTMLBio(r))
+		if fields != nil {
+			us.respondWithJSON(w, http.StatusOK, projectUser(r, processedUser, fields))
+			return
+		}
+		us.respondWithJSON(w, http.StatusOK, presentUsers(r, processedUser))
+		return
+	}
+
+	us.mutex.RLock()
+	expiry, missing := us.notFound[id]
+	us.mutex.RUnlock()
+	cacheMisses.Inc()
+
+	if missing && time.Now().Before(expiry) {
+		source = "cache"
+		respondWithError(w, http.StatusNotFound, codeUserNotFound, "User not found")
+		return
+	}
+
+	source = "db"
+	if fields != nil {
+		us.getUserFields(w, r, id, fields)
+		return
+	}
+
+	queryStart := time.Now()
+	user, err := us.loadUser(r.Context(), id)
+	recordTiming(r.Context(), timingDB, queryStart)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, codeUserNotFound, "User not found")
+		return
+	} else if err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+
+	processedUser := us.processUserData(user, wantsHTMLBio(r))
+	us.respondWithJSON(w, http.StatusOK, presentUsers(r, processedUser))
+}
+
+// loadUser reads a user missing from the cache and caches it. Concurrent
+// misses for the same ID share one query, and the cache is checked again
+// inside the flight, so a miss that raced with another request's load reads
+// the fresh entry instead of querying. A missing ID is remembered and
+// reported as sql.ErrNoRows.
+//
+// The query runs under sharedContext rather than ctx, so the caller that
+// happened to start it going away doesn't fail everyone else waiting on the
+// same ID; each caller still stops waiting when its own ctx is done.
+func (us *UserService) loadUser(ctx context.Context, id UserID) (*User, error) {
+	queried := false
+	results := us.lookups.DoChan(string(id), func() (interface{}, error) {
+		queried = true
+		if cached, exists := us.cache.Get(id); exists {
+			return cached, nil
+		}
+
+		queryCtx, cancel := sharedContext(ctx)
+		defer cancel()
+		user, err := scanUser(us.db.QueryRowContext(queryCtx, "SELECT "+userColumns+" FROM users WHERE id = $1 AND deleted_at IS NULL", id))
+		if err == sql.ErrNoRows {
+			us.rememberNotFound(id)
+			return nil, err
+		} else if err != nil {
+			return nil, err
+		}
+		us.cache.Set(&user)
+		return &user, nil
+	})
+
+	var result singleflight.Result
+	select {
+	case result = <-results:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	// queried is only safe to read once the flight has delivered, which
+	// orders its write before this read
+	if !queried {
+		requestsCoalesced.WithLabelValues("get_user").Inc()
+	}
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	return result.Val.(*User), nil
+}
+
+// getUserFields serves a projected GetUser straight from the DB. Partial
+// rows are never cached.
+func (us *UserService) getUserFields(w http.ResponseWriter, r *http.Request, id UserID, fields []string) {
+	var row userRow
+	query := "SELECT " + strings.Join(fields, ", ") + " FROM users WHERE id = $1 AND deleted_at IS NULL"
+	queryStart := time.Now()
+	err := us.db.QueryRowContext(r.Context(), query, id).Scan(row.targets(fields)...)
+	recordTiming(r.Context(), timingDB, queryStart)
+	if err == sql.ErrNoRows {
+		us.rememberNotFound(id)
+		respondWithError(w, http.StatusNotFound, codeUserNotFound, "User not found")
+		return
+	} else if err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+	user := row.result()
+	processedUser := us.processUserData(&user, wantsHTMLBio(r))
+	us.respondWithJSON(w, http.StatusOK, projectUser(r, processedUser, fields))
+}
+
+// rememberNotFound records a tombstone for a missing ID so repeated lookups
+// within NegativeCacheTTL are answered without a query. Creating a user with
+// that ID clears it.
+func (us *UserService) rememberNotFound(id UserID) {
+	if us.config.NegativeCacheTTL <= 0 {
+		return
+	}
+
+	now := time.Now()
+	us.mutex.Lock()
+	// Sweep expired tombstones occasionally so probing many IDs can't grow the map forever
+	if len(us.notFound) >= maxNotFoundEntries {
+		for missingID, expiry := range us.notFound {
+			if now.After(expiry) {
+				delete(us.notFound, missingID)
+			}
+		}
+	}
+	us.notFound[id] = now.Add(us.config.NegativeCacheTTL)
+	us.mutex.Unlock()
+}
+
+// UserExists answers existence checks without returning the record. A cache
+// miss falls through to the DB but is deliberately not cached, so probes for
+// many IDs don't push out entries that are actually read.
+func (us *UserService) UserExists(w http.ResponseWriter, r *http.Request) {
+	id, err := us.parseUserID(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, codeInvalidUserID, err.Error())
+		return
+	}
+
+	lookupStart := time.Now()
+	_, cached := us.cache.Get(id)
+	recordTiming(r.Context(), timingCache, lookupStart)
+
+	exists := cached
+	if !cached {
+		queryStart := time.Now()
+		err = us.db.QueryRowContext(r.Context(), "SELECT EXISTS(SELECT 1 FROM users WHERE id = $1 AND deleted_at IS NULL)", id).Scan(&exists)
+		recordTiming(r.Context(), timingDB, queryStart)
+		if err != nil {
+			respondWithDBError(w, r, err)
+			return
+		}
+	}
+
+	us.respondWithJSON(w, http.StatusOK, map[string]bool{"exists": exists})
+}
+
+func (us *UserService) ListUsers(w http.ResponseWriter, r *http.Request) {
+	fields, err := parseFields(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, codeInvalidFields, err.Error())
+		return
+	}
+
+	// Timestamps are always read, even when not requested, for Last-Modified
+	page, err := parsePage(r, us.config.ListPageSize, us.config.ListMaxPageSize)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, codeInvalidPage, err.Error())
+		return
+	}
+
+	// ?verified= filters on email verification, absent returns everyone
+	var conditions []string
+	var args []interface{}
+	if raw := r.URL.Query().Get("verified"); raw != "" {
+		verified, err := strconv.ParseBool(raw)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, codeInvalidFilter, "Invalid verified filter, expected true or false")
+			return
+		}
+		args = append(args, verified)
+		conditions = append(conditions, fmt.Sprintf("email_verified = $%d", len(args)))
+	}
+	if !includeInactive(r) {
+		conditions = append(conditions, "active")
+	}
+	conditions = append(conditions, "deleted_at IS NULL")
+
+	columns := userFields
+	if fields != nil {
+		columns = withField(withField(fields, "created"), "updated")
+	}
+	// Rows stream in as they're scanned, so the DB span covers the loop
+	queryStart := time.Now()
+	var rows *sql.Rows
+	if fields == nil && len(args) == 0 && !includeInactive(r) {
+		rows, err = us.listStmt.QueryContext(r.Context(), page.Limit, page.Offset)
+	} else {
+		query := "SELECT " + strings.Join(columns, ", ") + " FROM users WHERE " + strings.Join(conditions, " AND ") + " "
+		query += fmt.Sprintf("%s LIMIT $%d OFFSET $%d", listOrderBy(us.config.ListSort), len(args)+1, len(args)+2)
+		rows, err = us.db.QueryContext(r.Context(), query, append(args, page.Limit, page.Offset)...)
+	}
+	if err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	users := make([]User, 0, page.Limit)
+	lastModified := time.Unix(0, us.lastMutation.Load())
+
+	for rows.Next() {
+		var row userRow
+		if err := rows.Scan(row.targets(columns)...); err != nil {
+			respondWithDBError(w, r, err)
+			return
+		}
+		if row.created.After(lastModified) {
+			lastModified = row.created
+		}
+		if row.updated.After(lastModified) {
+			lastModified = row.updated
+		}
+		user := row.result()
+		processedUser := us.processUserData(&user, false)
+		users = append(users, *processedUser)
+	}
+	// A deadline passing mid-scan ends the loop early, don't serve the
+	// partial page as if it were complete
+	if err := rows.Err(); err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+
+	recordTiming(r.Context(), timingDB, queryStart)
+
+	// Projected rows are partial, so only full rows are cached
+	if fields == nil {
+		cacheStart := time.Now()
+		us.updateCache(users)
+		recordTiming(r.Context(), timingCache, cacheStart)
+	}
+
+	// Render after caching so the cache keeps the raw markdown
+	if wantsHTMLBio(r) {
+		for i := range users {
+			users[i] = *us.processUserData(&users[i], true)
+		}
+	}
+
+	// HTTP dates have second precision
+	lastModified = lastModified.UTC().Truncate(time.Second)
+	w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !lastModified.After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if wantsNDJSON(r) {
+		us.respondWithNDJSON(w, len(users), func(i int) interface{} {
+			if fields != nil {
+				return projectUser(r, &users[i], fields)
+			}
+			return presentUsers(r, users[i])
+		})
+		return
+	}
+
+	envelope := us.wantsEnvelope(r)
+	if !envelope {
+		us.markBareArrayDeprecated(w)
+	}
+
+	if fields != nil {
+		projected := projectUsers(r, users, fields)
+		if envelope {
+			body := map[string]interface{}{"data": projected, "count": len(projected)}
+			if warnings := responseWarnings(w); warnings != nil {
+				body["warnings"] = warnings
+			}
+			us.respondWithJSON(w, http.StatusOK, body)
+			return
+		}
+		us.respondWithJSON(w, http.StatusOK, projected)
+		return
+	}
+
+	if envelope {
+		us.respondWithJSON(w, http.StatusOK, presentUsers(r, UserList{Data: users, Count: len(users), Warnings: responseWarnings(w)}))
+		return
+	}
+	us.respondWithJSON(w, http.StatusOK, presentUsers(r, users))
+}
+
+// Page is a ?limit=&offset= window over a result set.
+type Page struct {
+	Limit  int
+	Offset int
+}
+
+// parsePage reads ?limit= and ?offset= for an endpoint, applying its
+// default page size when limit is absent and refusing limits above max.
+func parsePage(r *http.Request, defaultLimit, maxLimit int) (Page, error) {
+	page := Page{Limit: defaultLimit}
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxLimit {
+			return Page{}, fmt.Errorf("limit must be between 1 and %d", maxLimit)
+		}
+		page.Limit = limit
+	}
+	if raw := r.URL.Query().Get("offset"); raw != "" {
+		offset, err := strconv.Atoi(raw)
+		if err != nil || offset < 0 {
+			return Page{}, errors.New("offset must be a non-negative integer")
+		}
+		page.Offset = offset
+	}
+	return page, nil
+}
+
+// includeInactive reports whether listings and searches should also return
+// deactivated users, which are hidden by default.
+func includeInactive(r *http.Request) bool {
+	return r.URL.Query().Get("include_inactive") == "true"
+}
+
+// prefersMinimal reports whether the client sent Prefer: return=minimal
+// (RFC 7240), asking for writes to answer without a body.
+func prefersMinimal(r *http.Request) bool {
+	for _, header := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(header, ",") {
+			token, _, _ := strings.Cut(preference, ";")
+			if strings.EqualFold(strings.TrimSpace(token), "return=minimal") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// userLocation is the path of a user resource, for Location headers.
+func userLocation(id UserID) string {
+	return "/users/" + string(id)
+}
+
+// respondWithUser answers a successful create or update with the full user,
+// or, under Prefer: return=minimal, with just its Location and no body (a
+// 200 becomes 204).
+func (us *UserService) respondWithUser(w http.ResponseWriter, r *http.Request, status int, user User) {
+	if !prefersMinimal(r) {
+		us.respondWithJSON(w, status, presentUsers(r, user))
+		return
+	}
+
+	w.Header().Set("Location", userLocation(user.ID))
+	w.Header().Set("Preference-Applied", "return=minimal")
+	if status == http.StatusOK {
+		status = http.StatusNoContent
+	}
+	w.WriteHeader(status)
+}
+
+// wantsNDJSON reports whether the client asked for newline-delimited JSON.
+func wantsNDJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// ndjsonFlushEvery is how many lines are written between flushes.
+const ndjsonFlushEvery = 100
+
+// respondWithNDJSON writes count items, one JSON object per line, flushing
+// periodically so streaming consumers can start on early lines. Envelope
+// settings don't apply, each line is a bare item.
+func (us *UserService) respondWithNDJSON(w http.ResponseWriter, count int, item func(i int) interface{}) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	controller := http.NewResponseController(w)
+	encoder := us.newEncoder(w)
+	for i := 0; i < count; i++ {
+		if err := encoder.Encode(item(i)); err != nil {
+			return
+		}
+		if (i+1)%ndjsonFlushEvery == 0 {
+			controller.Flush()
+		}
+	}
+	controller.Flush()
+}
+
+// Warning header codes (RFC 7234 section 5.5)
+const (
+	warnStale     = 110 // served from stale data
+	warnDeprecate = 299 // miscellaneous persistent warning, used for deprecations
+)
+
+// addWarning attaches a non-fatal warning to the response as a Warning
+// header. Handlers that answer with an envelope also copy them into its
+// "warnings" array via responseWarnings, so they must add warnings before
+// building the body.
+func addWarning(w http.ResponseWriter, code int, text string) {
+	w.Header().Add("Warning", fmt.Sprintf("%d - %q", code, text))
+}
+
+// responseWarnings returns the texts of the warnings added so far.
+func responseWarnings(w http.ResponseWriter) []string {
+	var texts []string
+	for _, warning := range w.Header().Values("Warning") {
+		_, quoted, _ := strings.Cut(warning, " - ")
+		if text, err := strconv.Unquote(quoted); err == nil {
+			texts = append(texts, text)
+		}
+	}
+	return texts
+}
+
+// hasWarning reports whether header carries a warning with code.
+func hasWarning(header http.Header, code int) bool {
+	prefix := strconv.Itoa(code) + " "
+	for _, warning := range header.Values("Warning") {
+		if strings.HasPrefix(warning, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// markBareArrayDeprecated signals the legacy bare-array ListUsers response
+// as deprecated, with a Deprecation header, a Sunset header (RFC 8594) once
+// LIST_SUNSET sets a removal date, and a Warning for clients that only log
+// those.
+func (us *UserService) markBareArrayDeprecated(w http.ResponseWriter) {
+	w.Header().Set("Deprecation", "true")
+	if !us.config.ListSunset.IsZero() {
+		w.Header().Set("Sunset", us.config.ListSunset.Format(http.TimeFormat))
+	}
+	addWarning(w, warnDeprecate, "The bare array response is deprecated, pass ?envelope=true")
+}
+
+// wantsEnvelope picks the ListUsers response shape from ?envelope, falling
+// back to the configured default so existing clients keep the bare array.
+func (us *UserService) wantsEnvelope(r *http.Request) bool {
+	if envelope, err := strconv.ParseBool(r.URL.Query().Get("envelope")); err == nil {
+		return envelope
+	}
+	return us.config.ListEnvelope
+}
+
+func (us *UserService) updateCache(users []User) {
+	us.cache.SetMany(users)
+}
+
+func (us *UserService) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	id, err := us.parseUserID(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, codeInvalidUserID, err.Error())
+		return
+	}
+
+	var user User
+	if err := us.decodeUserJSON(r, &user); err != nil {
+		respondWithDecodeError(w, err, "Invalid JSON")
+		return
+	}
+
+	errs := us.validateUserFields(&user, nil)
+	if len(errs) > 0 && us.grandfathered(&user) {
+		// The user may already have had the value, which is allowed
+		stored, err := scanUser(us.db.QueryRowContext(r.Context(), "SELECT "+userColumns+" FROM users WHERE id = $1 AND deleted_at IS NULL", id))
+		if err == nil {
+			errs = us.validateUserFields(&user, &stored)
+		} else if err != sql.ErrNoRows {
+			respondWithDBError(w, r, err)
+			return
+		}
+	}
+	if len(errs) > 0 {
+		us.respondWithValidationErrors(w, errs)
+		return
+	}
+
+	// Respond with the stored row so server-managed fields are accurate
+	user, err = scanUser(us.db.QueryRowContext(r.Context(),
+		"UPDATE users SET username=$1, email=$2, bio=$3, updated=CURRENT_TIMESTAMP WHERE id=$4 AND deleted_at IS NULL RETURNING "+userColumns,
+		user.Username, user.Email, user.Bio, id))
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, codeUserNotFound, "User not found")
+		return
+	} else if isUniqueViolation(err) {
+		respondWithError(w, http.StatusConflict, codeDuplicateUser, "Username or email already taken")
+		return
+	} else if err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+
+	us.recordMutation()
+	us.publishEvent(r.Context(), "user.updated", user)
+	us.cache.Delete(id)
+
+	us.respondWithUser(w, r, http.StatusOK, user)
+}
+
+func (us *UserService) PatchUser(w http.ResponseWriter, r *http.Request) {
+	id, err := us.parseUserID(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, codeInvalidUserID, err.Error())
+		return
+	}
+
+	var patch UserPatch
+	if isMergePatch(r) {
+		if err := us.decodeMergePatch(r, &patch); err != nil {
+			respondWithDecodeError(w, err, "Invalid merge patch, expected a JSON object of string or null fields")
+			return
+		}
+	} else if err := us.decodeUserJSON(r, &patch); err != nil {
+		respondWithDecodeError(w, err, "Invalid JSON")
+		return
+	}
+
+	// Read and write in one transaction so a concurrent update between the
+	// two can't be silently overwritten
+	tx, err := us.beginTx(r.Context())
+	if err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRowContext(r.Context(), "SELECT "+userColumns+" FROM users WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id))
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, codeUserNotFound, "User not found")
+		return
+	} else if err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+
+	stored := user
+	patch.apply(&user)
+
+	// Validate the merged result so cleared fields are checked too
+	if errs := us.validateUserFields(&user, &stored); len(errs) > 0 {
+		us.respondWithValidationErrors(w, errs)
+		return
+	}
+
+	user, err = scanUser(tx.QueryRowContext(r.Context(),
+		"UPDATE users SET username=$1, email=$2, bio=$3, updated=CURRENT_TIMESTAMP WHERE id=$4 AND deleted_at IS NULL RETURNING "+userColumns,
+		user.Username, user.Email, user.Bio, id))
+	if isUniqueViolation(err) {
+		respondWithError(w, http.StatusConflict, codeDuplicateUser, "Username or email already taken")
+		return
+	} else if err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+
+	us.recordMutation()
+	us.publishEvent(r.Context(), "user.updated", user)
+	us.cache.Delete(id)
+
+	us.respondWithUser(w, r, http.StatusOK, user)
+}
+
+// maxBatchUpdates bounds how many users one update-batch request may touch.
+const maxBatchUpdates = 100
+
+// UpdateBatch applies a patch to each listed user in one transaction and
+// reports a result per item. Items fail independently: a missing ID, a
+// validation error or a conflict is reported for that item, rolled back to
+// its savepoint, and the rest of the batch still commits.
+func (us *UserService) UpdateBatch(w http.ResponseWriter, r *http.Request) {
+	var items []BatchUpdate
+	if err := us.decodeUserJSON(r, &items); err != nil {
+		respondWithDecodeError(w, err, "Invalid JSON, expected an array of {id, fields} objects")
+		return
+	}
+	if len(items) == 0 || len(items) > maxBatchUpdates {
+		respondWithError(w, http.StatusBadRequest, codeInvalidBatch, fmt.Sprintf("Batch must contain 1 to %d items", maxBatchUpdates))
+		return
+	}
+
+	tx, err := us.beginTx(r.Context())
+	if err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	results := make([]BatchResult, len(items))
+	for i, item := range items {
+		results[i], err = us.updateBatchItem(r.Context(), tx, item)
+		if err != nil {
+			respondWithDBError(w, r, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+
+	us.recordMutation()
+	updated := make([]UserID, 0, len(results))
+	for _, result := range results {
+		if result.User == nil {
+			continue
+		}
+		us.publishEvent(r.Context(), "user.updated", *result.User)
+		updated = append(updated, result.ID)
+	}
+	us.cache.DeleteMany(updated)
+
+	us.respondWithJSON(w, http.StatusOK, presentUsers(r, results))
+}
+
+// updateBatchItem applies one batch item inside a savepoint. Item-level
+// failures come back in the result; the error is reserved for failures
+// that break the whole transaction.
+func (us *UserService) updateBatchItem(ctx context.Context, tx *sql.Tx, item BatchUpdate) (BatchResult, error) {
+	result := BatchResult{ID: item.ID}
+	if !us.validUserID(item.ID) {
+		result.Status, result.Code, result.Error = http.StatusBadRequest, codeInvalidUserID, errInvalidUserID.Error()
+		return result, nil
+	}
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT batch_item"); err != nil {
+		return result, err
+	}
+	release := func() error {
+		_, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT batch_item")
+		return err
+	}
+
+	user, err := scanUser(tx.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", item.ID))
+	if err == sql.ErrNoRows {
+		result.Status, result.Code, result.Error = http.StatusNotFound, codeUserNotFound, "User not found"
+		return result, release()
+	} else if err != nil {
+		return result, err
+	}
+
+	stored := user
+	item.Fields.apply(&user)
+	if errs := us.validateUserFields(&user, &stored); len(errs) > 0 {
+		result.Status, result.Code, result.Error = http.StatusUnprocessableEntity, codeInvalidUserData, "Invalid user data"
+		result.Errors = errs
+		return result, release()
+	}
+
+	user, err = scanUser(tx.QueryRowContext(ctx,
+		"UPDATE users SET username=$1, email=$2, bio=$3, updated=CURRENT_TIMESTAMP WHERE id=$4 AND deleted_at IS NULL RETURNING "+userColumns,
+		user.Username, user.Email, user.Bio, item.ID))
+	if isUniqueViolation(err) {
+		if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT batch_item"); err != nil {
+			return result, err
+		}
+		result.Status, result.Code, result.Error = http.StatusConflict, codeDuplicateUser, "Username or email already taken"
+		return result, nil
+	} else if err != nil {
+		return result, err
+	}
+
+	result.Status, result.User = http.StatusOK, &user
+	return result, release()
+}
+
+func isMergePatch(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/merge-patch+json"
+}
+
+// decodeMergePatch reads an RFC 7396 merge patch into a UserPatch. Absent
+// members stay nil and are left unchanged, while null clears the field,
+// which for these string columns means the empty string. Unknown members
+// are ignored.
+func (us *UserService) decodeMergePatch(r *http.Request, patch *UserPatch) error {
+	var members map[string]json.RawMessage
+	if err := us.decodeUserJSON(r, &members); err != nil {
+		return err
+	}
+	if members == nil {
+		return errors.New("merge patch must be a JSON object")
+	}
+	renameAliases(members)
+
+	targets := map[string]**string{
+		"username": &patch.Username,
+		"email":    &patch.Email,
+		"bio":      &patch.Bio,
+	}
+	for name, raw := range members {
+		target, ok := targets[name]
+		if !ok {
+			continue
+		}
+		value := ""
+		if string(raw) != "null" {
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return err
+			}
+		}
+		*target = &value
+	}
+	return nil
+}
+
+// UpdateBio replaces only the bio column, so UIs editing the bio don't need
+// to round-trip the whole user.
+func (us *UserService) UpdateBio(w http.ResponseWriter, r *http.Request) {
+	id, err := us.parseUserID(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, codeInvalidUserID, err.Error())
+		return
+	}
+
+	var body struct {
+		Bio *string `json:"bio"`
+	}
+	if err := us.decodeUserJSON(r, &body); err != nil || body.Bio == nil {
+		respondWithDecodeError(w, err, "Invalid JSON, expected {\"bio\": \"...\"}")
+		return
+	}
+
+	bio := strings.TrimSpace(*body.Bio)
+	if errs := validateBio(bio); len(errs) > 0 {
+		us.respondWithValidationErrors(w, errs)
+		return
+	}
+
+	user, err := scanUser(us.db.QueryRowContext(r.Context(),
+		"UPDATE users SET bio = $1, updated = CURRENT_TIMESTAMP WHERE id = $2 AND deleted_at IS NULL RETURNING "+userColumns, bio, id))
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, codeUserNotFound, "User not found")
+		return
+	} else if err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+
+	us.recordMutation()
+	us.publishEvent(r.Context(), "user.updated", user)
+	us.cache.Delete(id)
+
+	us.respondWithUser(w, r, http.StatusOK, user)
+}
+
+func (us *UserService) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, err := us.parseUserID(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, codeInvalidUserID, err.Error())
+		return
+	}
+
+	// Deleted rows are kept until PurgeDeleted removes them
+	result, err := us.db.ExecContext(r.Context(), "UPDATE users SET deleted_at = CURRENT_TIMESTAMP WHERE id = $1 AND deleted_at IS NULL", id)
+	if err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, codeUserNotFound, "User not found")
+		return
+	}
+
+	us.recordMutation()
+	us.publishEvent(r.Context(), "user.deleted", map[string]UserID{"id": id})
+	us.cache.Delete(id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PreloadCache loads the given user IDs into the cache with a single query,
+// for admins priming entries ahead of expected traffic.
+func (us *UserService) PreloadCache(w http.ResponseWriter, r *http.Request) {
+	var ids []UserID
+	if err := us.decodeUserJSON(r, &ids); err != nil {
+		respondWithDecodeError(w, err, "Invalid JSON, expected an array of user IDs")
+		return
+	}
+
+	requested := make(map[UserID]bool, len(ids))
+	unique := make([]UserID, 0, len(ids))
+	for _, id := range ids {
+		if !us.validUserID(id) {
+			respondWithError(w, http.StatusBadRequest, codeInvalidUserID, fmt.Sprintf("Invalid user ID: %s", id))
+			return
+		}
+		if !requested[id] {
+			requested[id] = true
+			unique = append(unique, id)
+		}
+	}
+
+	users, err := us.usersByID(r.Context(), unique)
+	if err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+
+	us.updateCache(users)
+
+	us.respondWithJSON(w, http.StatusOK, map[string]int{
+		"loaded":    len(users),
+		"not_found": len(requested) - len(users),
+	})
+}
+
+// usersByID loads the given users, querying ID_CHUNK_SIZE IDs at a time so
+// a long list doesn't become one huge ANY($1) array. Missing IDs are left
+// out of the result.
+func (us *UserService) usersByID(ctx context.Context, ids []UserID) ([]User, error) {
+	users := make([]User, 0, len(ids))
+	for chunk := range slices.Chunk(ids, us.config.IDChunkSize) {
+		rows, err := us.db.QueryContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = ANY($1) AND deleted_at IS NULL", pq.Array(chunk))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			user, err := scanUser(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			users = append(users, user)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// DebugCacheEntry shows what the cache holds for one user and since when,
+// for tracking down stale reads. Users that aren't cached get a 404.
+func (us *UserService) DebugCacheEntry(w http.ResponseWriter, r *http.Request) {
+	id, err := us.parseUserID(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, codeInvalidUserID, err.Error())
+		return
+	}
+
+	info, ok := us.cache.Inspect(id)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, codeNotCached, "User not cached")
+		return
+	}
+
+	entry := map[string]interface{}{
+		"cached":                true,
+		"user":                  presentUsers(r, *info.User),
+		"stored":                info.Stored.UTC().Format(time.RFC3339Nano),
+		"age_seconds":           time.Since(info.Stored).Seconds(),
+		"ttl_remaining_seconds": nil,
+	}
+	if !info.Expires.IsZero() {
+		entry["ttl_remaining_seconds"] = max(time.Until(info.Expires).Seconds(), 0)
+	}
+	us.respondWithJSON(w, http.StatusOK, entry)
+}
+
+// DebugSchema lists the migrations recorded in schema_migrations, with the
+// current version and any embedded migrations still missing (optional ones
+// such as the trigram index can be), to confirm what a deploy applied.
+func (us *UserService) DebugSchema(w http.ResponseWriter, r *http.Request) {
+	rows, err := us.db.QueryContext(r.Context(), "SELECT version, name, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	applied := make([]map[string]interface{}, 0, len(migrations))
+	seen := make(map[int]bool)
+	current := 0
+	for rows.Next() {
+		var version int
+		var name string
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &name, &appliedAt); err != nil {
+			respondWithDBError(w, r, err)
+			return
+		}
+		applied = append(applied, map[string]interface{}{
+			"version":    version,
+			"name":       name,
+			"applied_at": appliedAt.Format(time.RFC3339),
+		})
+		seen[version] = true
+		current = max(current, version)
+	}
+	if err := rows.Err(); err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+
+	pending := make([]string, 0)
+	for _, m := range migrations {
+		if !seen[m.version] {
+			pending = append(pending, fmt.Sprintf("%04d_%s", m.version, m.name))
+		}
+	}
+
+	us.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"current_version": current,
+		"latest_version":  migrations[len(migrations)-1].version,
+		"applied":         applied,
+		"pending":         pending,
+	})
+}
+
+// RebuildCache flushes the cache and reloads the most recent users, for
+// operators resyncing after direct DB edits. A client disconnect cancels the
+// reload, leaving whatever was loaded so far in place.
+func (us *UserService) RebuildCache(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rows, err := us.db.QueryContext(ctx,
+		"SELECT "+userColumns+" FROM users WHERE deleted_at IS NULL "+listOrderBy("desc")+" LIMIT $1",
+		us.config.CacheRebuildLimit)
+	if err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	us.cache.Clear()
+
+	loaded := 0
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			respondWithDBError(w, r, err)
+			return
+		}
+		us.cache.Set(&user)
+		loaded++
+	}
+	if err := rows.Err(); err != nil {
+		if ctx.Err() != nil {
+			respondUnavailable(w, retryAfterUnavailable, codeRequestCancelled, "Cache rebuild cancelled")
+			return
+		}
+		respondWithDBError(w, r, err)
+		return
+	}
+
+	us.respondWithJSON(w, http.StatusOK, map[string]int{"loaded": loaded})
+}
+
+// PurgeDeleted hard-deletes users soft-deleted more than
+// SOFT_DELETE_RETENTION ago, PURGE_BATCH_SIZE rows per statement so no
+// single delete holds locks on a large part of the table. A client
+// disconnect stops it between batches; the response reports how many rows
+// were purged either way.
+func (us *UserService) PurgeDeleted(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	cutoff := time.Now().Add(-us.config.SoftDeleteRetention)
+
+	purged := int64(0)
+	var err error
+	for ctx.Err() == nil {
+		var result sql.Result
+		result, err = us.db.ExecContext(ctx, `
+			DELETE FROM users WHERE id IN (
+				SELECT id FROM users WHERE deleted_at < $1 LIMIT $2
+			)`, cutoff, us.config.PurgeBatchSize)
+		if err != nil {
+			break
+		}
+		batch, _ := result.RowsAffected()
+		purged += batch
+		if batch < int64(us.config.PurgeBatchSize) {
+			break
+		}
+	}
+
+	if purged > 0 {
+		slog.Info("Purged soft-deleted users", "purged", purged, "cutoff", cutoff.Format(time.RFC3339))
+		us.recordMutation()
+	}
+	if err != nil && ctx.Err() == nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+	us.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"purged":   purged,
+		"complete": ctx.Err() == nil,
+	})
+}
+
+// warmCache preloads up to CacheWarmLimit of the newest users in batches of
+// CacheWarmBatch, pausing CacheWarmDelay between batches so a cold DB isn't
+// hit with one large scan at startup. after is the clock used for the pauses
+// (time.After outside tests). It returns the number of users loaded.
+func (us *UserService) warmCache(ctx context.Context, after func(time.Duration) <-chan time.Time) (int, error) {
+	loaded := 0
+	// Start above every ID; with UUIDs "newest" is just a stable order
+	lastID := UserID(strconv.Itoa(math.MaxInt32))
+	if us.config.IDType == idTypeUUID {
+		lastID = "ffffffff-ffff-ffff-ffff-ffffffffffff"
+	}
+	for loaded < us.config.CacheWarmLimit {
+		batchSize := min(us.config.CacheWarmBatch, us.config.CacheWarmLimit-loaded)
+		rows, err := us.db.QueryContext(ctx,
+			"SELECT "+userColumns+" FROM users WHERE id < $1 AND deleted_at IS NULL ORDER BY id DESC LIMIT $2",
+			lastID, batchSize)
+		if err != nil {
+			return loaded, err
+		}
+
+		batch := make([]User, 0, batchSize)
+		for rows.Next() {
+			user, err := scanUser(rows)
+			if err != nil {
+				rows.Close()
+				return loaded, err
+			}
+			batch = append(batch, user)
+			lastID = user.ID
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return loaded, err
+		}
+		us.cache.SetMany(batch)
+
+		loaded += len(batch)
+		if len(batch) < batchSize || loaded == us.config.CacheWarmLimit {
+			return loaded, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return loaded, ctx.Err()
+		case <-after(us.config.CacheWarmDelay):
+		}
+	}
+	return loaded, nil
+}
+
+func (us *UserService) SearchUsers(w http.ResponseWriter, r *http.Request) {
+	// Surrounding whitespace never helps a match, and a term of only
+	// whitespace or wildcard characters would match (almost) everything
+	searchTerm := strings.TrimSpace(r.URL.Query().Get("q"))
+	if searchTerm == "" {
+		respondWithError(w, http.StatusBadRequest, codeInvalidSearch, "Search query required")
+		return
+	}
+	if strings.TrimFunc(searchTerm, isSearchFiller) == "" {
+		respondWithError(w, http.StatusBadRequest, codeInvalidSearch, "Search query must contain more than wildcard characters")
+		return
+	}
+
+	if len([]rune(searchTerm)) < us.config.SearchMinLength {
+		respondWithError(w, http.StatusBadRequest, codeInvalidSearch, fmt.Sprintf("Search query must be at least %d characters", us.config.SearchMinLength))
+		return
+	}
+
+	page, err := parsePage(r, us.config.SearchPageSize, us.config.SearchMaxResults)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, codeInvalidPage, err.Error())
+		return
+	}
+
+	searchTerm = strings.ToLower(searchTerm)
+	fuzzy := r.URL.Query().Get("fuzzy") == "true" && trigramAvailable
+	where, orderBy, args := us.searchFilter(searchTerm, fuzzy, !includeInactive(r))
+
+	// Facet widgets only need the number of matches. Counting stops one past
+	// SEARCH_MAX_COUNT, so a term matching most of the table can't force a
+	// full scan; past the cap the count is reported as capped.
+	if r.URL.Query().Get("count_only") == "true" {
+		var count int
+		query := fmt.Sprintf("SELECT COUNT(*) FROM (SELECT 1 FROM users %s LIMIT $%d) matches", where, len(args)+1)
+		queryStart := time.Now()
+		err := us.db.QueryRowContext(r.Context(), query, append(args, us.config.SearchMaxCount+1)...).Scan(&count)
+		recordTiming(r.Context(), timingDB, queryStart)
+		if err != nil {
+			respondWithDBError(w, r, err)
+			return
+		}
+		if count > us.config.SearchMaxCount {
+			us.respondWithJSON(w, http.StatusOK, map[string]interface{}{"count": us.config.SearchMaxCount, "capped": true})
+			return
+		}
+		us.respondWithJSON(w, http.StatusOK, map[string]int{"count": count})
+		return
+	}
+
+	if wantsNDJSON(r) {
+		us.streamSearch(w, r, where, orderBy, args, page)
+		return
+	}
+
+	// Identical concurrent searches share one query, run under
+	// sharedContext for the same reason as loadUser's
+	key := fmt.Sprint(fuzzy, includeInactive(r), page, searchTerm)
+	queried := false
+	queryStart := time.Now()
+	results := us.searches.DoChan(key, func() (interface{}, error) {
+		queried = true
+		ctx, cancel := sharedContext(r.Context())
+		defer cancel()
+		users, err := us.querySearch(ctx, where, orderBy, args, page)
+		if err == nil {
+			us.rememberSearch(key, users)
+		}
+		return users, err
+	})
+	var result interface{}
+	select {
+	case flight := <-results:
+		result, err = flight.Val, flight.Err
+		if !queried {
+			requestsCoalesced.WithLabelValues("search").Inc()
+		}
+	case <-r.Context().Done():
+		err = r.Context().Err()
+	}
+	recordTiming(r.Context(), timingDB, queryStart)
+	if err != nil {
+		stale, ok := us.staleSearch(key)
+		if !ok {
+			respondWithDBError(w, r, err)
+			return
+		}
+		slog.Warn("Serving stale search results", "error", err)
+		addWarning(w, warnStale, "Response is Stale")
+		result = stale
+	}
+
+	// The shared result is copied before processing, which edits in place.
+	// A non-nil slice keeps no matches encoding as [] rather than null.
+	matches := result.([]User)
+	users := make([]User, 0, len(matches))
+	for _, user := range matches {
+		processedUser := us.processUserData(&user, wantsHTMLBio(r))
+		users = append(users, *processedUser)
+	}
+
+	for _, user := range users {
+		if strings.Contains(strings.ToLower(user.Bio), searchTerm) {
+			break
+		}
+	}
+
+	us.respondWithJSON(w, http.StatusOK, presentUsers(r, users))
+}
+
+// signupIntervals are the ?interval= values CountSignups accepts, which are
+// passed to date_trunc.
+var signupIntervals = map[string]bool{"day": true, "week": true, "month": true}
+
+// SignupBucket is one row of the signups histogram.
+type SignupBucket struct {
+	Bucket string `json:"bucket"`
+	Count  int    `json:"count"`
+}
+
+// CountSignups reports how many users were created per interval between
+// ?from= (inclusive) and ?to= (exclusive), for analytics. Bounds are dates
+// (2006-01-02) or RFC 3339 times, defaulting to the 30 days up to now.
+// Empty buckets are omitted.
+func (us *UserService) CountSignups(w http.ResponseWriter, r *http.Request) {
+	interval := r.URL.Query().Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+	if !signupIntervals[interval] {
+		respondWithError(w, http.StatusBadRequest, codeInvalidFilter, "Invalid interval, expected day, week or month")
+		return
+	}
+
+	to := time.Now()
+	if raw := r.URL.Query().Get("to"); raw != "" {
+		parsed, err := parseDateParam(raw)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, codeInvalidFilter, "Invalid to, expected a date or RFC 3339 time")
+			return
+		}
+		to = parsed
+	}
+	from := to.AddDate(0, 0, -30)
+	if raw := r.URL.Query().Get("from"); raw != "" {
+		parsed, err := parseDateParam(raw)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, codeInvalidFilter, "Invalid from, expected a date or RFC 3339 time")
+			return
+		}
+		from = parsed
+	}
+	if !from.Before(to) {
+		respondWithError(w, http.StatusBadRequest, codeInvalidFilter, "from must be before to")
+		return
+	}
+
+	rows, err := us.db.QueryContext(r.Context(), `
+		SELECT date_trunc($1, created) AS bucket, COUNT(*)
+		FROM users
+		WHERE created >= $2 AND created < $3
+		GROUP BY bucket
+		ORDER BY bucket`, interval, from, to)
+	if err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	buckets := make([]SignupBucket, 0)
+	for rows.Next() {
+		var bucket time.Time
+		var count int
+		if err := rows.Scan(&bucket, &count); err != nil {
+			respondWithDBError(w, r, err)
+			return
+		}
+		buckets = append(buckets, SignupBucket{Bucket: bucket.Format(time.RFC3339), Count: count})
+	}
+	if err := rows.Err(); err != nil {
+		respondWithDBError(w, r, err)
+		return
+	}
+
+	us.respondWithJSON(w, http.StatusOK, buckets)
+}
+
+// parseDateParam accepts a bare date or an RFC 3339 timestamp.
+func parseDateParam(value string) (time.Time, error) {
+	if date, err := time.Parse(time.DateOnly, value); err == nil {
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// staleSearchResult is the last successful result of a search, kept for
+// SERVE_STALE_ON_ERROR.
+type staleSearchResult struct {
+	users  []User
+	stored time.Time
+}
+
+// rememberSearch keeps a successful search result for serving while the DB
+// is failing. It is a no-op unless SERVE_STALE_ON_ERROR is set.
+func (us *UserService) rememberSearch(key string, users []User) {
+	if !us.config.ServeStaleOnError {
+		return
+	}
+	us.staleMutex.Lock()
+	if len(us.staleSearches) >= maxCachedResponses {
+		us.staleSearches = make(map[string]staleSearchResult)
+	}
+	us.staleSearches[key] = staleSearchResult{users: users, stored: time.Now()}
+	us.staleMutex.Unlock()
+}
+
+// staleSearch returns a remembered result no older than StaleSearchTTL.
+func (us *UserService) staleSearch(key string) ([]User, bool) {
+	if !us.config.ServeStaleOnError {
+		return nil, false
+	}
+	us.staleMutex.Lock()
+	stale, ok := us.staleSearches[key]
+	us.staleMutex.Unlock()
+	if !ok || time.Since(stale.stored) > us.config.StaleSearchTTL {
+		return nil, false
+	}
+	return stale.users, true
+}
+
+// searchQuery assembles the SELECT for one page of a search built by
+// searchFilter, returning it with its full argument list.
+func searchQuery(where, orderBy string, args []interface{}, page Page) (string, []interface{}) {
+	query := fmt.Sprintf("SELECT %s FROM users %s %s LIMIT $%d OFFSET $%d",
+		userColumns, where, orderBy, len(args)+1, len(args)+2)
+	return query, append(args, page.Limit, page.Offset)
+}
+
+// streamSearch writes one page of search matches as NDJSON while the rows
+// arrive, for broad searches that would be slow to buffer. The query is
+// cancelled after SEARCH_MAX_DURATION, and a stream cut short ends with a
+// {"truncated": true} line so clients can tell it from a complete one.
+// Streams skip coalescing, the stale fallback and the response cache.
+func (us *UserService) streamSearch(w http.ResponseWriter, r *http.Request, where, orderBy string, args []interface{}, page Page) {
+	ctx := r.Context()
+	if us.config.SearchMaxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, us.config.SearchMaxDuration)
+		defer cancel()
+	}
+
+	query, args := searchQuery(where, orderBy, args, page)
+	queryStart := time.Now()
+	rows, err := us.db.QueryContext(ctx, query, args...)
+	recordTiming(r.Context(), timingDB, queryStart)
+	// Running out of SEARCH_MAX_DURATION still streams, ending truncated
+	if err != nil && (ctx.Err() == nil || r.Context().Err() != nil) {
+		respondWithDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	controller := http.NewResponseController(w)
+	encoder := us.newEncoder(w)
+	truncated := err != nil
+	if rows != nil {
+		defer rows.Close()
+		written := 0
+		for rows.Next() {
+			user, err := scanUser(rows)
+			if err != nil {
+				continue
+			}
+			if err := encoder.Encode(presentUsers(r, *us.processUserData(&user, wantsHTMLBio(r)))); err != nil {
+				return
+			}
+			if written++; written%ndjsonFlushEvery == 0 {
+				controller.Flush()
+			}
+		}
+		truncated = rows.Err() != nil
+	}
+
+	// Nobody is left to read a marker once the client has gone
+	if truncated && r.Context().Err() == nil {
+		slog.Warn("Search stream truncated", "max_duration", us.config.SearchMaxDuration.String(), "error", ctx.Err())
+		encoder.Encode(map[string]bool{"truncated": true})
+	}
+	controller.Flush()
+}
+
+// querySearch runs one page of a search built by searchFilter. Rows that
+// fail to scan are skipped, but a scan cut short by ctx is an error rather
+// than a short page that would be cached as the full result.
+func (us *UserService) querySearch(ctx context.Context, where, orderBy string, args []interface{}, page Page) ([]User, error) {
+	query, args := searchQuery(where, orderBy, args, page)
+	rows, err := us.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]User, 0, page.Limit)
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			continue
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// searchFilter builds the WHERE and ORDER BY clauses shared by searches and
+// their counts, over the SEARCH_FIELDS columns. Substring mode matches the
+// term anywhere in those fields. Fuzzy mode matches usernames and emails by
+// trigram similarity so misspelled terms still find users, ordered best
+// match first. Substring terms are escaped so % and _ match literally.
+// Soft-deleted users never match; activeOnly also excludes deactivated users.
+func (us *UserService) searchFilter(searchTerm string, fuzzy, activeOnly bool) (string, string, []interface{}) {
+	scope := func(match string) string {
+		if activeOnly {
+			return "WHERE active AND deleted_at IS NULL AND (" + match + ")"
+		}
+		return "WHERE deleted_at IS NULL AND (" + match + ")"
+	}
+
+	if fuzzy {
+		var matches, scores []string
+		for _, field := range us.config.SearchFields {
+			// Trigram similarity against a whole bio is meaningless
+			if field == "bio" {
+				continue
+			}
+			score := "similarity(" + field + ", $1)"
+			scores = append(scores, score)
+			matches = append(matches, score+" >= $2")
+		}
+		where := scope(strings.Join(matches, " OR "))
+		orderBy := "ORDER BY GREATEST(" + strings.Join(scores, ", ") + ") DESC, id"
+		return where, orderBy, []interface{}{searchTerm, us.config.FuzzyThreshold}
+	}
+
+	matches := make([]string, len(us.config.SearchFields))
+	for i, field := range us.config.SearchFields {
+		matches[i] = "LOWER(" + field + `) LIKE $1 ESCAPE '\'`
+	}
+	return scope(strings.Join(matches, " OR ")), "", []interface{}{"%" + likeEscaper.Replace(searchTerm) + "%"}
+}
+
+// searchableFields are the columns SEARCH_FIELDS may select, and the
+// default. Entries are interpolated into SQL, so only these are accepted.
+var searchableFields = []string{"username", "email", "bio"}
+
+// searchWildcards are characters that, on their own, don't make a useful
+// search term: LIKE's metacharacters plus the * and ? clients often send
+// meaning "anything".
+const searchWildcards = "%_*?"
+
+// isSearchFiller reports whether r means nothing in a search term on its
+// own, so "% _" is rejected along with "%".
+func isSearchFiller(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune(searchWildcards, r)
+}
+
+// likeEscaper escapes LIKE metacharacters, including the escape character.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+var (
+	errInvalidUserID  = errors.New("Invalid user ID")
+	errUserIDOutRange = errors.New("ID out of range")
+)
+
+// maxIntegerID is the largest id users.id can hold, the column being a
+// SERIAL (int4). Larger IDs are rejected up front rather than failing the
+// query.
+const maxIntegerID = math.MaxInt32
+
+// parseUserID reads the {id} path variable. The route regex only admits
+// IDs of the configured type, so the interesting failure is an integer too
+// large for the id column. IDs are normalized (no leading zeros, lowercase UUIDs)
+// since the cache and notFound compare them as strings.
+func (us *UserService) parseUserID(r *http.Request) (UserID, error) {
+	raw := mux.Vars(r)["id"]
+	if us.config.IDType == idTypeUUID {
+		return UserID(strings.ToLower(raw)), nil
+	}
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if errors.Is(err, strconv.ErrRange) || id > maxIntegerID {
+		return "", errUserIDOutRange
+	} else if err != nil {
+		return "", errInvalidUserID
+	}
+	return UserID(strconv.FormatInt(id, 10)), nil
+}
+
+// validUserID reports whether an ID from a request body has the configured
+// type and fits the id column, since those don't pass through parseUserID.
+func (us *UserService) validUserID(id UserID) bool {
+	if us.config.IDType == idTypeUUID {
+		return uuidRegex.MatchString(string(id))
+	}
+	if !isIntegerID(string(id)) {
+		return false
+	}
+	n, _ := strconv.ParseInt(string(id), 10, 64)
+	return n <= maxIntegerID
+}
+
+// maxEmailLength matches the users.email VARCHAR(100) column, so oversized
+// emails are rejected by validation rather than failing the insert.
+// usernameRegex already keeps usernames well inside VARCHAR(50).
+const maxEmailLength = 100
+
+// FieldError describes why a single field failed validation.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validateUserFields runs every validation rule and reports all failures,
+// rather than stopping at the first, so forms can flag each bad field.
+// Unless TRIM_IDENTIFIERS is disabled, surrounding whitespace is first
+// trimmed from username and email in place, so "alice " is stored as
+// "alice" while "al ice" is still rejected.
+//
+// stored is the row being updated, or nil for a new user. Reserved
+// usernames and disposable email domains are only refused when being newly
+// set, so users who had one before it was listed can still edit the rest
+// of their profile.
+func (us *UserService) validateUserFields(user, stored *User) []FieldError {
+	if us.config.TrimIdentifiers {
+		user.Username = strings.TrimSpace(user.Username)
+		user.Email = strings.TrimSpace(user.Email)
+	}
+
+	var errs []FieldError
+	if !usernameRegex.MatchString(user.Username) {
+		errs = append(errs, FieldError{Field: "username", Message: "must be 3-20 letters, digits or underscores"})
+	} else if us.config.ReservedUsernames[strings.ToLower(user.Username)] && (stored == nil || stored.Username != user.Username) {
+		errs = append(errs, FieldError{Field: "username", Message: "is reserved"})
+	}
+	if len(user.Email) > maxEmailLength {
+		errs = append(errs, FieldError{Field: "email", Message: fmt.Sprintf("must be at most %d characters", maxEmailLength)})
+	} else if !emailRegex.MatchString(user.Email) {
+		errs = append(errs, FieldError{Field: "email", Message: "must be a valid email address"})
+	} else if !us.emailDomainAllowed(user.Email) {
+		errs = append(errs, FieldError{Field: "email", Message: "email domain is not allowed"})
+	} else if us.config.DisposableEmailDomains[emailDomain(user.Email)] && (stored == nil || !strings.EqualFold(stored.Email, user.Email)) {
+		errs = append(errs, FieldError{Field: "email", Message: "disposable email addresses are not accepted"})
+	}
+	errs = append(errs, validateBio(user.Bio)...)
+
+	return errs
+}
+
+// grandfathered reports whether user has a value validateUserFields only
+// accepts from a user who already had it, so an update needs the stored row
+// to validate.
+func (us *UserService) grandfathered(user *User) bool {
+	return us.config.ReservedUsernames[strings.ToLower(user.Username)] ||
+		us.config.DisposableEmailDomains[emailDomain(user.Email)]
+}
+
+// defaultReservedUsernames are kept back for staff and system accounts
+// unless RESERVED_USERNAMES replaces them.
+var defaultReservedUsernames = []string{
+	"admin", "administrator", "root", "system", "api", "support", "help",
+	"security", "staff", "moderator", "null", "undefined",
+}
+
+// emailDomainAllowed checks the email's domain against ALLOWED_EMAIL_DOMAINS.
+// An empty allowlist allows every domain.
+func (us *UserService) emailDomainAllowed(email string) bool {
+	if len(us.config.AllowedEmailDomains) == 0 {
+		return true
+	}
+
+	domain := emailDomain(email)
+	for _, allowed := range us.config.AllowedEmailDomains {
+		if domain == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func emailDomain(email string) string {
+	return strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+}
+
+func validateBio(bio string) []FieldError {
+	var errs []FieldError
+	if len(bio) > 1000 {
+		errs = append(errs, FieldError{Field: "bio", Message: "must be at most 1000 characters"})
+	}
+
+	if strings.Contains(bio, "spam") {
+		errs = append(errs, FieldError{Field: "bio", Message: "must not contain spam"})
+	}
+
+	return errs
+}
+
+// User primary key types, selected by ID_TYPE
+const (
+	idTypeInteger = "integer"
+	idTypeUUID    = "uuid"
+)
+
+// Route patterns for the {id} path variable of each ID type
+const (
+	integerIDPattern = `[0-9]+`
+	uuidIDPattern    = `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`
+)
+
+// Handling of invalid UTF-8 in user payloads, selected by INVALID_UTF8
+const (
+	invalidUTF8Replace = "replace"
+	invalidUTF8Reject  = "reject"
+)
+
+var errInvalidUTF8 = errors.New("Request body must be valid UTF-8")
+
+// decodeUserJSON decodes a user payload. encoding/json already replaces
+// invalid UTF-8 with U+FFFD, which is the replace mode; in reject mode the
+// raw body is checked first, since the damage is invisible after decoding.
+func (us *UserService) decodeUserJSON(r *http.Request, v interface{}) error {
+	if us.config.InvalidUTF8 != invalidUTF8Reject {
+		return json.NewDecoder(r.Body).Decode(v)
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if !utf8.Valid(body) {
+		return errInvalidUTF8
+	}
+	return json.Unmarshal(body, v)
+}
+
+// ValidateUser is a dry run of CreateUser's validation that never touches
+// the DB, for forms that want feedback before submitting.
+func (us *UserService) ValidateUser(w http.ResponseWriter, r *http.Request) {
+	var user User
+	if err := us.decodeUserJSON(r, &user); err != nil {
+		respondWithDecodeError(w, err, "Invalid JSON")
+		return
+	}
+
+	if errs := us.validateUserFields(&user, nil); len(errs) > 0 {
+		us.respondWithJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"valid":  false,
+			"errors": errs,
+		})
+		return
+	}
+
+	us.respondWithJSON(w, http.StatusOK, map[string]bool{"valid": true})
+}
+
+// processUserData normalizes a copy of user for output, rendering the
+// markdown bio when renderHTML is set. The input is never modified, since it
+// may be a cache entry other requests are reading concurrently.
+func (us *UserService) processUserData(user *User, renderHTML bool) *User {
+	processed := *user
+	if us.config.BioWhitespace == bioWhitespacePreserveNewlines {
+		processed.Bio = collapseHorizontalWhitespace(processed.Bio)
+	} else if strings.Contains(processed.Bio, "  ") {
+		processed.Bio = strings.ReplaceAll(processed.Bio, "  ", " ")
+	}
+	if renderHTML && us.config.RenderMarkdown {
+		processed.Bio = renderMarkdown(processed.Bio)
+	}
+	return &processed
+}
+
+// collapseHorizontalWhitespace squeezes runs of spaces and tabs within each
+// line to a single space but keeps the line breaks of multi-paragraph bios.
+func collapseHorizontalWhitespace(bio string) string {
+	lines := strings.Split(bio, "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// wantsHTMLBio reports whether the client asked for bios rendered as HTML,
+// either with ?format=html or an Accept header preferring text/html.
+func wantsHTMLBio(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "html" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// renderMarkdown converts the small markdown subset used in bios (paragraphs,
+// line breaks, bold, italics, inline code and http(s) links) to HTML. The
+// input is escaped first so no client-supplied markup survives.
+func renderMarkdown(text string) string {
+	escaped := html.EscapeString(strings.ReplaceAll(text, "\r\n", "\n"))
+
+	var out strings.Builder
+	for _, paragraph := range strings.Split(escaped, "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph == "" {
+			continue
+		}
+		paragraph = markdownCode.ReplaceAllString(paragraph, "<code>$1</code>")
+		paragraph = markdownBold.ReplaceAllString(paragraph, "<strong>$1</strong>")
+		paragraph = markdownItalic.ReplaceAllString(paragraph, "<em>$1</em>")
+		paragraph = markdownLink.ReplaceAllString(paragraph, `<a href="$2" rel="nofollow">$1</a>`)
+		paragraph = strings.ReplaceAll(paragraph, "\n", "<br>")
+		out.WriteString("<p>" + paragraph + "</p>")
+	}
+	return out.String()
+}
+
+// userFields are the columns clients may select with ?fields=, in the
+// order they are selected when no projection is requested.
+var userFields = []string{"id", "username", "email", "bio", "created", "updated", "active"}
+
+// userColumns is the select list for a full users row, read by scanUser.
+var userColumns = strings.Join(userFields, ", ")
+
+// parseFields reads the ?fields= projection. It returns nil when the
+// parameter is absent and an error naming the first unknown field.
+func parseFields(r *http.Request) ([]string, error) {
+	raw := r.URL.Query().Get("fields")
+	if raw == "" {
+		return nil, nil
+	}
+
+	var fields []string
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		known := false
+		for _, allowed := range userFields {
+			if field == allowed {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown field %q", field)
+		}
+		fields = withField(fields, field)
+	}
+	return fields, nil
+}
+
+// withField appends field unless it is already present.
+func withField(fields []string, field string) []string {
+	for _, existing := range fields {
+		if existing == field {
+			return fields
+		}
+	}
+	return append(fields[:len(fields):len(fields)], field)
+}
+
+// userRow holds Scan destinations for a users row. Timestamps are scanned
+// as time.Time and formatted by result.
+type userRow struct {
+	user    User
+	created time.Time
+	updated time.Time
+}
+
+// targets returns Scan destinations for the given columns.
+func (ur *userRow) targets(columns []string) []interface{} {
+	targets := make([]interface{}, len(columns))
+	for i, column := range columns {
+		switch column {
+		case "id":
+			targets[i] = &ur.user.ID
+		case "username":
+			targets[i] = &ur.user.Username
+		case "email":
+			targets[i] = &ur.user.Email
+		case "bio":
+			targets[i] = &ur.user.Bio
+		case "created":
+			targets[i] = &ur.created
+		case "updated":
+			targets[i] = &ur.updated
+		case "active":
+			targets[i] = &ur.user.Active
+		}
+	}
+	return targets
+}
+
+func (ur *userRow) result() User {
+	user := ur.user
+	if !ur.created.IsZero() {
+		user.Created = ur.created.Format(time.RFC3339)
+	}
+	if !ur.updated.IsZero() {
+		user.Updated = ur.updated.Format(time.RFC3339)
+	}
+	return user
+}
+
+// scanUser reads a full row selected with userColumns.
+func scanUser(row interface {
+	Scan(dest ...interface{}) error
+}) (User, error) {
+	var ur userRow
+	if err := row.Scan(ur.targets(userFields)...); err != nil {
+		return User{}, err
+	}
+	return ur.result(), nil
+}
+
+// projectUser keeps only the requested fields, honoring ?id_as_string=true.
+func projectUser(r *http.Request, user *User, fields []string) map[string]interface{} {
+	projected := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		switch field {
+		case "id":
+			if r.URL.Query().Get("id_as_string") == "true" {
+				projected["id"] = string(user.ID)
+			} else {
+				projected["id"] = user.ID
+			}
+		case "username":
+			projected["username"] = user.Username
+		case "email":
+			projected["email"] = user.Email
+		case "bio":
+			projected["bio"] = user.Bio
+		case "created":
+			projected["created"] = user.Created
+		case "updated":
+			projected["updated"] = user.Updated
+		case "active":
+			projected["active"] = user.Active
+		}
+	}
+	return projected
+}
+
+func projectUsers(r *http.Request, users []User, fields []string) []map[string]interface{} {
+	projected := make([]map[string]interface{}, len(users))
+	for i := range users {
+		projected[i] = projectUser(r, &users[i], fields)
+	}
+	return projected
+}
+
+// presentUsers converts user payloads to their string-ID form when the
+// client asked for ?id_as_string=true, and returns other payloads unchanged.
+func presentUsers(r *http.Request, payload interface{}) interface{} {
+	if r.URL.Query().Get("id_as_string") != "true" {
+		return payload
+	}
+
+	toStringIDs := func(users []User) []stringIDUser {
+		converted := make([]stringIDUser, len(users))
+		for i, user := range users {
+			converted[i] = user.withStringID()
+		}
+		return converted
+	}
+
+	switch p := payload.(type) {
+	case User:
+		return p.withStringID()
+	case *User:
+		return p.withStringID()
+	case []User:
+		return toStringIDs(p)
+	case UserList:
+		return stringIDUserList{Data: toStringIDs(p.Data), Count: p.Count, Warnings: p.Warnings}
+	case []BatchResult:
+		converted := make([]stringIDBatchResult, len(p))
+		for i, result := range p {
+			converted[i] = stringIDBatchResult{ID: string(result.ID), Status: result.Status, Error: result.Error, Code: result.Code, Errors: result.Errors}
+			if result.User != nil {
+				user := result.User.withStringID()
+				converted[i].User = &user
+			}
+		}
+		return converted
+	}
+	return payload
+}
+
+// newEncoder returns the JSON encoder for API responses. <, > and & are
+// left as-is so bios read naturally; JSON_ESCAPE_HTML=true restores
+// encoding/json's \u003c escaping for clients that embed responses in HTML
+// script blocks.
+func (us *UserService) newEncoder(w io.Writer) *json.Encoder {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(us.config.EscapeHTML)
+	return encoder
+}
+
+// prettyWriter marks a response whose request asked for ?pretty=true, so
+// respondWithJSON indents it. See middlewarePrettyJSON.
+type prettyWriter struct {
+	http.ResponseWriter
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (pw *prettyWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
+
+// wantsPretty reports whether w, or a writer it wraps, is a prettyWriter.
+func wantsPretty(w http.ResponseWriter) bool {
+	for {
+		if _, ok := w.(*prettyWriter); ok {
+			return true
+		}
+		wrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return false
+		}
+		w = wrapper.Unwrap()
+	}
+}
+
+// middlewarePrettyJSON honours ?pretty=true, for reading responses by hand
+// while debugging. JSON_ALLOW_PRETTY=false turns it off in production.
+// Responses stay compact by default, and NDJSON is never indented.
+func (us *UserService) middlewarePrettyJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if us.config.AllowPrettyJSON && r.URL.Query().Get("pretty") == "true" {
+			w = &prettyWriter{ResponseWriter: w}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (us *UserService) respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	// Stream directly to response instead of marshaling to memory first
+	encoder := us.newEncoder(w)
+	if wantsPretty(w) {
+		encoder.SetIndent("", "  ")
+	}
+	if err := encoder.Encode(payload); err != nil {
+		http.Error(w, "JSON encoding error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// MetricsLite summarizes a few headline numbers from the Prometheus registry
+// as plain JSON, for dashboards that can't scrape /metrics.
+func (us *UserService) MetricsLite(w http.ResponseWriter, r *http.Request) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, codeInternalError, "Failed to gather metrics")
+		return
+	}
+
+	var totalRequests, serverErrors, hits, misses, activeConnections float64
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			switch family.GetName() {
+			case "http_requests_total":
+				value := metric.GetCounter().GetValue()
+				totalRequests += value
+				for _, label := range metric.GetLabel() {
+					if label.GetName() == "status" && strings.HasPrefix(label.GetValue(), "5") {
+						serverErrors += value
+					}
+				}
+			case "cache_hits_total":
+				hits += metric.GetCounter().GetValue()
+			case "cache_misses_total":
+				misses += metric.GetCounter().GetValue()
+			case "database_connections_active":
+				activeConnections += metric.GetGauge().GetValue()
+			}
+		}
+	}
+
+	ratio := func(part, whole float64) float64 {
+		if whole == 0 {
+			return 0
+		}
+		return part / whole
+	}
+
+	us.respondWithJSON(w, http.StatusOK, map[string]float64{
+		"total_requests":        totalRequests,
+		"error_rate":            ratio(serverErrors, totalRequests),
+		"cache_hit_ratio":       ratio(hits, hits+misses),
+		"active_db_connections": activeConnections,
+	})
+}
+
+func (us *UserService) respondWithValidationErrors(w http.ResponseWriter, errs []FieldError) {
+	us.respondWithJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+		"error":  "Invalid user data",
+		"code":   codeInvalidUserData,
+		"errors": errs,
+	})
+}
+
+// respondWithDecodeError answers a failed request body decode, telling an
+// oversized body apart from malformed JSON.
+func respondWithDecodeError(w http.ResponseWriter, err error, message string) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Request body too large")
+		return
+	}
+	if errors.Is(err, errInvalidUTF8) {
+		respondWithError(w, http.StatusUnprocessableEntity, codeInvalidUTF8, err.Error())
+		return
+	}
+	respondWithError(w, http.StatusBadRequest, codeInvalidJSON, message)
+}
+
+// Error codes sent in the "code" member of JSON error responses. Codes are
+// stable identifiers clients can switch on; messages may change.
+const (
+	codeInvalidUserID          = "invalid_user_id"          // malformed or out-of-range {id}
+	codeInvalidFields          = "invalid_fields"           // unknown ?fields= entry
+	codeInvalidJSON            = "invalid_json"             // undecodable request body
+	codeInvalidUTF8            = "invalid_utf8"             // body rejected by INVALID_UTF8=reject
+	codeBodyTooLarge           = "body_too_large"           // body over MAX_BODY_BYTES
+	codeInvalidUserData        = "invalid_user_data"        // validation failed, see "errors"
+	codeInvalidSearch          = "invalid_search_query"     // missing or too short ?q=
+	codeInvalidBatch           = "invalid_batch"            // empty or oversized update-batch
+	codeInvalidStatus          = "invalid_status"           // unknown webhook delivery ?status=
+	codeInvalidFilter          = "invalid_filter"           // malformed list filter such as ?verified=
+	codeInvalidPage            = "invalid_page"             // ?limit= or ?offset= out of range
+	codeInvalidMethodOverride  = "invalid_method_override"  // unsupported X-HTTP-Method-Override
+	codeUserNotFound           = "user_not_found"           // no user with this ID
+	codeNotCached              = "not_cached"               // /debug/cache/{id} miss
+	codeDuplicateUser          = "duplicate_user"           // username or email already taken
+	codeDuplicateUsername      = "duplicate_username"       // username taken (DUPLICATE_PRECHECK)
+	codeDuplicateEmail         = "duplicate_email"          // email taken (DUPLICATE_PRECHECK)
+	codeUnauthorized           = "unauthorized"             // missing or wrong bearer token
+	codeAdminDisabled          = "admin_disabled"           // ADMIN_TOKEN unset
+	codeNotFound               = "not_found"                // no such route
+	codeMethodNotAllowed       = "method_not_allowed"       // route exists, method doesn't
+	codeReindexRunning         = "reindex_running"          // a reindex is already in progress
+	codeSearchIndexUnavailable = "search_index_unavailable" // pg_trgm missing
+	codeServerBusy             = "server_busy"              // DB bulkhead full
+	codeTooManyConcurrent      = "too_many_concurrent"      // PER_IP_MAX_CONCURRENCY reached
+	codeRouteDisabled          = "route_disabled"           // endpoint switched off by DISABLED_ROUTES
+	codeTooManySubscribers     = "too_many_subscribers"     // SSE_MAX_SUBSCRIBERS reached
+	codeRequestCancelled       = "request_cancelled"        // client went away mid-operation
+	codeQueryTimeout           = "query_timeout"            // request or statement timeout cut a query short
+	codeDatabaseError          = "database_error"           // query failed
+	codeDatabaseUnavailable    = "database_unavailable"     // readiness DB ping failed
+	codeCacheUnavailable       = "cache_unavailable"        // readiness cache ping failed
+	codeShuttingDown           = "shutting_down"            // readiness after shutdown began
+	codeInternalError          = "internal_error"           // anything else
+)
+
+// respondWithError writes the JSON error envelope, {"error": message,
+// "code": code}.
+func respondWithError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message, "code": code})
+}
+
+// Retry-After hints sent with 503s (and the per-IP 429), sized to how long
+// each condition usually lasts.
+const (
+	retryAfterBusy        = time.Second     // bulkhead or per-IP slots full
+	retryAfterSubscribers = 5 * time.Second // SSE_MAX_SUBSCRIBERS reached
+	retryAfterUnavailable = 5 * time.Second // a dependency is down
+	retryAfterDisabled    = time.Minute     // route switched off by an operator
+)
+
+// setRetryAfter sets Retry-After in whole seconds, rounding up so a hint
+// is never zero.
+func setRetryAfter(w http.ResponseWriter, after time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(after.Seconds())))))
+}
+
+// respondWithDBError answers a failed query. Queries cut short by the
+// request's deadline or by STATEMENT_TIMEOUT get a 503, since the same
+// request may well succeed once the DB is less busy, and ones abandoned by
+// a client that went away are told apart in the logs and metrics by
+// request_cancelled. Anything else is a 500.
+func respondWithDBError(w http.ResponseWriter, r *http.Request, err error) {
+	var pqErr *pq.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(r.Context().Err(), context.DeadlineExceeded),
+		errors.As(err, &pqErr) && pqErr.Code == "57014":
+		respondUnavailable(w, retryAfterUnavailable, codeQueryTimeout, "Query timed out")
+	case errors.Is(r.Context().Err(), context.Canceled):
+		respondUnavailable(w, retryAfterUnavailable, codeRequestCancelled, "Request cancelled")
+	default:
+		respondWithError(w, http.StatusInternalServerError, codeDatabaseError, "Database error")
+	}
+}
+
+// sharedContext returns a context for a query that must not die with the
+// request that started it, such as one shared by several requests through
+// singleflight or a webhook enqueued after a committed write. It keeps ctx's
+// values and deadline but not its cancellation, so the query outlives the
+// request if that client goes away, while still being bounded by the route's
+// timeout.
+func sharedContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detached, deadline)
+	}
+	return context.WithCancel(detached)
+}
+
+// respondUnavailable writes a 503 error with a Retry-After hint. Every 503
+// goes through here so well-behaved clients know when to come back.
+func respondUnavailable(w http.ResponseWriter, retryAfter time.Duration, code, message string) {
+	setRetryAfter(w, retryAfter)
+	respondWithError(w, http.StatusServiceUnavailable, code, message)
+}
+
+// allowedMethods lists the methods registered for routes matching the
+// request path, regardless of the request's own method, sorted and
+// deduplicated. The route table is the single source for both 405 and
+// OPTIONS responses.
+func allowedMethods(router *mux.Router, r *http.Request) []string {
+	var methods []string
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		var match mux.RouteMatch
+		if route.Match(r, &match) || match.MatchErr == mux.ErrMethodMismatch {
+			routeMethods, err := route.GetMethods()
+			if err == nil {
+				methods = append(methods, routeMethods...)
+			}
+		}
+		return nil
+	})
+	slices.Sort(methods)
+	return slices.Compact(methods)
+}
+
+// methodNotAllowedHandler answers requests for a known path with an
+// unregistered method. OPTIONS is never registered, so it lands here too
+// and is answered with the path's Allow list.
+func (us *UserService) methodNotAllowedHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", strings.Join(allowedMethods(router, r), ", "))
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		respondWithError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+	})
+}
+
+func (us *UserService) notFoundHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondWithError(w, http.StatusNotFound, codeNotFound, "Not found")
+	})
+}
+
+// unmatchedRouteLabel labels requests that matched no route. Using the raw
+// path would let crafted 404s create unbounded metric series.
+const unmatchedRouteLabel = "__unmatched__"
+
+// routeLabel returns the matched route template with any variable patterns
+// stripped, e.g. /users/{id:[0-9]+} becomes /users/{id}, so metric labels stay
+// bounded no matter which IDs or query strings are requested.
+func routeLabel(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return unmatchedRouteLabel
+	}
+
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return unmatchedRouteLabel
+	}
+	return routeVariablePattern.ReplaceAllString(template, "{$1}")
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// timingMetric is one component of the Server-Timing header.
+type timingMetric int
+
+const (
+	timingDB timingMetric = iota
+	timingCache
+	timingMetricCount
+)
+
+var timingNames = [timingMetricCount]string{timingDB: "db", timingCache: "cache"}
+
+type timingKey struct{}
+
+// requestTiming sums the time one request spends in each timingMetric.
+type requestTiming struct {
+	start time.Time
+	spent [timingMetricCount]atomic.Int64
+}
+
+// recordTiming adds the time since start to the request's metric. It does
+// nothing outside middlewareServerTiming.
+func recordTiming(ctx context.Context, metric timingMetric, start time.Time) {
+	if timing, ok := ctx.Value(timingKey{}).(*requestTiming); ok {
+		timing.spent[metric].Add(int64(time.Since(start)))
+	}
+}
+
+// header formats the totals so far as a Server-Timing value, durations in
+// milliseconds.
+func (rt *requestTiming) header() string {
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', 3, 64)
+	}
+	parts := make([]string, 0, timingMetricCount+1)
+	for metric, name := range timingNames {
+		parts = append(parts, name+";dur="+ms(time.Duration(rt.spent[metric].Load())))
+	}
+	parts = append(parts, "total;dur="+ms(time.Since(rt.start)))
+	return strings.Join(parts, ", ")
+}
+
+// timingWriter adds the Server-Timing header just before the headers go
+// out, so it covers everything the handler did up to then.
+type timingWriter struct {
+	http.ResponseWriter
+	timing      *requestTiming
+	wroteHeader bool
+}
+
+func (tw *timingWriter) WriteHeader(code int) {
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		tw.Header().Set("Server-Timing", tw.timing.header())
+	}
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *timingWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (tw *timingWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// middlewareServerTiming reports on each response how long the request
+// spent in the DB and the cache, and in total, as a Server-Timing header
+// that browser devtools show alongside the network timings.
+func (us *UserService) middlewareServerTiming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timing := &requestTiming{start: time.Now()}
+		ctx := context.WithValue(r.Context(), timingKey{}, timing)
+		next.ServeHTTP(&timingWriter{ResponseWriter: w, timing: timing}, r.WithContext(ctx))
+	})
+}
+
+func countRequest(path string) {
+	counter, ok := requestCounts.Load(path)
+	if !ok {
+		counter, _ = requestCounts.LoadOrStore(path, new(atomic.Int64))
+	}
+	counter.(*atomic.Int64).Add(1)
+}
+
+// RequestCounts reports how many requests each route has served since startup.
+func (us *UserService) RequestCounts(w http.ResponseWriter, r *http.Request) {
+	counts := make(map[string]int64)
+	requestCounts.Range(func(path, counter interface{}) bool {
+		counts[path.(string)] = counter.(*atomic.Int64).Load()
+		return true
+	})
+	us.respondWithJSON(w, http.StatusOK, counts)
+}
+
+// trigramIndex is the search index rebuilt by /admin/reindex.
+const trigramIndex = "users_username_trgm_idx"
+
+// reindexJob tracks the single background reindex allowed at a time.
+type reindexJob struct {
+	mutex    sync.Mutex
+	running  bool
+	started  time.Time
+	finished time.Time
+	err      error
+}
+
+// StartReindex rebuilds the trigram search index in the background, for
+// use after bulk imports. REINDEX CONCURRENTLY keeps the index usable
+// while it is rebuilt, so searches keep being served. It answers 202, or
+// 409 if a reindex is already running.
+func (us *UserService) StartReindex(w http.ResponseWriter, r *http.Request) {
+	if !trigramAvailable {
+		respondWithError(w, http.StatusConflict, codeSearchIndexUnavailable, "Trigram search index unavailable")
+		return
+	}
+
+	job := &us.reindex
+	job.mutex.Lock()
+	if job.running {
+		job.mutex.Unlock()
+		respondWithError(w, http.StatusConflict, codeReindexRunning, "Reindex already running")
+		return
+	}
+	job.running = true
+	job.started = time.Now()
+	job.finished = time.Time{}
+	job.err = nil
+	job.mutex.Unlock()
+
+	// Detached from the request, a client disconnect shouldn't abort it
+	go func() {
+		err := us.execUnbounded(context.Background(), "REINDEX INDEX CONCURRENTLY "+trigramIndex)
+		if err != nil {
+			slog.Error("Reindex failed", "index", trigramIndex, "error", err)
+		} else {
+			slog.Info("Reindex complete", "index", trigramIndex)
+		}
+
+		job.mutex.Lock()
+		job.running = false
+		job.finished = time.Now()
+		job.err = err
+		job.mutex.Unlock()
+	}()
+
+	us.respondWithJSON(w, http.StatusAccepted, us.reindexStatus(r.Context()))
+}
+
+// execUnbounded runs query with STATEMENT_TIMEOUT lifted, for maintenance
+// statements that can't run in a transaction (so SET LOCAL is out). The
+// connection's own timeout is restored before it goes back to the pool.
+func (us *UserService) execUnbounded(ctx context.Context, query string) error {
+	conn, err := us.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SET statement_timeout = 0"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "RESET statement_timeout")
+
+	_, err = conn.ExecContext(ctx, query)
+	return err
+}
+
+// ReindexStatus reports the state of the last reindex.
+func (us *UserService) ReindexStatus(w http.ResponseWriter, r *http.Request) {
+	us.respondWithJSON(w, http.StatusOK, us.reindexStatus(r.Context()))
+}
+
+// reindexStatus describes the reindex job. While one runs, progress comes
+// from pg_stat_progress_create_index.
+func (us *UserService) reindexStatus(ctx context.Context) map[string]interface{} {
+	job := &us.reindex
+	job.mutex.Lock()
+	status := map[string]interface{}{"index": trigramIndex, "running": job.running}
+	if !job.started.IsZero() {
+		status["started"] = job.started.Format(time.RFC3339)
+	}
+	if !job.finished.IsZero() {
+		status["finished"] = job.finished.Format(time.RFC3339)
+	}
+	if job.err != nil {
+		status["error"] = job.err.Error()
+	}
+	running := job.running
+	job.mutex.Unlock()
+
+	if running {
+		var phase string
+		var blocksDone, blocksTotal int64
+		err := us.db.QueryRowContext(ctx, `
+			SELECT phase, blocks_done, blocks_total
+			FROM pg_stat_progress_create_index
+			WHERE relid = 'users'::regclass
+			LIMIT 1`).Scan(&phase, &blocksDone, &blocksTotal)
+		if err == nil {
+			status["phase"] = phase
+			status["blocks_done"] = blocksDone
+			status["blocks_total"] = blocksTotal
+		}
+	}
+	return status
+}
+
+// SelfTest is a deep health check: it inserts, reads back and soft-deletes
+// a throwaway user, checking it no longer reads back, inside a transaction that is always rolled back, so it
+// exercises the full write path without leaving anything behind. Each
+// step's duration is reported in milliseconds; a failure answers 503 with
+// the step that broke.
+func (us *UserService) SelfTest(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), selfTestTimeout)
+	defer cancel()
+
+	started := time.Now()
+	steps := make(map[string]float64)
+	fail := func(step string, err error) {
+		slog.Error("Self-test failed", "step", step, "error", err)
+		setRetryAfter(w, retryAfterUnavailable)
+		us.respondWithJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"ok":          false,
+			"failed_step": step,
+			"error":       err.Error(),
+			"steps":       steps,
+		})
+	}
+	timed := func(step string, fn func() error) bool {
+		stepStarted := time.Now()
+		if err := fn(); err != nil {
+			fail(step, err)
+			return false
+		}
+		steps[step] = float64(time.Since(stepStarted).Microseconds()) / 1000
+		return true
+	}
+
+	var tx *sql.Tx
+	if !timed("begin", func() (err error) {
+		tx, err = us.db.BeginTx(ctx, nil)
+		return err
+	}) {
+		return
+	}
+	defer tx.Rollback()
+
+	marker := strconv.FormatInt(time.Now().UnixNano(), 36)
+	var id UserID
+	passed := timed("insert", func() error {
+		return tx.QueryRowContext(ctx, "INSERT INTO users (username, email, bio) VALUES ($1, $2, '') RETURNING id",
+			"selftest_"+marker, "selftest_"+marker+"@selftest.invalid").Scan(&id)
+	}) && timed("select", func() error {
+		_, err := scanUser(tx.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1 AND deleted_at IS NULL", id))
+		return err
+	}) && timed("delete", func() error {
+		result, err := tx.ExecContext(ctx, "UPDATE users SET deleted_at = CURRENT_TIMESTAMP WHERE id = $1 AND deleted_at IS NULL", id)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n != 1 {
+			return fmt.Errorf("delete matched %d rows, want 1", n)
+		}
+		_, err = scanUser(tx.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1 AND deleted_at IS NULL", id))
+		if err == nil {
+			return errors.New("deleted user still reads back")
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+		return nil
+	}) && timed("rollback", tx.Rollback)
+	if !passed {
+		return
+	}
+
+	us.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"ok":       true,
+		"steps":    steps,
+		"total_ms": float64(time.Since(started).Microseconds()) / 1000,
+	})
+}
+
+// limitDBConcurrency caps how many DB-bound handlers run at once. A request
+// arriving when all slots are taken waits up to DB_QUEUE_TIMEOUT for one and
+// then gets a 503, so a spike queues briefly instead of piling onto the DB.
+func (us *UserService) limitDBConcurrency(next http.HandlerFunc) http.HandlerFunc {
+	if us.dbSlots == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case us.dbSlots <- struct{}{}:
+		default:
+			dbQueued.Inc()
+			timer := time.NewTimer(us.config.DBQueueTimeout)
+			select {
+			case us.dbSlots <- struct{}{}:
+				timer.Stop()
+				dbQueued.Dec()
+			case <-timer.C:
+				dbQueued.Dec()
+				respondUnavailable(w, retryAfterBusy, codeServerBusy, "Server busy, try again later")
+				return
+			case <-r.Context().Done():
+				timer.Stop()
+				dbQueued.Dec()
+				return
+			}
+		}
+		defer func() { <-us.dbSlots }()
+		next(w, r)
+	}
+}
+
+// withTimeout gives route its own deadline in place of REQUEST_TIMEOUT,
+// for endpoints that legitimately run longer; 0 means no deadline. It must
+// be called before the server starts.
+func (us *UserService) withTimeout(route *mux.Route, timeout time.Duration) *mux.Route {
+	us.routeTimeouts[route] = timeout
+	return route
+}
+
+// writeDeadlineSlack is added to a route's timeout when extending the
+// write deadline, so a handler finishing right at its deadline can still
+// send its response.
+const writeDeadlineSlack = 5 * time.Second
+
+// middlewareTimeout puts the route's deadline (withTimeout, or else
+// REQUEST_TIMEOUT) on the request context, so DB calls made with it are
+// cancelled once it passes. A deadline beyond WRITE_TIMEOUT also extends
+// the connection's write deadline, or the server would cut the response
+// off first.
+func (us *UserService) middlewareTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout, ok := us.routeTimeouts[mux.CurrentRoute(r)]
+		if !ok {
+			timeout = us.config.RequestTimeout
+		}
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if us.config.WriteTimeout > 0 && timeout > us.config.WriteTimeout {
+			http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + writeDeadlineSlack))
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// middlewarePerIPConcurrency caps how many requests one client IP can have
+// in flight at once, so a client holding many slow connections can't starve
+// everyone else. Requests over PER_IP_MAX_CONCURRENCY get a 429 straight
+// away rather than queueing.
+//
+// ExemptPaths don't count, so probes and scrapers sharing an IP with a busy
+// client still get through. Neither does /users/events: a stream is open
+// for as long as the client is subscribed, and SSE_MAX_SUBSCRIBERS caps
+// those instead.
+func (us *UserService) middlewarePerIPConcurrency(next http.Handler) http.Handler {
+	if us.config.PerIPConcurrency <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if us.exemptPath(r.URL.Path) || r.URL.Path == "/users/events" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := us.clientIP(r)
+
+		us.ipMutex.Lock()
+		if us.ipInFlight[ip] >= us.config.PerIPConcurrency {
+			us.ipMutex.Unlock()
+			setRetryAfter(w, retryAfterBusy)
+			respondWithError(w, http.StatusTooManyRequests, codeTooManyConcurrent, "Too many concurrent requests")
+			return
+		}
+		us.ipInFlight[ip]++
+		us.ipMutex.Unlock()
+
+		defer func() {
+			us.ipMutex.Lock()
+			if us.ipInFlight[ip]--; us.ipInFlight[ip] == 0 {
+				delete(us.ipInFlight, ip)
+			}
+			us.ipMutex.Unlock()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cachedResponse is a captured 200 response. It is only served while
+// mutation matches lastMutation, so any successful write invalidates every
+// entry at once without walking the map. header holds only what the handler
+// itself set; headers from the surrounding middleware, such as the request
+// ID and CORS, are per request and are left for them to set again.
+type cachedResponse struct {
+	header   http.Header
+	body     []byte
+	mutation int64
+	expires  time.Time
+}
+
+// responseRecorder captures a response while passing it through.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(code int) {
+	rr.status = code
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController flush through the recorder.
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// headerChanges returns copies of the headers in after that were added or
+// changed since before.
+func headerChanges(before, after http.Header) http.Header {
+	changes := make(http.Header)
+	for name, values := range after {
+		if !slices.Equal(before[name], values) {
+			changes[name] = slices.Clone(values)
+		}
+	}
+	return changes
+}
+
+// responseCacheKey covers everything the cached handlers vary on: the
+// path, the normalized query and the Accept header (for HTML bios).
+func responseCacheKey(r *http.Request) string {
+	return r.URL.Path + "?" + r.URL.Query().Encode() + "|" + r.Header.Get("Accept")
+}
+
+// cacheResponses serves repeated GETs from a short-lived response cache when
+// RESPONSE_CACHE_TTL is set. Conditional requests bypass it so
+// Last-Modified handling stays exact.
+func (us *UserService) cacheResponses(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if us.config.ResponseCacheTTL <= 0 || r.Header.Get("If-Modified-Since") != "" {
+			next(w, r)
+			return
+		}
+
+		key := responseCacheKey(r)
+		mutation := us.lastMutation.Load()
+		now := time.Now()
+
+		us.responseMutex.Lock()
+		cached, ok := us.responses[key]
+		us.responseMutex.Unlock()
+		recordTiming(r.Context(), timingCache, now)
+		if ok && cached.mutation == mutation && now.Before(cached.expires) {
+			for name, values := range cached.header {
+				w.Header()[name] = slices.Clone(values)
+			}
+			w.Header().Set("X-Cache", "HIT")
+			w.WriteHeader(http.StatusOK)
+			w.Write(cached.body)
+			return
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		before := w.Header().Clone()
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+		// Stale results would otherwise be replayed after the DB recovers
+		if recorder.status != http.StatusOK || hasWarning(w.Header(), warnStale) ||
+			w.Header().Get("Cache-Control") == "no-store" {
+			return
+		}
+
+		header := headerChanges(before, w.Header())
+		header.Del("Server-Timing")
+		us.responseMutex.Lock()
+		if len(us.responses) >= maxCachedResponses {
+			us.responses = make(map[string]*cachedResponse)
+		}
+		us.responses[key] = &cachedResponse{
+			header:   header,
+			body:     recorder.body.Bytes(),
+			mutation: mutation,
+			expires:  now.Add(us.config.ResponseCacheTTL),
+		}
+		us.responseMutex.Unlock()
+	}
+}
+
+func (us *UserService) middlewareMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		path := routeLabel(r)
+		countRequest(path)
+		httpDuration.WithLabelValues(path, r.Method).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(path, r.Method, strconv.Itoa(recorder.status)).Inc()
+	})
+}
+
+func (us *UserService) isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range us.config.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that made the request. The
+// X-Forwarded-For header is only believed when the immediate peer is a
+// trusted proxy, and is then walked from the right, skipping further trusted
+// hops, so a client can't spoof its address by sending the header itself.
+func (us *UserService) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !us.isTrustedProxy(peer) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		host = hop.Unmap().String()
+		if !us.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+// requireAdmin guards operator endpoints with a bearer token. They are
+// disabled entirely when ADMIN_TOKEN is unset.
+func (us *UserService) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if us.config.AdminToken == "" {
+			respondWithError(w, http.StatusForbidden, codeAdminDisabled, "Admin endpoints are disabled")
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(us.config.AdminToken)) != 1 {
+			respondWithError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// defaultExemptPaths stay public when API_TOKEN is set so probes and
+// scrapers don't need credentials.
+var defaultExemptPaths = []string{"/health", "/readyz", "/metrics", "/metrics-lite", "/version", "/openapi.json"}
+
+// exemptPath reports whether path matches an ExemptPaths entry. Entries are
+// exact paths, or prefixes when they end in "/*" ("/debug/*" matches
+// "/debug" and everything below it).
+func (us *UserService) exemptPath(path string) bool {
+	for _, pattern := range us.config.ExemptPaths {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if path == prefix || strings.HasPrefix(path, prefix+"/") {
+				return true
+			}
+			continue
+		}
+		if path == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// middlewareAuth requires a bearer API_TOKEN on every route outside
+// ExemptPaths. The admin token is accepted too so admin endpoints only need
+// one credential. Auth is off when API_TOKEN is unset.
+func (us *UserService) middlewareAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if us.config.APIToken == "" || us.exemptPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := []byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		apiOK := subtle.ConstantTimeCompare(token, []byte(us.config.APIToken)) == 1
+		adminOK := us.config.AdminToken != "" && subtle.ConstantTimeCompare(token, []byte(us.config.AdminToken)) == 1
+		if !apiOK && !adminOK {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			respondWithError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// middlewareFeatureFlags answers requests to disabled routes with
+// DISABLED_ROUTE_STATUS while leaving them registered, so they come back as
+// soon as they're re-enabled. Entries are route labels such as
+// /users/search or /users/{id}, optionally prefixed with a method
+// ("delete /users/{id}") to disable just that method.
+func (us *UserService) middlewareFeatureFlags(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		disabled := *us.disabledRoutes.Load()
+		if len(disabled) > 0 {
+			route := strings.ToLower(routeLabel(r))
+			if disabled[route] || disabled[strings.ToLower(r.Method)+" "+route] {
+				if us.config.DisabledRouteStatus == http.StatusNotFound {
+					respondWithError(w, http.StatusNotFound, codeNotFound, "Not found")
+				} else {
+					respondUnavailable(w, retryAfterDisabled, codeRouteDisabled, "This endpoint is temporarily disabled")
+				}
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// middlewareCORS adds CORS headers for origins in CORS_ALLOWED_ORIGINS ("*"
+// allows any) and answers preflight requests directly. It wraps the router
+// rather than being registered with r.Use, since preflight OPTIONS requests
+// don't match any route and would otherwise never reach it.
+func (us *UserService) middlewareCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(us.config.CORSOrigins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !slices.Contains(us.config.CORSOrigins, "*") && !slices.Contains(us.config.CORSOrigins, strings.ToLower(origin)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Content-Encoding")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// overridableMethods are the only methods a POST may be rewritten to. GET and
+// friends are excluded so an override can't turn a write into a cached read.
+var overridableMethods = map[string]bool{
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// middlewareMethodOverride lets clients limited to GET/POST reach PUT, PATCH
+// and DELETE handlers by sending a POST with X-HTTP-Method-Override. It is
+// off unless METHOD_OVERRIDE is set, and wraps the router because the method
+// must be rewritten before mux matches routes.
+func (us *UserService) middlewareMethodOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		override := r.Header.Get("X-HTTP-Method-Override")
+		if !us.config.MethodOverride || override == "" || r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		method := strings.ToUpper(strings.TrimSpace(override))
+		if !overridableMethods[method] {
+			respondWithError(w, http.StatusBadRequest, codeInvalidMethodOverride, "Invalid X-HTTP-Method-Override, expected PUT, PATCH or DELETE")
+			return
+		}
+		r.Method = method
+		r.Header.Del("X-HTTP-Method-Override")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// gzipBody closes both the gzip stream and the underlying request body.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (gb gzipBody) Close() error {
+	gb.Reader.Close()
+	return gb.body.Close()
+}
+
+// middlewareRequestBody caps request bodies at MaxBodyBytes and transparently
+// decompresses Content-Encoding: gzip. The cap applies to the decompressed
+// stream as well, so a small compressed payload can't expand without bound.
+func (us *UserService) middlewareRequestBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, us.config.MaxBodyBytes)
+
+		if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+			reader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				respondWithDecodeError(w, err, "Invalid gzip body")
+				return
+			}
+			r.Body = http.MaxBytesReader(w, gzipBody{Reader: reader, body: r.Body}, us.config.MaxBodyBytes)
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type requestIDKey struct{}
+
+// maxRequestIDLength bounds accepted inbound IDs so clients can't inflate
+// every log line.
+const maxRequestIDLength = 128
+
+// middlewareRequestID propagates the REQUEST_ID_HEADER value (X-Request-ID
+// by default), generating one when the client didn't send a usable ID. It
+// is echoed on the response and kept in the context for logging.
+func (us *UserService) middlewareRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(us.config.RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			r.Header.Set(us.config.RequestIDHeader, id)
+		}
+		w.Header().Set(us.config.RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID accepts non-empty printable ASCII IDs up to
+// maxRequestIDLength, which covers UUIDs and traceparent values.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestID returns the ID assigned by middlewareRequestID, or "".
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func (us *UserService) middlewareLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		slog.Info("Request handled",
+			"request_id", requestID(r.Context()),
+			"client_ip", us.clientIP(r),
+			"method", r.Method,
+			"path", r.URL.Path,
+			"duration", time.Since(start).String(),
+		)
+	})
+}
+
+// sseEvent is one Server-Sent Event, data holding its JSON payload.
+type sseEvent struct {
+	name string
+	data []byte
+}
 
-	prometheus.MustRegister(httpDuration)
-	prometheus.MustRegister(httpRequests)
-	prometheus.MustRegister(dbConnections)
-	prometheus.MustRegister(cacheSize)
+// sseHub fans events out to /users/events subscribers. Each subscriber has
+// a bounded buffer; when it is full the event is dropped for that subscriber
+// rather than blocking the publisher, so one slow client can't stall writes
+// or grow memory without bound.
+type sseHub struct {
+	mutex       sync.Mutex
+	subscribers map[chan sseEvent]struct{}
+	max         int
+	buffer      int
+	closed      bool
 }
 
-func NewUserService(db *sql.DB) *UserService {
-	listStmt, err := db.Prepare("SELECT id, username, email, bio, created FROM users ORDER BY created DESC LIMIT 20")
-	if err != nil {
-		log.Fatal("Failed to prepare statement:", err)
+func newSSEHub(max, buffer int) *sseHub {
+	return &sseHub{subscribers: make(map[chan sseEvent]struct{}), max: max, buffer: buffer}
+}
+
+// subscribe registers a subscriber, failing once max subscribers are
+// connected or the hub has been closed.
+func (h *sseHub) subscribe() (chan sseEvent, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed || len(h.subscribers) >= h.max {
+		return nil, false
 	}
+	events := make(chan sseEvent, h.buffer)
+	h.subscribers[events] = struct{}{}
+	sseSubscribers.Set(float64(len(h.subscribers)))
+	return events, true
+}
 
-	return &UserService{
-		db:       db,
-		cache:    make(map[int]*User),
-		listStmt: listStmt,
+func (h *sseHub) unsubscribe(events chan sseEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, ok := h.subscribers[events]; ok {
+		delete(h.subscribers, events)
+		close(events)
 	}
+	sseSubscribers.Set(float64(len(h.subscribers)))
 }
 
-func (us *UserService) CreateUser(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	defer func() {
-		httpDuration.WithLabelValues("/users", "POST").Observe(time.Since(start).Seconds())
-	}()
+func (h *sseHub) publish(event sseEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for events := range h.subscribers {
+		select {
+		case events <- event:
+		default:
+			sseDropped.Inc()
+		}
+	}
+}
 
-	var user User
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&user); err != nil {
-		httpRequests.WithLabelValues("/users", "POST", "400").Inc()
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+// close disconnects every subscriber and refuses new ones, so streams end
+// during graceful shutdown.
+func (h *sseHub) close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.closed = true
+	for events := range h.subscribers {
+		delete(h.subscribers, events)
+		close(events)
 	}
+	sseSubscribers.Set(0)
+}
 
-	if !us.validateUser(&user) {
-		httpRequests.WithLabelValues("/users", "POST", "400").Inc()
-		http.Error(w, "Invalid user data", http.StatusBadRequest)
+// StreamEvents streams user.created, user.updated and user.deleted events
+// as Server-Sent Events until the client disconnects or the server shuts
+// down.
+func (us *UserService) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	events, ok := us.events.subscribe()
+	if !ok {
+		respondUnavailable(w, retryAfterSubscribers, codeTooManySubscribers, "Too many event subscribers")
 		return
 	}
+	defer us.events.unsubscribe(events)
 
-	query := fmt.Sprintf("INSERT INTO users (username, email, bio, created) VALUES ('%s', '%s', '%s', '%s') RETURNING id",
-		user.Username, user.Email, user.Bio, time.Now().Format(time.RFC3339))
+	// Streams outlive WRITE_TIMEOUT by design
+	controller := http.NewResponseController(w)
+	controller.SetWriteDeadline(time.Time{})
 
-	err := us.db.QueryRow(query).Scan(&user.ID)
-	if err != nil {
-		httpRequests.WithLabelValues("/users", "POST", "500").Inc()
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	controller.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, open := <-events:
+			if !open {
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.name, event.data)
+			if err := controller.Flush(); err != nil {
+				return
+			}
+		}
 	}
+}
 
-	globalUsers = append(globalUsers, user)
+// Webhook delivery statuses
+const (
+	webhookPending   = "pending"
+	webhookDelivered = "delivered"
+	webhookDead      = "dead"
+)
 
-	us.mutex.Lock()
-	us.cache[user.ID] = &user
-	cacheSize.Set(float64(len(us.cache)))
-	us.mutex.Unlock()
+// maxWebhookBackoff caps the exponential retry delay
+const maxWebhookBackoff = time.Hour
 
-	httpRequests.WithLabelValues("/users", "POST", "201").Inc()
-	us.respondWithJSON(w, http.StatusCreated, user)
-}
+// webhookBatchSize bounds how many deliveries one pass claims.
+const webhookBatchSize = 50
 
-func (us *UserService) GetUser(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	defer func() {
-		httpDuration.WithLabelValues("/users/{id}", "GET").Observe(time.Since(start).Seconds())
-	}()
+type WebhookDelivery struct {
+	ID          int             `json:"id"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt string          `json:"next_attempt_at"`
+	LastError   string          `json:"last_error,omitempty"`
+	Created     string          `json:"created"`
+}
 
-	vars := mux.Vars(r)
-	id, err := strconv.Atoi(vars["id"])
+// publishEvent announces a user change to SSE subscribers and, when
+// configured, the webhook queue.
+func (us *UserService) publishEvent(ctx context.Context, event string, payload interface{}) {
+	body, err := json.Marshal(payload)
 	if err != nil {
-		httpRequests.WithLabelValues("/users/{id}", "GET", "400").Inc()
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
-	}
-
-	us.mutex.RLock()
-	if cachedUser, exists := us.cache[id]; exists {
-		us.mutex.RUnlock()
-		processedUser := us.processUserData(cachedUser)
-		httpRequests.WithLabelValues("/users/{id}", "GET", "200").Inc()
-		us.respondWithJSON(w, http.StatusOK, processedUser)
+		slog.Error("Failed to encode event payload", "event", event, "error", err)
 		return
 	}
-	us.mutex.RUnlock()
 
-	query := "SELECT * FROM users WHERE id = " + strconv.Itoa(id)
-	row := us.db.QueryRow(query)
+	us.events.publish(sseEvent{name: event, data: body})
+	us.enqueueWebhook(ctx, event, body)
+}
 
-	var user User
-	var created time.Time
-	err = row.Scan(&user.ID, &user.Username, &user.Email, &user.Bio, &created)
-	if err == sql.ErrNoRows {
-		httpRequests.WithLabelValues("/users/{id}", "GET", "404").Inc()
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
-	} else if err != nil {
-		httpRequests.WithLabelValues("/users/{id}", "GET", "500").Inc()
-		http.Error(w, "Database error", http.StatusInternalServerError)
+// enqueueWebhook records an event in the webhook_deliveries table for the
+// background worker to send. Once queued, a delivery survives restarts and
+// is retried until it goes through or gives up. The insert runs after the
+// user write has committed and outside its transaction though, so a crash
+// between the two loses the event. It is a no-op when WEBHOOK_URL is unset.
+func (us *UserService) enqueueWebhook(ctx context.Context, event string, body []byte) {
+	if us.config.WebhookURL == "" {
 		return
 	}
 
-	user.Created = created.Format(time.RFC3339)
-
-	us.mutex.Lock()
-	us.cache[id] = &user
-	cacheSize.Set(float64(len(us.cache)))
-	us.mutex.Unlock()
-
-	processedUser := us.processUserData(&user)
-	httpRequests.WithLabelValues("/users/{id}", "GET", "200").Inc()
-	us.respondWithJSON(w, http.StatusOK, processedUser)
+	// The write has already happened, so a client hanging up must not drop
+	// its event; the route's deadline still bounds the insert.
+	ctx, cancel := sharedContext(ctx)
+	defer cancel()
+	_, err := us.db.ExecContext(ctx, "INSERT INTO webhook_deliveries (event, payload) VALUES ($1, $2)", event, body)
+	if err != nil {
+		slog.Error("Failed to enqueue webhook", "event", event, "error", err)
+	}
 }
 
-func (us *UserService) ListUsers(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	defer func() {
-		httpDuration.WithLabelValues("/users", "GET").Observe(time.Since(start).Seconds())
-	}()
+// runWebhookWorker delivers due webhooks every WebhookInterval until ctx is
+// done. Pending deliveries left over at shutdown are flushed by the
+// OnShutdown hook registered in startBackground.
+func (us *UserService) runWebhookWorker(ctx context.Context) {
+	ticker := time.NewTicker(us.config.WebhookInterval)
+	defer ticker.Stop()
 
-	counterMutex.Lock()
-	requestCount++
-	counterMutex.Unlock()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := us.deliverDueWebhooks(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("Webhook delivery pass failed", "error", err)
+			}
+		}
+	}
+}
 
-	rows, err := us.listStmt.Query()
+// deliverDueWebhooks attempts every pending delivery whose retry time has
+// come. Failures are rescheduled with exponential backoff until
+// WebhookAttempts is reached, then dead-lettered. It returns the number of
+// deliveries attempted.
+//
+// Rows are claimed in one short statement that pushes next_attempt_at out
+// by a lease covering the whole batch, so several instances can share the
+// queue without holding row locks while the HTTP calls run. Each outcome is
+// then recorded with its own UPDATE. A claim left by an instance that died
+// mid-batch simply expires and the delivery is retried.
+//
+// When ctx is cancelled part-way, as the worker's is on shutdown, the
+// unsent claims are released rather than left to wait out the lease, so the
+// shutdown flush or another instance sends them. Outcomes of sends that did
+// finish are still recorded.
+func (us *UserService) deliverDueWebhooks(ctx context.Context) (int, error) {
+	lease := us.config.WebhookTimeout * webhookBatchSize
+	rows, err := us.db.QueryContext(ctx, `
+		UPDATE webhook_deliveries
+		SET next_attempt_at = NOW() + $2 * INTERVAL '1 millisecond'
+		WHERE id IN (
+			SELECT id
+			FROM webhook_deliveries
+			WHERE status = $1 AND next_attempt_at <= NOW()
+			ORDER BY id
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, event, payload, attempts`, webhookPending, lease.Milliseconds(), webhookBatchSize)
 	if err != nil {
-		httpRequests.WithLabelValues("/users", "GET", "500").Inc()
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
+		return 0, err
 	}
-	defer rows.Close()
-
-	users := make([]User, 0, 20)
 
+	var due []WebhookDelivery
 	for rows.Next() {
-		var user User
-		var created time.Time
-		err := rows.Scan(&user.ID, &user.Username, &user.Bio, &user.Email, &created)
+		var delivery WebhookDelivery
+		if err := rows.Scan(&delivery.ID, &delivery.Event, &delivery.Payload, &delivery.Attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, delivery)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	// RETURNING has no order, deliveries go out oldest first
+	slices.SortFunc(due, func(a, b WebhookDelivery) int { return a.ID - b.ID })
+
+	// Outcomes are written even once ctx is cancelled, a cancelled write
+	// would leave a sent delivery leased and resend it later
+	recordCtx := context.WithoutCancel(ctx)
+	for i, delivery := range due {
+		if ctx.Err() != nil {
+			return i, us.releaseWebhooks(ctx, due[i:])
+		}
+		attempts := delivery.Attempts + 1
+		sendErr := us.sendWebhook(ctx, delivery)
+		// A send cut short by cancellation isn't the endpoint's failure
+		if sendErr != nil && ctx.Err() != nil {
+			return i, us.releaseWebhooks(ctx, due[i:])
+		}
+		switch {
+		case sendErr == nil:
+			_, err = us.db.ExecContext(recordCtx,
+				"UPDATE webhook_deliveries SET status = $1, attempts = $2, last_error = NULL WHERE id = $3",
+				webhookDelivered, attempts, delivery.ID)
+		case attempts >= us.config.WebhookAttempts:
+			slog.Warn("Webhook dead-lettered", "id", delivery.ID, "event", delivery.Event, "error", sendErr)
+			_, err = us.db.ExecContext(recordCtx,
+				"UPDATE webhook_deliveries SET status = $1, attempts = $2, last_error = $3 WHERE id = $4",
+				webhookDead, attempts, sendErr.Error(), delivery.ID)
+		default:
+			_, err = us.db.ExecContext(recordCtx,
+				"UPDATE webhook_deliveries SET attempts = $1, last_error = $2, next_attempt_at = NOW() + $3 * INTERVAL '1 millisecond' WHERE id = $4",
+				attempts, sendErr.Error(), webhookBackoff(us.config.WebhookBackoff, attempts).Milliseconds(), delivery.ID)
+		}
 		if err != nil {
-			httpRequests.WithLabelValues("/users", "GET", "500").Inc()
-			http.Error(w, "Database error", http.StatusInternalServerError)
-			return
+			return i + 1, err
 		}
-		user.Created = created.Format(time.RFC3339)
-		processedUser := us.processUserData(&user)
-		users = append(users, *processedUser)
 	}
 
-	us.updateCache(users)
+	return len(due), nil
+}
 
-	httpRequests.WithLabelValues("/users", "GET", "200").Inc()
-	us.respondWithJSON(w, http.StatusOK, users)
+// releaseWebhooks ends the lease on claimed deliveries that weren't sent,
+// making them due again straight away. It runs detached from ctx, which has
+// usually just been cancelled, and returns ctx's error once done.
+func (us *UserService) releaseWebhooks(ctx context.Context, deliveries []WebhookDelivery) error {
+	ids := make([]int64, len(deliveries))
+	for i, delivery := range deliveries {
+		ids[i] = int64(delivery.ID)
+	}
+	releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), closeTimeout)
+	defer cancel()
+	if _, err := us.db.ExecContext(releaseCtx, "UPDATE webhook_deliveries SET next_attempt_at = NOW() WHERE id = ANY($1)", pq.Array(ids)); err != nil {
+		return fmt.Errorf("releasing %d unsent webhooks: %w", len(ids), err)
+	}
+	return ctx.Err()
 }
 
-func (us *UserService) updateCache(users []User) {
-	us.mutex.Lock()
-	for _, user := range users {
-		us.cache[user.ID] = &user
+// webhookBackoff doubles the base delay for each failed attempt.
+func webhookBackoff(base time.Duration, attempts int) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < maxWebhookBackoff; i++ {
+		delay *= 2
 	}
-	us.mutex.Unlock()
-	cacheSize.Set(float64(len(us.cache)))
+	return min(delay, maxWebhookBackoff)
 }
 
-func (us *UserService) UpdateUser(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	defer func() {
-		httpDuration.WithLabelValues("/users/{id}", "PUT").Observe(time.Since(start).Seconds())
-	}()
+func (us *UserService) sendWebhook(ctx context.Context, delivery WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(ctx, us.config.WebhookTimeout)
+	defer cancel()
 
-	vars := mux.Vars(r)
-	id, err := strconv.Atoi(vars["id"])
+	body, err := json.Marshal(map[string]interface{}{
+		"id":    delivery.ID,
+		"event": delivery.Event,
+		"data":  delivery.Payload,
+	})
 	if err != nil {
-		httpRequests.WithLabelValues("/users/{id}", "PUT", "400").Inc()
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
+		return err
 	}
 
-	var user User
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&user); err != nil {
-		httpRequests.WithLabelValues("/users/{id}", "PUT", "400").Inc()
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, us.config.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
 
-	if !us.validateUser(&user) {
-		httpRequests.WithLabelValues("/users/{id}", "PUT", "400").Inc()
-		http.Error(w, "Invalid user data", http.StatusBadRequest)
-		return
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook endpoint returned %d", resp.StatusCode)
 	}
+	return nil
+}
 
-	query := fmt.Sprintf("UPDATE users SET username='%s', email='%s', bio='%s' WHERE id=%d",
-		user.Username, user.Email, user.Bio, id)
+// ListWebhookDeliveries shows the most recent deliveries, optionally
+// filtered by ?status=pending|delivered|dead, for inspecting the queue.
+func (us *UserService) ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	query := `
+		SELECT id, event, payload, status, attempts, next_attempt_at, COALESCE(last_error, ''), created
+		FROM webhook_deliveries`
+	var args []interface{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		if status != webhookPending && status != webhookDelivered && status != webhookDead {
+			respondWithError(w, http.StatusBadRequest, codeInvalidStatus, "Invalid status, expected pending, delivered or dead")
+			return
+		}
+		query += " WHERE status = $1"
+		args = append(args, status)
+	}
+	query += " ORDER BY id DESC LIMIT 100"
 
-	result, err := us.db.Exec(query)
+	rows, err := us.db.QueryContext(r.Context(), query, args...)
 	if err != nil {
-		httpRequests.WithLabelValues("/users/{id}", "PUT", "500").Inc()
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		respondWithDBError(w, r, err)
 		return
 	}
+	defer rows.Close()
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		httpRequests.WithLabelValues("/users/{id}", "PUT", "404").Inc()
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
+	deliveries := make([]WebhookDelivery, 0)
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var nextAttempt, created time.Time
+		err := rows.Scan(&delivery.ID, &delivery.Event, &delivery.Payload, &delivery.Status,
+			&delivery.Attempts, &nextAttempt, &delivery.LastError, &created)
+		if err != nil {
+			respondWithDBError(w, r, err)
+			return
+		}
+		delivery.NextAttempt = nextAttempt.Format(time.RFC3339)
+		delivery.Created = created.Format(time.RFC3339)
+		deliveries = append(deliveries, delivery)
 	}
 
-	user.ID = id
-	us.mutex.Lock()
-	delete(us.cache, id)
-	us.mutex.Unlock()
+	us.respondWithJSON(w, http.StatusOK, deliveries)
+}
 
-	httpRequests.WithLabelValues("/users/{id}", "PUT", "200").Inc()
-	us.respondWithJSON(w, http.StatusOK, user)
+func updateDBMetrics(stats sql.DBStats) {
+	dbConnections.Set(float64(stats.OpenConnections))
+	dbConnectionsIdle.Set(float64(stats.Idle))
+	dbConnectionsInUse.Set(float64(stats.InUse))
+	dbWaitCount.Set(float64(stats.WaitCount))
 }
 
-func (us *UserService) SearchUsers(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	defer func() {
-		httpDuration.WithLabelValues("/users/search", "GET").Observe(time.Since(start).Seconds())
-	}()
+// collectDBStats refreshes the pool gauges every interval until ctx is done,
+// so they stay current even when nothing is polling /health.
+func collectDBStats(ctx context.Context, interval time.Duration, stats func() sql.DBStats) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	searchTerm := r.URL.Query().Get("q")
-	if searchTerm == "" {
-		httpRequests.WithLabelValues("/users/search", "GET", "400").Inc()
-		http.Error(w, "Search query required", http.StatusBadRequest)
-		return
+	updateDBMetrics(stats())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			updateDBMetrics(stats())
+		}
 	}
+}
 
-	searchTerm = strings.ToLower(searchTerm)
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migration is one embedded schema change. Files are named NNNN_name.sql
+// and applied in version order, each in its own transaction together with
+// its schema_migrations row. A file starting with "-- optional" may fail
+// (a missing extension, duplicates blocking a unique index) without
+// stopping startup; it is retried on the next start. Add new files rather
+// than editing applied ones.
+type migration struct {
+	version  int
+	name     string
+	sql      string
+	optional bool
+}
 
-	query := fmt.Sprintf(`
-		SELECT id, username, email, bio, created 
-		FROM users 
-		WHERE LOWER(username) LIKE '%%%s%%' 
-		   OR LOWER(email) LIKE '%%%s%%' 
-		   OR LOWER(bio) LIKE '%%%s%%'`,
-		searchTerm, searchTerm, searchTerm)
+var migrations = mustLoadMigrations()
 
-	rows, err := us.db.Query(query)
+// mustLoadMigrations parses the embedded files. They are part of the
+// binary, so a malformed name is a build mistake and panics.
+func mustLoadMigrations() []migration {
+	entries, err := migrationFiles.ReadDir("migrations")
 	if err != nil {
-		httpRequests.WithLabelValues("/users/search", "GET", "500").Inc()
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
+		panic(err)
 	}
-	defer rows.Close()
 
-	var users []User
-	for rows.Next() {
-		var user User
-		var created time.Time
-		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Bio, &created)
+	var loaded []migration
+	for _, entry := range entries {
+		prefix, name, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || (len(loaded) > 0 && version <= loaded[len(loaded)-1].version) {
+			panic("migrations must be named NNNN_name.sql with increasing versions: " + entry.Name())
+		}
+		body, err := migrationFiles.ReadFile("migrations/" + entry.Name())
 		if err != nil {
-			continue
+			panic(err)
 		}
-		user.Created = created.Format(time.RFC3339)
+		loaded = append(loaded, migration{
+			version:  version,
+			name:     name,
+			sql:      string(body),
+			optional: strings.HasPrefix(string(body), "-- optional"),
+		})
+	}
+	return loaded
+}
 
-		processedUser := us.processUserData(&user)
-		users = append(users, *processedUser)
+// migrationLockKey is the advisory lock held while migrating, so instances
+// starting together apply each migration once.
+const migrationLockKey = 4_202_611
+
+// runMigrations applies every migration not yet recorded in
+// schema_migrations. Re-running it is a no-op, and the SQL files use IF
+// NOT EXISTS so databases created before the runner existed migrate
+// cleanly too.
+func runMigrations(ctx context.Context, db *sql.DB, idType string) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
 	}
+	defer conn.Close()
 
-	for _, user := range users {
-		if strings.Contains(strings.ToLower(user.Bio), searchTerm) {
-			break
-		}
+	// Waiting for another instance's migrations and building indexes on a
+	// large table can both outlast STATEMENT_TIMEOUT. The connection's own
+	// timeout is restored before it goes back to the pool.
+	if _, err := conn.ExecContext(ctx, "SET statement_timeout = 0"); err != nil {
+		return err
 	}
+	defer conn.ExecContext(context.Background(), "RESET statement_timeout")
 
-	httpRequests.WithLabelValues("/users/search", "GET", "200").Inc()
-	us.respondWithJSON(w, http.StatusOK, users)
-}
+	_, err = conn.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`)
+	if err != nil {
+		return err
+	}
 
-func (us *UserService) validateUser(user *User) bool {
-	if !usernameRegex.MatchString(user.Username) {
-		return false
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return err
 	}
-	if !emailRegex.MatchString(user.Email) {
-		return false
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockKey)
+
+	// Read under the lock, another instance may have just migrated
+	applied := make(map[int]bool)
+	rows, err := conn.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return err
 	}
-	if len(user.Bio) > 1000 {
-		return false
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[version] = true
 	}
-
-	if strings.Contains(user.Bio, "spam") {
-		return false
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
-	return true
-}
-
-func (us *UserService) processUserData(user *User) *User {
-	if strings.Contains(user.Bio, "  ") {
-		user.Bio = strings.ReplaceAll(user.Bio, "  ", " ")
+	idColumn := "id SERIAL PRIMARY KEY"
+	if idType == idTypeUUID {
+		idColumn = "id UUID PRIMARY KEY DEFAULT gen_random_uuid()"
 	}
-	return user
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		statements := strings.ReplaceAll(m.sql, "{{id_column}}", idColumn)
+		if err := applyMigration(ctx, conn, m, statements); err != nil {
+			if m.optional {
+				slog.Warn("Optional migration failed, retrying on next start", "version", m.version, "name", m.name, "error", err)
+				continue
+			}
+			return fmt.Errorf("migration %04d_%s: %w", m.version, m.name, err)
+		}
+		slog.Info("Applied migration", "version", m.version, "name", m.name)
+	}
+	return nil
 }
 
-func (us *UserService) respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
+// applyMigration runs one migration and records it in a single transaction.
+func applyMigration(ctx context.Context, conn *sql.Conn, m migration, statements string) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	// Stream directly to response instead of marshaling to memory first
-	encoder := json.NewEncoder(w)
-	encoder.SetEscapeHTML(false)
-	if err := encoder.Encode(payload); err != nil {
-		http.Error(w, "JSON encoding error", http.StatusInternalServerError)
-		return
+	if _, err := tx.ExecContext(ctx, statements); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.version, m.name); err != nil {
+		return err
 	}
+	return tx.Commit()
 }
 
-func (us *UserService) middlewareLogging(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		next.ServeHTTP(w, r)
-		log.Printf("%s %s %v", r.Method, r.URL.Path, time.Since(start))
-	})
+// statementTimeoutOption is the connection string option for
+// STATEMENT_TIMEOUT. Sent as a startup parameter, Postgres kills runaway
+// queries on every pooled connection even when no context cancels them.
+func statementTimeoutOption(timeout time.Duration) string {
+	if timeout <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" statement_timeout=%d", timeout.Milliseconds())
 }
 
-func initDB() *sql.DB {
+func initDB(config *Config) *sql.DB {
 	dbHost := os.Getenv("DB_HOST")
 	if dbHost == "" {
 		dbHost = "localhost"
@@ -415,8 +5007,7 @@ func initDB() *sql.DB {
 
 	connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
 		dbHost, dbUser, dbPassword, dbName)
-
-	db, err := sql.Open("postgres", connStr)
+	db, err := sql.Open("postgres", connStr+statementTimeoutOption(config.StatementTimeout))
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
@@ -425,57 +5016,325 @@ func initDB() *sql.DB {
 	db.SetMaxIdleConns(25) // Increase from 5
 	db.SetConnMaxLifetime(30 * time.Minute)
 
-	// Create table
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS users (
-		id SERIAL PRIMARY KEY,
-		username VARCHAR(50) UNIQUE NOT NULL,
-		email VARCHAR(100) UNIQUE NOT NULL,
-		bio TEXT,
-		created TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);`
+	if err := runMigrations(context.Background(), db, config.IDType); err != nil {
+		log.Fatal("Failed to migrate database:", err)
+	}
+
+	var idDataType string
+	err = db.QueryRow(`SELECT data_type FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'users' AND column_name = 'id'`).Scan(&idDataType)
+	if err != nil {
+		log.Fatal("Failed to read users.id type:", err)
+	}
+	if (idDataType == "uuid") != (config.IDType == idTypeUUID) {
+		log.Fatalf("users.id is %s but ID_TYPE is %s", idDataType, config.IDType)
+	}
 
-	_, err = db.Exec(createTableSQL)
+	// The pg_trgm migration is optional, fuzzy search needs it
+	err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_trgm')`).Scan(&trigramAvailable)
 	if err != nil {
-		log.Fatal("Failed to create table:", err)
+		log.Fatal("Failed to check for pg_trgm:", err)
+	}
+	if !trigramAvailable {
+		slog.Warn("pg_trgm extension unavailable, fuzzy search disabled")
 	}
 
 	return db
 }
 
-func main() {
-	db := initDB()
-	defer db.Close()
-
-	userService := NewUserService(db)
-
+// routes registers every endpoint and its middleware, returning the
+// handler the server runs.
+func (us *UserService) routes() http.Handler {
 	r := mux.NewRouter()
-	r.Use(userService.middlewareLogging)
+	r.Use(us.middlewareRequestID)
+	r.Use(us.middlewareLogging)
+	r.Use(us.middlewareMetrics)
+	r.Use(us.middlewareServerTiming)
+	r.Use(us.middlewarePrettyJSON)
+	r.Use(us.middlewarePerIPConcurrency)
+	r.Use(us.middlewareAuth)
+	r.Use(us.middlewareFeatureFlags)
+	r.Use(us.middlewareRequestBody)
+	r.Use(us.middlewareTimeout)
+	// mux skips r.Use middleware when no route matches, so these get a
+	// request ID, a log line and metrics (under unmatchedRouteLabel) here
+	unmatched := func(h http.Handler) http.Handler {
+		return us.middlewareRequestID(us.middlewareLogging(us.middlewareMetrics(h)))
+	}
+	r.MethodNotAllowedHandler = unmatched(us.methodNotAllowedHandler(r))
+	r.NotFoundHandler = unmatched(us.notFoundHandler())
+
+	// DB-bound user routes share the DB_MAX_CONCURRENCY bulkhead
+	limitDB := us.limitDBConcurrency
+	idPattern := integerIDPattern
+	if us.config.IDType == idTypeUUID {
+		idPattern = uuidIDPattern
+	}
+	userPath := "/users/{id:" + idPattern + "}"
+	r.HandleFunc("/users", limitDB(us.CreateUser)).Methods("POST")
+	r.HandleFunc("/users", us.cacheResponses(limitDB(us.ListUsers))).Methods("GET")
+	r.HandleFunc("/users/validate", us.ValidateUser).Methods("POST")
+	r.HandleFunc("/users/update-batch", us.requireAdmin(limitDB(us.UpdateBatch))).Methods("POST")
+	r.HandleFunc(userPath, limitDB(us.GetUser)).Methods("GET")
+	r.HandleFunc(userPath, limitDB(us.UpdateUser)).Methods("PUT")
+	r.HandleFunc(userPath, limitDB(us.PatchUser)).Methods("PATCH")
+	r.HandleFunc(userPath, limitDB(us.DeleteUser)).Methods("DELETE")
+	r.HandleFunc(userPath+"/exists", limitDB(us.UserExists)).Methods("GET")
+	r.HandleFunc(userPath+"/bio", limitDB(us.UpdateBio)).Methods("PUT")
+	r.HandleFunc(userPath+"/deactivate", limitDB(us.DeactivateUser)).Methods("POST")
+	r.HandleFunc(userPath+"/activate", limitDB(us.ActivateUser)).Methods("POST")
+	r.HandleFunc("/users/signups", limitDB(us.CountSignups)).Methods("GET")
+	// Event streams stay open indefinitely, searches can be broad
+	us.withTimeout(r.HandleFunc("/users/events", us.StreamEvents).Methods("GET"), 0)
+	us.withTimeout(r.HandleFunc("/users/search", us.cacheResponses(limitDB(us.SearchUsers))).Methods("GET"),
+		us.config.SlowRouteTimeout)
 
-	r.HandleFunc("/users", userService.CreateUser).Methods("POST")
-	r.HandleFunc("/users", userService.ListUsers).Methods("GET")
-	r.HandleFunc("/users/{id:[0-9]+}", userService.GetUser).Methods("GET")
-	r.HandleFunc("/users/{id:[0-9]+}", userService.UpdateUser).Methods("PUT")
-	r.HandleFunc("/users/search", userService.SearchUsers).Methods("GET")
+	// Admin endpoints
+	r.HandleFunc("/cache/preload", us.requireAdmin(us.PreloadCache)).Methods("POST")
+	us.withTimeout(r.HandleFunc("/cache/rebuild", us.requireAdmin(us.RebuildCache)).Methods("POST"),
+		us.config.SlowRouteTimeout)
+	r.HandleFunc("/debug/schema", us.requireAdmin(us.DebugSchema)).Methods("GET")
+	r.HandleFunc("/debug/cache/{id:"+idPattern+"}", us.requireAdmin(us.DebugCacheEntry)).Methods("GET")
+	r.HandleFunc("/admin/request-counts", us.requireAdmin(us.RequestCounts)).Methods("GET")
+	r.HandleFunc("/admin/reindex", us.requireAdmin(us.StartReindex)).Methods("POST")
+	r.HandleFunc("/selftest", us.requireAdmin(us.SelfTest)).Methods("GET")
+	us.withTimeout(r.HandleFunc("/admin/purge-deleted", us.requireAdmin(us.PurgeDeleted)).Methods("POST"),
+		us.config.SlowRouteTimeout)
+	r.HandleFunc("/admin/reindex", us.requireAdmin(us.ReindexStatus)).Methods("GET")
+	r.HandleFunc("/webhooks/deliveries", us.requireAdmin(us.ListWebhookDeliveries)).Methods("GET")
 
 	// Metrics endpoint
 	r.Handle("/metrics", promhttp.Handler())
 
+	r.HandleFunc("/metrics-lite", us.MetricsLite).Methods("GET")
+
+	// Readiness: the DB and the cache backend must both be reachable
+	r.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if us.shuttingDown.Load() {
+			respondUnavailable(w, retryAfterUnavailable, codeShuttingDown, "Shutting down")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		if err := us.db.PingContext(ctx); err != nil {
+			respondUnavailable(w, retryAfterUnavailable, codeDatabaseUnavailable, "Database unavailable")
+			return
+		}
+		if err := us.cache.Ping(ctx); err != nil {
+			respondUnavailable(w, retryAfterUnavailable, codeCacheUnavailable, "Cache unavailable")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	}).Methods("GET")
+
 	// Health check
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		dbConnections.Set(float64(db.Stats().OpenConnections))
+		updateDBMetrics(us.db.Stats())
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
 
+	// Build info
+	r.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		us.respondWithJSON(w, http.StatusOK, map[string]string{
+			"version":    version,
+			"git_commit": gitCommit,
+			"build_time": buildTime,
+		})
+	}).Methods("GET")
+
 	// pprof endpoints
-	r.PathPrefix("/debug/pprof/").Handler(http.DefaultServeMux)
+	// CPU profiles and traces run for as long as ?seconds= asks
+	us.withTimeout(r.PathPrefix("/debug/pprof/").Handler(http.DefaultServeMux), 0)
+
+	return us.middlewareCORS(us.middlewareMethodOverride(r))
+}
+
+func main() {
+	config := loadConfig()
+	slog.SetDefault(newLogger(config, os.Stderr))
+
+	db := initDB(config)
+	userService := NewUserService(db, config)
+
+	logStartup(config)
+
+	listener, err := net.Listen("tcp", ":"+config.Port)
+	if err != nil {
+		log.Fatal("Failed to listen:", err)
+	}
+	server := userService.newServer(userService.routes())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	userService.startBackground(ctx)
+	if err := userService.run(ctx, server, listener); err != nil {
+		log.Fatal("Server failed:", err)
+	}
+}
+
+// logStartup records the build and the effective configuration, so a log
+// alone shows what was running and how it was set up.
+func logStartup(config *Config) {
+	slog.Info("Server starting",
+		"version", version,
+		"git_commit", gitCommit,
+		"build_time", buildTime,
+		"go_version", runtime.Version(),
+		"port", config.Port,
+		"fuzzy_threshold", config.FuzzyThreshold,
+		"fuzzy_search", trigramAvailable,
+		"read_timeout", config.ReadTimeout.String(),
+		"write_timeout", config.WriteTimeout.String(),
+		"log_level", config.LogLevel.String(),
+		"db_isolation", config.Isolation.String(),
+	)
+}
+
+// newServer builds the HTTP server for handler. Timeouts bound how long a
+// slow or stalled client can hold a connection.
+func (us *UserService) newServer(handler http.Handler) *http.Server {
+	server := &http.Server{
+		Handler:           handler,
+		ReadTimeout:       us.config.ReadTimeout,
+		ReadHeaderTimeout: us.config.ReadHeaderTimeout,
+		WriteTimeout:      us.config.WriteTimeout,
+		IdleTimeout:       us.config.IdleTimeout,
+	}
+	if us.config.TLSCertFile != "" {
+		server.TLSConfig = &tls.Config{
+			MinVersion:   us.config.TLSMinVersion,
+			CipherSuites: us.config.TLSCipherSuites,
+		}
+	}
+	return server
+}
+
+// startBackground launches the workers that run alongside the server until
+// ctx is done, and registers their shutdown drain steps.
+func (us *UserService) startBackground(ctx context.Context) {
+	go collectDBStats(ctx, dbStatsInterval, us.db.Stats)
+	if us.config.DisabledRoutesFile != "" {
+		go us.reloadOnHangup(ctx)
+	}
+
+	// Ending event streams lets server.Shutdown finish
+	us.OnShutdown(func(context.Context) {
+		us.events.close()
+	})
+
+	if us.config.WebhookURL != "" {
+		workerDone := make(chan struct{})
+		go func() {
+			defer close(workerDone)
+			us.runWebhookWorker(ctx)
+		}()
+		// Give due deliveries a last attempt before exiting, once the worker
+		// has handed back any batch it was part-way through
+		us.OnShutdown(func(shutdownCtx context.Context) {
+			select {
+			case <-workerDone:
+			case <-shutdownCtx.Done():
+				return
+			}
+			if _, err := us.deliverDueWebhooks(shutdownCtx); err != nil {
+				slog.Error("Failed to flush webhooks on shutdown", "error", err)
+			}
+		})
+	}
+
+	// Warm in the background so the server can take traffic immediately
+	if us.config.CacheWarmLimit > 0 {
+		go func() {
+			loaded, err := us.warmCache(ctx, time.After)
+			if err != nil {
+				slog.Warn("Cache warm-up stopped early", "loaded", loaded, "error", err)
+				return
+			}
+			slog.Info("Cache warm-up complete", "loaded", loaded)
+		}()
+	}
+}
+
+// run serves on listener until ctx is cancelled, then shuts down. It
+// returns early only if the server itself fails.
+func (us *UserService) run(ctx context.Context, server *http.Server, listener net.Listener) error {
+	config := us.config
+
+	tlsEnabled := config.TLSCertFile != ""
+	serverErr := make(chan error, 1)
+	go func() {
+		if tlsEnabled {
+			serverErr <- server.ServeTLS(listener, config.TLSCertFile, config.TLSKeyFile)
+			return
+		}
+		serverErr <- server.Serve(listener)
+	}()
+	slog.Info("Server listening", "addr", listener.Addr().String(), "tls", tlsEnabled)
+
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// Fail readiness first and keep serving for SHUTDOWN_READINESS_DELAY, so
+	// load balancers see it and stop routing here before the listener closes
+	us.shuttingDown.Store(true)
+	if config.ShutdownDelay > 0 {
+		slog.Info("Readiness failing, waiting before shutdown", "delay", config.ShutdownDelay.String())
+		time.Sleep(config.ShutdownDelay)
 	}
 
-	log.Printf("Server starting on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	// Shut down in dependency order: stop taking requests and let in-flight
+	// ones finish first, so no handler is left holding a closed cache or DB
+	slog.Info("Server shutting down", "timeout", config.ShutdownTimeout.String())
+	shutdownStep("http", config.ShutdownTimeout, func(ctx context.Context) error {
+		// Drain hooks run alongside so long-lived streams don't hold Shutdown up
+		drained := make(chan struct{})
+		go func() {
+			us.drain(ctx)
+			close(drained)
+		}()
+		err := server.Shutdown(ctx)
+		<-drained
+		return err
+	})
+	shutdownStep("cache", closeTimeout, func(context.Context) error {
+		return us.cache.Close()
+	})
+	shutdownStep("database", closeTimeout, func(context.Context) error {
+		us.listStmt.Close()
+		return us.db.Close()
+	})
+	slog.Info("Server stopped")
+	return nil
+}
+
+// shutdownStep runs one stage of the shutdown sequence, logging its outcome.
+// A step that overruns its timeout is abandoned so the next one can start.
+func shutdownStep(name string, timeout time.Duration, step func(ctx context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- step(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			slog.Error("Shutdown step failed", "step", name, "error", err)
+			return
+		}
+		slog.Info("Shutdown step complete", "step", name, "duration", time.Since(start).String())
+	case <-ctx.Done():
+		slog.Error("Shutdown step timed out", "step", name, "timeout", timeout.String())
+	}
 }
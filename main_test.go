@@ -0,0 +1,6317 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// stubQuery is one statement sent to a stubDB.
+type stubQuery struct {
+	ctx  context.Context
+	sql  string
+	args []driver.Value
+}
+
+// stubResult is what a stubDB answers a statement with: rows for queries,
+// affected for execs, or err. Rows are delayed by rowDelay each, which a
+// cancelled context cuts short.
+type stubResult struct {
+	columns  []string
+	rows     [][]driver.Value
+	affected int64
+	err      error
+	rowDelay time.Duration
+}
+
+// stubDB is a database/sql connector whose statements are answered by
+// handle, so handlers can be tested without Postgres. It records every
+// statement it runs, including BEGIN, COMMIT and ROLLBACK.
+type stubDB struct {
+	handle     func(q stubQuery) stubResult
+	connectErr error
+
+	mutex     sync.Mutex
+	queries   []string
+	txOptions []driver.TxOptions
+}
+
+func (s *stubDB) Connect(context.Context) (driver.Conn, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.connectErr != nil {
+		return nil, s.connectErr
+	}
+	return &stubConn{db: s}, nil
+}
+
+// setDown makes new connections and pings fail with err, or succeed again
+// when err is nil.
+func (s *stubDB) setDown(err error) {
+	s.mutex.Lock()
+	s.connectErr = err
+	s.mutex.Unlock()
+}
+
+func (s *stubDB) Driver() driver.Driver { return stubDriver{} }
+
+// run records and answers one statement.
+func (s *stubDB) run(ctx context.Context, query string, args []driver.Value) stubResult {
+	s.mutex.Lock()
+	s.queries = append(s.queries, query)
+	s.mutex.Unlock()
+	if s.handle == nil {
+		return stubResult{}
+	}
+	return s.handle(stubQuery{ctx: ctx, sql: query, args: args})
+}
+
+// count reports how many recorded statements contain fragment.
+func (s *stubDB) count(fragment string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := 0
+	for _, query := range s.queries {
+		if strings.Contains(query, fragment) {
+			n++
+		}
+	}
+	return n
+}
+
+// reset forgets the statements recorded so far.
+func (s *stubDB) reset() {
+	s.mutex.Lock()
+	s.queries = nil
+	s.mutex.Unlock()
+}
+
+type stubDriver struct{}
+
+func (stubDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("stub driver is only usable through sql.OpenDB")
+}
+
+type stubConn struct {
+	db *stubDB
+}
+
+func (c *stubConn) Prepare(query string) (driver.Stmt, error) {
+	return &stubStmt{conn: c, query: query}, nil
+}
+
+func (c *stubConn) Close() error { return nil }
+
+// Ping fails with connectErr, so a pool can be taken down after startup.
+func (c *stubConn) Ping(context.Context) error {
+	c.db.mutex.Lock()
+	defer c.db.mutex.Unlock()
+	return c.db.connectErr
+}
+
+func (c *stubConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *stubConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.db.mutex.Lock()
+	c.db.txOptions = append(c.db.txOptions, opts)
+	c.db.mutex.Unlock()
+	if result := c.db.run(ctx, "BEGIN", nil); result.err != nil {
+		return nil, result.err
+	}
+	return &stubTx{conn: c}, nil
+}
+
+func (c *stubConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	result := c.db.run(ctx, query, values(args))
+	if result.err != nil {
+		return nil, result.err
+	}
+	return &stubRows{ctx: ctx, result: result}, nil
+}
+
+func (c *stubConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	result := c.db.run(ctx, query, values(args))
+	if result.err != nil {
+		return nil, result.err
+	}
+	return driver.RowsAffected(result.affected), nil
+}
+
+func values(args []driver.NamedValue) []driver.Value {
+	converted := make([]driver.Value, len(args))
+	for i, arg := range args {
+		converted[i] = arg.Value
+	}
+	return converted
+}
+
+type stubStmt struct {
+	conn  *stubConn
+	query string
+}
+
+func (s *stubStmt) Close() error  { return nil }
+func (s *stubStmt) NumInput() int { return -1 }
+
+func (s *stubStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), named(args))
+}
+
+func (s *stubStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), named(args))
+}
+
+func (s *stubStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.conn.ExecContext(ctx, s.query, args)
+}
+
+func (s *stubStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.conn.QueryContext(ctx, s.query, args)
+}
+
+func named(args []driver.Value) []driver.NamedValue {
+	converted := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		converted[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return converted
+}
+
+type stubTx struct {
+	conn *stubConn
+}
+
+func (tx *stubTx) Commit() error {
+	return tx.conn.db.run(context.Background(), "COMMIT", nil).err
+}
+
+func (tx *stubTx) Rollback() error {
+	return tx.conn.db.run(context.Background(), "ROLLBACK", nil).err
+}
+
+type stubRows struct {
+	ctx    context.Context
+	result stubResult
+	next   int
+}
+
+func (r *stubRows) Columns() []string { return r.result.columns }
+func (r *stubRows) Close() error      { return nil }
+
+func (r *stubRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.rows) {
+		return io.EOF
+	}
+	if r.result.rowDelay > 0 {
+		select {
+		case <-time.After(r.result.rowDelay):
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+	}
+	copy(dest, r.result.rows[r.next])
+	r.next++
+	return nil
+}
+
+// testCreated is the created timestamp given to users that don't set one.
+var testCreated = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// userRows answers a userColumns query with users.
+func userRows(users ...User) stubResult {
+	result := stubResult{columns: userFields}
+	for _, user := range users {
+		created := testCreated
+		if user.Created != "" {
+			created, _ = time.Parse(time.RFC3339, user.Created)
+		}
+		updated := created
+		if user.Updated != "" {
+			updated, _ = time.Parse(time.RFC3339, user.Updated)
+		}
+		var id driver.Value = string(user.ID)
+		if n, err := json.Number(user.ID).Int64(); err == nil {
+			id = n
+		}
+		result.rows = append(result.rows, []driver.Value{id, user.Username, user.Email, user.Bio, created, updated, user.Active})
+	}
+	return result
+}
+
+// scalarRow answers a single-column, single-row query.
+func scalarRow(value driver.Value) stubResult {
+	return stubResult{columns: []string{"value"}, rows: [][]driver.Value{{value}}}
+}
+
+// testConfig returns the defaults loadConfig applies to an empty
+// environment.
+func testConfig(t *testing.T) *Config {
+	t.Helper()
+	return loadConfig()
+}
+
+// newTestService builds a UserService over a stubDB answering with handle.
+func newTestService(t *testing.T, config *Config, handle func(q stubQuery) stubResult) (*UserService, *stubDB) {
+	t.Helper()
+	stub := &stubDB{handle: handle}
+	db := sql.OpenDB(stub)
+	t.Cleanup(func() { db.Close() })
+	return NewUserService(db, config), stub
+}
+
+// newRequest builds a request, as JSON when body is set.
+func newRequest(method, target, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	return r
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+// decodeBody decodes a JSON response into v, failing the test if it can't.
+func decodeBody(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+}
+
+// errorCode returns the "code" of a JSON error response.
+func errorCode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Code string `json:"code"`
+	}
+	decodeBody(t, rec, &body)
+	return body.Code
+}
+
+// usernames lists the usernames in a JSON array of users.
+func usernames(t *testing.T, rec *httptest.ResponseRecorder) []string {
+	t.Helper()
+	var users []User
+	decodeBody(t, rec, &users)
+	names := make([]string, len(users))
+	for i, user := range users {
+		names[i] = user.Username
+	}
+	return names
+}
+
+// withTrigram sets trigramAvailable for the duration of a test.
+func withTrigram(t *testing.T, available bool) {
+	t.Helper()
+	previous := trigramAvailable
+	trigramAvailable = available
+	t.Cleanup(func() { trigramAvailable = previous })
+}
+
+func TestSearchUsersFuzzyMatchesMisspelling(t *testing.T) {
+	withTrigram(t, true)
+	config := testConfig(t)
+	us, stub := newTestService(t, config, func(q stubQuery) stubResult {
+		if strings.Contains(q.sql, "similarity(username, $1) >= $2") {
+			if q.args[0] != "alcie" || q.args[1] != config.FuzzyThreshold {
+				t.Errorf("fuzzy args = %v, want term and threshold %v", q.args, config.FuzzyThreshold)
+			}
+			return userRows(User{ID: "1", Username: "alice", Email: "alice@example.com", Active: true})
+		}
+		return stubResult{}
+	})
+
+	rec := serve(http.HandlerFunc(us.SearchUsers), newRequest("GET", "/users/search?q=alcie&fuzzy=true", ""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+	}
+	if got := usernames(t, rec); !slices.Equal(got, []string{"alice"}) {
+		t.Errorf("matches = %v, want [alice]", got)
+	}
+	if stub.count("ORDER BY GREATEST(similarity(") != 1 {
+		t.Errorf("fuzzy search not ordered by similarity: %v", stub.queries)
+	}
+}
+
+func TestSearchUsersFuzzyFallsBackWithoutTrigram(t *testing.T) {
+	withTrigram(t, false)
+	us, stub := newTestService(t, testConfig(t), nil)
+
+	rec := serve(http.HandlerFunc(us.SearchUsers), newRequest("GET", "/users/search?q=alcie&fuzzy=true", ""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+	}
+	if stub.count("similarity(") != 0 || stub.count("LIKE $1") != 1 {
+		t.Errorf("expected a substring search, ran %v", stub.queries)
+	}
+}
+
+// withVars sets the route variables a handler reads with mux.Vars.
+func withVars(r *http.Request, vars map[string]string) *http.Request {
+	return mux.SetURLVars(r, vars)
+}
+
+// alice is the stored user most handler tests start from.
+var alice = User{ID: "1", Username: "alice", Email: "alice@example.com", Bio: "hello", Active: true}
+
+// patchStore answers PatchUser's locking read with stored and its UPDATE
+// with the written columns, reporting the bio it was given.
+func patchStore(stored User, written *[]driver.Value) func(q stubQuery) stubResult {
+	return func(q stubQuery) stubResult {
+		switch {
+		case strings.Contains(q.sql, "FOR UPDATE"):
+			return userRows(stored)
+		case strings.HasPrefix(q.sql, "UPDATE users SET username=$1, email=$2, bio=$3"):
+			*written = q.args
+			updated := stored
+			updated.Username, updated.Email, updated.Bio = q.args[0].(string), q.args[1].(string), q.args[2].(string)
+			return userRows(updated)
+		}
+		return stubResult{}
+	}
+}
+
+func TestPatchUserBioOmittedVersusEmpty(t *testing.T) {
+	tests := []struct {
+		name, body, wantBio string
+	}{
+		{"omitted keeps bio", `{"email":"alice@example.org"}`, "hello"},
+		{"empty clears bio", `{"bio":""}`, ""},
+		{"null keeps bio", `{"bio":null}`, "hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var written []driver.Value
+			us, _ := newTestService(t, testConfig(t), patchStore(alice, &written))
+
+			r := withVars(newRequest("PATCH", "/users/1", tt.body), map[string]string{"id": "1"})
+			rec := serve(http.HandlerFunc(us.PatchUser), r)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+			}
+			if written[2] != tt.wantBio {
+				t.Errorf("bio written = %q, want %q", written[2], tt.wantBio)
+			}
+			var user User
+			decodeBody(t, rec, &user)
+			if user.Bio != tt.wantBio {
+				t.Errorf("bio returned = %q, want %q", user.Bio, tt.wantBio)
+			}
+		})
+	}
+}
+
+func TestPatchUserValidatesClearedField(t *testing.T) {
+	var written []driver.Value
+	us, _ := newTestService(t, testConfig(t), patchStore(alice, &written))
+
+	r := withVars(newRequest("PATCH", "/users/1", `{"username":""}`), map[string]string{"id": "1"})
+	rec := serve(http.HandlerFunc(us.PatchUser), r)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want 422, body %s", rec.Code, rec.Body)
+	}
+	if written != nil {
+		t.Errorf("invalid patch was written: %v", written)
+	}
+}
+
+// logBuffer collects log output written from several goroutines.
+type logBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+// entries decodes the JSON log lines written so far.
+func (b *logBuffer) entries(t *testing.T) []map[string]interface{} {
+	t.Helper()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// messages lists the "msg" of each log entry written so far.
+func (b *logBuffer) messages(t *testing.T) []string {
+	t.Helper()
+	var messages []string
+	for _, entry := range b.entries(t) {
+		messages = append(messages, entry["msg"].(string))
+	}
+	return messages
+}
+
+// captureLogs sends the default logger to a buffer for the rest of a test.
+func captureLogs(t *testing.T, config *Config) *logBuffer {
+	t.Helper()
+	logs := &logBuffer{}
+	previous := slog.Default()
+	slog.SetDefault(newLogger(config, logs))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return logs
+}
+
+func TestLifecycleLogging(t *testing.T) {
+	config := testConfig(t)
+	logs := captureLogs(t, config)
+	us, _ := newTestService(t, config, nil)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := us.newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	logStartup(config)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- us.run(ctx, server, listener) }()
+
+	resp, err := http.Get("http://" + listener.Addr().String())
+	if err != nil {
+		t.Fatalf("server not listening: %v", err)
+	}
+	resp.Body.Close()
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	want := []string{"Server starting", "Server listening", "Server shutting down", "Server stopped"}
+	var lifecycle []string
+	for _, message := range logs.messages(t) {
+		if slices.Contains(want, message) {
+			lifecycle = append(lifecycle, message)
+		}
+	}
+	if !slices.Equal(lifecycle, want) {
+		t.Errorf("lifecycle logs = %v, want %v", lifecycle, want)
+	}
+
+	starting := logs.entries(t)[0]
+	for _, key := range []string{"version", "git_commit", "go_version", "port", "db_isolation"} {
+		if _, ok := starting[key]; !ok {
+			t.Errorf("startup log is missing %q: %v", key, starting)
+		}
+	}
+}
+
+func TestVersionReportsBuildInfo(t *testing.T) {
+	previous := []string{version, gitCommit, buildTime}
+	version, gitCommit, buildTime = "1.4.2", "abc1234", "2024-05-01T10:00:00Z"
+	t.Cleanup(func() { version, gitCommit, buildTime = previous[0], previous[1], previous[2] })
+
+	us, _ := newTestService(t, testConfig(t), nil)
+	rec := serve(us.routes(), newRequest("GET", "/version", ""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+	}
+	var info map[string]string
+	decodeBody(t, rec, &info)
+	want := map[string]string{"version": "1.4.2", "git_commit": "abc1234", "build_time": "2024-05-01T10:00:00Z"}
+	if !maps.Equal(info, want) {
+		t.Errorf("version info = %v, want %v", info, want)
+	}
+}
+
+func TestVersionDefaultsToDev(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), nil)
+	rec := serve(us.routes(), newRequest("GET", "/version", ""))
+	var info map[string]string
+	decodeBody(t, rec, &info)
+	for _, key := range []string{"version", "git_commit", "build_time"} {
+		if info[key] != "dev" {
+			t.Errorf("%s = %q, want dev", key, info[key])
+		}
+	}
+}
+
+func TestSearchUsersRejectsShortTerm(t *testing.T) {
+	us, stub := newTestService(t, testConfig(t), nil)
+
+	rec := serve(http.HandlerFunc(us.SearchUsers), newRequest("GET", "/users/search?q=a", ""))
+	if rec.Code != http.StatusBadRequest || errorCode(t, rec) != codeInvalidSearch {
+		t.Fatalf("status = %d, body %s; want 400 %s", rec.Code, rec.Body, codeInvalidSearch)
+	}
+	if len(stub.queries) != 0 {
+		t.Errorf("short term reached the database: %v", stub.queries)
+	}
+}
+
+func TestSearchUsersBoundsResults(t *testing.T) {
+	config := testConfig(t)
+	var limit driver.Value
+	us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+		if strings.Contains(q.sql, "LIKE $1") {
+			limit = q.args[1]
+			return userRows(alice)
+		}
+		return stubResult{}
+	})
+
+	rec := serve(http.HandlerFunc(us.SearchUsers), newRequest("GET", "/users/search?q=al", ""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+	}
+	if got := usernames(t, rec); !slices.Equal(got, []string{"alice"}) {
+		t.Errorf("matches = %v, want [alice]", got)
+	}
+	if limit != int64(config.SearchPageSize) {
+		t.Errorf("search limit = %v, want %d", limit, config.SearchPageSize)
+	}
+
+	over := fmt.Sprintf("/users/search?q=al&limit=%d", config.SearchMaxResults+1)
+	if rec := serve(http.HandlerFunc(us.SearchUsers), newRequest("GET", over, "")); rec.Code != http.StatusBadRequest {
+		t.Errorf("limit above SEARCH_MAX_RESULTS: status = %d, want 400", rec.Code)
+	}
+}
+
+func TestMethodNotAllowedIsJSON(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), nil)
+
+	rec := serve(us.routes(), newRequest("DELETE", "/users", ""))
+	if rec.Code != http.StatusMethodNotAllowed || errorCode(t, rec) != codeMethodNotAllowed {
+		t.Fatalf("status = %d, body %s; want 405 %s", rec.Code, rec.Body, codeMethodNotAllowed)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Content-Type = %q, want JSON", ct)
+	}
+	allow := strings.Split(rec.Header().Get("Allow"), ", ")
+	for _, method := range []string{"GET", "POST"} {
+		if !slices.Contains(allow, method) {
+			t.Errorf("Allow = %v, missing %s", allow, method)
+		}
+	}
+	if slices.Contains(allow, "DELETE") {
+		t.Errorf("Allow = %v lists the rejected method", allow)
+	}
+}
+
+func TestNotFoundIsJSON(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), nil)
+
+	rec := serve(us.routes(), newRequest("GET", "/no-such-route", ""))
+	if rec.Code != http.StatusNotFound || errorCode(t, rec) != codeNotFound {
+		t.Fatalf("status = %d, body %s; want 404 %s", rec.Code, rec.Body, codeNotFound)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Content-Type = %q, want JSON", ct)
+	}
+}
+
+func TestUserIDOutOfRange(t *testing.T) {
+	us, stub := newTestService(t, testConfig(t), nil)
+	handler := us.routes()
+
+	for _, id := range []string{"123456789012345678901234567890", "3000000000"} {
+		for _, method := range []string{"GET", "PUT", "DELETE"} {
+			rec := serve(handler, newRequest(method, "/users/"+id, `{"username":"alice","email":"alice@example.com"}`))
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), errUserIDOutRange.Error()) {
+				t.Errorf("%s /users/%s: status = %d, body %s; want 400 out of range", method, id, rec.Code, rec.Body)
+			}
+		}
+	}
+	if len(stub.queries) != 0 {
+		t.Errorf("out-of-range IDs reached the database: %v", stub.queries)
+	}
+}
+
+func TestUserIDLargestInRange(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		return userRows(User{ID: "2147483647", Username: "alice", Email: "alice@example.com", Active: true})
+	})
+
+	rec := serve(us.routes(), newRequest("GET", "/users/2147483647", ""))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, body %s; want 200", rec.Code, rec.Body)
+	}
+}
+
+func TestValidUserIDBoundsBodyIDs(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), nil)
+	tests := map[UserID]bool{
+		"1":          true,
+		"2147483647": true,
+		"2147483648": false,
+		"3000000000": false,
+		"01":         false,
+		"abc":        false,
+	}
+	for id, want := range tests {
+		if got := us.validUserID(id); got != want {
+			t.Errorf("validUserID(%s) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+// metricValue reads the current value of a gauge or counter, or the
+// number of observations of a histogram.
+func metricValue(t *testing.T, m prometheus.Metric) float64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := m.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	if metric.Counter != nil {
+		return metric.GetCounter().GetValue()
+	}
+	if metric.Histogram != nil {
+		return float64(metric.GetHistogram().GetSampleCount())
+	}
+	return metric.GetGauge().GetValue()
+}
+
+func TestCollectDBStatsUpdatesGauges(t *testing.T) {
+	var calls atomic.Int64
+	stats := func() sql.DBStats {
+		n := int(calls.Add(1))
+		return sql.DBStats{OpenConnections: 10 * n, Idle: 4 * n, InUse: 6 * n, WaitCount: int64(n)}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		collectDBStats(ctx, time.Millisecond, stats)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for calls.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("ticker never refreshed the stats")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	n := float64(calls.Load())
+	gauges := map[string]prometheus.Gauge{
+		"open": dbConnections, "idle": dbConnectionsIdle, "in_use": dbConnectionsInUse, "wait_count": dbWaitCount,
+	}
+	want := map[string]float64{"open": 10 * n, "idle": 4 * n, "in_use": 6 * n, "wait_count": n}
+	for name, gauge := range gauges {
+		if got := metricValue(t, gauge); got != want[name] {
+			t.Errorf("%s gauge = %v, want %v from the latest stats", name, got, want[name])
+		}
+	}
+}
+
+// webhookReceiver is a webhook endpoint recording the events it is sent.
+type webhookReceiver struct {
+	mutex  sync.Mutex
+	events []string
+	status int
+}
+
+func newWebhookReceiver(t *testing.T, status int) (*webhookReceiver, string) {
+	t.Helper()
+	receiver := &webhookReceiver{status: status}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receiver.mutex.Lock()
+		receiver.events = append(receiver.events, r.Header.Get("X-Webhook-Event"))
+		receiver.mutex.Unlock()
+		w.WriteHeader(receiver.status)
+	}))
+	t.Cleanup(server.Close)
+	return receiver, server.URL
+}
+
+func (wr *webhookReceiver) received() []string {
+	wr.mutex.Lock()
+	defer wr.mutex.Unlock()
+	return slices.Clone(wr.events)
+}
+
+// webhookQueue answers the delivery claim with due, once, and records the
+// status each delivery is then given.
+func webhookQueue(due [][]driver.Value, statuses *sync.Map) func(q stubQuery) stubResult {
+	var claimed atomic.Bool
+	return func(q stubQuery) stubResult {
+		switch {
+		case strings.Contains(q.sql, "payload, attempts") && strings.Contains(q.sql, "webhook_deliveries"):
+			if claimed.Swap(true) {
+				return stubResult{columns: []string{"id", "event", "payload", "attempts"}}
+			}
+			return stubResult{columns: []string{"id", "event", "payload", "attempts"}, rows: due}
+		case strings.HasPrefix(q.sql, "UPDATE webhook_deliveries SET status = $1"):
+			statuses.Store(q.args[len(q.args)-1], q.args[0])
+			return stubResult{affected: 1}
+		}
+		return stubResult{affected: 1}
+	}
+}
+
+func TestShutdownFlushesWebhooksAndClosesStreams(t *testing.T) {
+	receiver, url := newWebhookReceiver(t, http.StatusOK)
+	config := testConfig(t)
+	config.WebhookURL = url
+	config.WebhookInterval = time.Hour
+	config.CacheWarmLimit = 0
+	var statuses sync.Map
+	due := [][]driver.Value{{int64(7), "user.created", []byte(`{"id":1}`), int64(0)}}
+	us, _ := newTestService(t, config, webhookQueue(due, &statuses))
+
+	events, ok := us.events.subscribe()
+	if !ok {
+		t.Fatal("subscribe failed")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	us.startBackground(ctx)
+	done := make(chan error, 1)
+	go func() { done <- us.run(ctx, us.newServer(http.NotFoundHandler()), listener) }()
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	if got := receiver.received(); !slices.Equal(got, []string{"user.created"}) {
+		t.Errorf("webhooks sent during shutdown = %v, want [user.created]", got)
+	}
+	if status, _ := statuses.Load(int64(7)); status != webhookDelivered {
+		t.Errorf("delivery status = %v, want %s", status, webhookDelivered)
+	}
+	if _, open := <-events; open {
+		t.Error("event stream still open after shutdown")
+	}
+}
+
+func TestGetUserBioPlainAndRendered(t *testing.T) {
+	stored := alice
+	stored.Bio = "**Go** dev <script>x</script>"
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		return userRows(stored)
+	})
+	handler := us.routes()
+
+	tests := []struct {
+		name   string
+		target string
+		accept string
+		want   string
+	}{
+		{"plain by default", "/users/1", "", stored.Bio},
+		{"format=html", "/users/1?format=html", "", "<p><strong>Go</strong> dev &lt;script&gt;x&lt;/script&gt;</p>"},
+		{"Accept text/html", "/users/1", "text/html", "<p><strong>Go</strong> dev &lt;script&gt;x&lt;/script&gt;</p>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRequest("GET", tt.target, "")
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			rec := serve(handler, r)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+			}
+			var user User
+			decodeBody(t, rec, &user)
+			if user.Bio != tt.want {
+				t.Errorf("bio = %q, want %q", user.Bio, tt.want)
+			}
+		})
+	}
+}
+
+func TestListUsersNotModified(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		return userRows(alice)
+	})
+	list := http.HandlerFunc(us.ListUsers)
+
+	first := serve(list, newRequest("GET", "/users", ""))
+	lastModified := first.Header().Get("Last-Modified")
+	if first.Code != http.StatusOK || lastModified == "" {
+		t.Fatalf("status = %d, Last-Modified %q", first.Code, lastModified)
+	}
+
+	r := newRequest("GET", "/users", "")
+	r.Header.Set("If-Modified-Since", lastModified)
+	if second := serve(list, r); second.Code != http.StatusNotModified || second.Body.Len() != 0 {
+		t.Errorf("unchanged list: status = %d, body %q; want empty 304", second.Code, second.Body)
+	}
+
+	// A write after the client's copy makes the list modified again
+	us.lastMutation.Store(time.Now().Add(2 * time.Second).UnixNano())
+	r = newRequest("GET", "/users", "")
+	r.Header.Set("If-Modified-Since", lastModified)
+	if third := serve(list, r); third.Code != http.StatusOK {
+		t.Errorf("after a mutation: status = %d, want 200", third.Code)
+	}
+}
+
+func TestListUsersEnvelopeToggle(t *testing.T) {
+	for _, defaultEnvelope := range []bool{false, true} {
+		config := testConfig(t)
+		config.ListEnvelope = defaultEnvelope
+		us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+			return userRows(alice)
+		})
+
+		for _, query := range []string{"", "?envelope=false", "?envelope=true"} {
+			envelope := defaultEnvelope
+			if query != "" {
+				envelope = query == "?envelope=true"
+			}
+			rec := serve(http.HandlerFunc(us.ListUsers), newRequest("GET", "/users"+query, ""))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("/users%s: status = %d, body %s", query, rec.Code, rec.Body)
+			}
+
+			if envelope {
+				var list UserList
+				decodeBody(t, rec, &list)
+				if list.Count != 1 || len(list.Data) != 1 || list.Data[0].Username != "alice" {
+					t.Errorf("default %v, /users%s: envelope = %+v", defaultEnvelope, query, list)
+				}
+				if rec.Header().Get("Deprecation") != "" {
+					t.Errorf("default %v, /users%s: envelope marked deprecated", defaultEnvelope, query)
+				}
+				continue
+			}
+			if got := usernames(t, rec); !slices.Equal(got, []string{"alice"}) {
+				t.Errorf("default %v, /users%s: bare array = %v", defaultEnvelope, query, got)
+			}
+			if rec.Header().Get("Deprecation") != "true" {
+				t.Errorf("default %v, /users%s: bare array not marked deprecated", defaultEnvelope, query)
+			}
+		}
+	}
+}
+
+func TestUserExists(t *testing.T) {
+	us, stub := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		if strings.HasPrefix(q.sql, "SELECT EXISTS") {
+			return scalarRow(q.args[0] == "1")
+		}
+		return stubResult{}
+	})
+	handler := us.routes()
+
+	for id, want := range map[string]bool{"1": true, "2": false} {
+		rec := serve(handler, newRequest("GET", "/users/"+id+"/exists", ""))
+		var body map[string]bool
+		decodeBody(t, rec, &body)
+		if rec.Code != http.StatusOK || body["exists"] != want {
+			t.Errorf("/users/%s/exists: status = %d, body %v; want exists %v", id, rec.Code, body, want)
+		}
+		if _, cached := us.cache.Get(UserID(id)); cached {
+			t.Errorf("/users/%s/exists populated the cache", id)
+		}
+	}
+
+	// A cached user is answered without a query
+	us.cache.Set(&User{ID: "3", Username: "carol"})
+	stub.reset()
+	rec := serve(handler, newRequest("GET", "/users/3/exists", ""))
+	var body map[string]bool
+	decodeBody(t, rec, &body)
+	if !body["exists"] || stub.count("SELECT EXISTS") != 0 {
+		t.Errorf("cached user: body %v, queries %v", body, stub.queries)
+	}
+}
+
+func TestRouteLabelIsTheTemplate(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		return userRows(alice)
+	})
+	handler := us.routes()
+
+	requests := httpRequests.WithLabelValues("/users/{id}", "GET", "200")
+	before := metricValue(t, requests)
+	for _, id := range []string{"1", "2"} {
+		if rec := serve(handler, newRequest("GET", "/users/"+id, "")); rec.Code != http.StatusOK {
+			t.Fatalf("/users/%s: status = %d", id, rec.Code)
+		}
+	}
+	if got := metricValue(t, requests) - before; got != 2 {
+		t.Errorf("/users/{id} requests = %v, want 2", got)
+	}
+	for _, raw := range []string{"/users/1", "/users/2"} {
+		if httpRequests.DeleteLabelValues(raw, "GET", "200") {
+			t.Errorf("a series was labelled with the raw path %s", raw)
+		}
+	}
+}
+
+func TestMetricsMiddlewareRecordsEveryRoute(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		return userRows()
+	})
+	handler := us.routes()
+
+	tests := []struct {
+		target, label, status string
+	}{
+		{"/version", "/version", "200"},
+		{"/users/42", "/users/{id}", "404"},
+	}
+	for _, tt := range tests {
+		requests := httpRequests.WithLabelValues(tt.label, "GET", tt.status)
+		durations := httpDuration.WithLabelValues(tt.label, "GET").(prometheus.Metric)
+		beforeRequests, beforeDurations := metricValue(t, requests), metricValue(t, durations)
+
+		serve(handler, newRequest("GET", tt.target, ""))
+		if got := metricValue(t, requests) - beforeRequests; got != 1 {
+			t.Errorf("%s: %s requests recorded = %v, want 1", tt.target, tt.status, got)
+		}
+		if got := metricValue(t, durations) - beforeDurations; got != 1 {
+			t.Errorf("%s: durations observed = %v, want 1", tt.target, got)
+		}
+	}
+}
+
+func TestClientIPTrustsOnlyConfiguredProxies(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.168.1.1")
+	us, _ := newTestService(t, testConfig(t), nil)
+
+	tests := []struct {
+		name, remote, forwarded, want string
+	}{
+		{"untrusted peer ignores the header", "203.0.113.9:5000", "198.51.100.1", "203.0.113.9"},
+		{"trusted peer is believed", "10.1.2.3:5000", "198.51.100.1", "198.51.100.1"},
+		{"trusted hops are skipped", "10.1.2.3:5000", "198.51.100.1, 192.168.1.1", "198.51.100.1"},
+		{"spoofed leftmost entry is ignored", "10.1.2.3:5000", "6.6.6.6, 198.51.100.1", "198.51.100.1"},
+		{"trusted peer without the header", "10.1.2.3:5000", "", "10.1.2.3"},
+		{"malformed hop stops the walk", "10.1.2.3:5000", "198.51.100.1, junk", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRequest("GET", "/users", "")
+			r.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := us.clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestLogUsesClientIP(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8")
+	config := testConfig(t)
+	logs := captureLogs(t, config)
+	us, _ := newTestService(t, config, nil)
+
+	r := newRequest("GET", "/version", "")
+	r.RemoteAddr = "10.1.2.3:5000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	serve(us.routes(), r)
+
+	for _, entry := range logs.entries(t) {
+		if entry["msg"] == "Request handled" {
+			if entry["client_ip"] != "198.51.100.1" {
+				t.Errorf("logged client_ip = %v, want the forwarded address", entry["client_ip"])
+			}
+			return
+		}
+	}
+	t.Error("request was not logged")
+}
+
+func TestValidateUserDryRun(t *testing.T) {
+	us, stub := newTestService(t, testConfig(t), nil)
+	handler := us.routes()
+
+	rec := serve(handler, newRequest("POST", "/users/validate", `{"username":"alice","email":"alice@example.com","bio":"hi"}`))
+	var valid map[string]interface{}
+	decodeBody(t, rec, &valid)
+	if rec.Code != http.StatusOK || valid["valid"] != true {
+		t.Errorf("valid user: status = %d, body %v", rec.Code, valid)
+	}
+
+	rec = serve(handler, newRequest("POST", "/users/validate", `{"username":"a!","email":"not-an-email"}`))
+	var invalid struct {
+		Valid  bool         `json:"valid"`
+		Errors []FieldError `json:"errors"`
+	}
+	decodeBody(t, rec, &invalid)
+	if rec.Code != http.StatusUnprocessableEntity || invalid.Valid {
+		t.Errorf("invalid user: status = %d, body %s; want 422", rec.Code, rec.Body)
+	}
+	var fields []string
+	for _, err := range invalid.Errors {
+		fields = append(fields, err.Field)
+	}
+	if !slices.Equal(fields, []string{"username", "email"}) {
+		t.Errorf("field errors = %v, want username and email", fields)
+	}
+
+	if len(stub.queries) != 0 {
+		t.Errorf("validation touched the database: %v", stub.queries)
+	}
+}
+
+func TestCreateUserDuplicatePrecheck(t *testing.T) {
+	for field, code := range duplicateCodes {
+		t.Run(field, func(t *testing.T) {
+			us, stub := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+				if strings.Contains(q.sql, "username = $1 OR LOWER(email) = LOWER($2)") {
+					return scalarRow(field)
+				}
+				return stubResult{}
+			})
+
+			rec := serve(http.HandlerFunc(us.CreateUser), newRequest("POST", "/users", `{"username":"alice","email":"alice@example.com"}`))
+			if rec.Code != http.StatusConflict || errorCode(t, rec) != code {
+				t.Errorf("status = %d, body %s; want 409 %s", rec.Code, rec.Body, code)
+			}
+			if stub.count("INSERT INTO users") != 0 {
+				t.Errorf("insert attempted after the pre-check found a duplicate: %v", stub.queries)
+			}
+		})
+	}
+}
+
+func TestCreateUserWithoutPrecheckReliesOnConstraint(t *testing.T) {
+	config := testConfig(t)
+	config.DuplicatePrecheck = false
+	us, stub := newTestService(t, config, func(q stubQuery) stubResult {
+		// ON CONFLICT DO NOTHING returns no row for a duplicate
+		return userRows()
+	})
+
+	rec := serve(http.HandlerFunc(us.CreateUser), newRequest("POST", "/users", `{"username":"alice","email":"alice@example.com"}`))
+	if rec.Code != http.StatusConflict || errorCode(t, rec) != codeDuplicateUser {
+		t.Errorf("status = %d, body %s; want 409 %s", rec.Code, rec.Body, codeDuplicateUser)
+	}
+	if stub.count("LOWER(email) = LOWER($2)") != 0 || stub.count("INSERT INTO users") != 1 {
+		t.Errorf("expected only the insert, ran %v", stub.queries)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	config := testConfig(t)
+	config.NegativeCacheTTL = time.Minute
+	config.DuplicatePrecheck = false
+	us, stub := newTestService(t, config, func(q stubQuery) stubResult {
+		if strings.HasPrefix(strings.TrimSpace(q.sql), "INSERT INTO users") {
+			return userRows(User{ID: "5", Username: "eve", Email: "eve@example.com", Active: true})
+		}
+		return userRows()
+	})
+	handler := us.routes()
+
+	for i := 0; i < 2; i++ {
+		if rec := serve(handler, newRequest("GET", "/users/5", "")); rec.Code != http.StatusNotFound {
+			t.Fatalf("lookup %d: status = %d, want 404", i+1, rec.Code)
+		}
+	}
+	if n := stub.count("FROM users WHERE id = $1"); n != 1 {
+		t.Errorf("repeated 404s ran %d queries, want 1", n)
+	}
+
+	if rec := serve(handler, newRequest("POST", "/users", `{"username":"eve","email":"eve@example.com"}`)); rec.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d, body %s", rec.Code, rec.Body)
+	}
+	us.mutex.RLock()
+	_, tombstoned := us.notFound["5"]
+	us.mutex.RUnlock()
+	if tombstoned {
+		t.Error("create left the tombstone in place")
+	}
+	if rec := serve(handler, newRequest("GET", "/users/5", "")); rec.Code != http.StatusOK {
+		t.Errorf("after create: status = %d, want 200", rec.Code)
+	}
+}
+
+func TestNegativeCacheDisabled(t *testing.T) {
+	config := testConfig(t)
+	config.NegativeCacheTTL = 0
+	us, stub := newTestService(t, config, func(q stubQuery) stubResult {
+		return userRows()
+	})
+	handler := us.routes()
+
+	for i := 0; i < 2; i++ {
+		serve(handler, newRequest("GET", "/users/5", ""))
+	}
+	if n := stub.count("FROM users WHERE id = $1"); n != 2 {
+		t.Errorf("without negative caching, 404s ran %d queries, want 2", n)
+	}
+}
+
+// testAdminToken is the ADMIN_TOKEN adminRequest authenticates with.
+const testAdminToken = "test-admin-token"
+
+// adminRequest builds a request carrying the admin bearer token.
+func adminRequest(method, target, body string) *http.Request {
+	r := newRequest(method, target, body)
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return r
+}
+
+// storedUsers answers ANY($1) lookups with the listed IDs present in store.
+func storedUsers(store map[UserID]User) func(q stubQuery) stubResult {
+	return func(q stubQuery) stubResult {
+		if !strings.Contains(q.sql, "ANY($1)") {
+			return stubResult{}
+		}
+		var found []User
+		for _, id := range strings.Split(strings.Trim(q.args[0].(string), "{}"), ",") {
+			if user, ok := store[UserID(strings.Trim(id, `"`))]; ok {
+				found = append(found, user)
+			}
+		}
+		return userRows(found...)
+	}
+}
+
+func TestPreloadCache(t *testing.T) {
+	config := testConfig(t)
+	config.AdminToken = testAdminToken
+	config.IDChunkSize = 2
+	store := map[UserID]User{
+		"1": {ID: "1", Username: "alice", Email: "alice@example.com", Active: true},
+		"3": {ID: "3", Username: "carol", Email: "carol@example.com", Active: true},
+	}
+	us, stub := newTestService(t, config, storedUsers(store))
+
+	rec := serve(us.routes(), adminRequest("POST", "/cache/preload", `[1, 2, 3, 1]`))
+	var counts map[string]int
+	decodeBody(t, rec, &counts)
+	if rec.Code != http.StatusOK || counts["loaded"] != 2 || counts["not_found"] != 1 {
+		t.Fatalf("status = %d, counts %v; want 2 loaded, 1 not found", rec.Code, counts)
+	}
+	for id, want := range map[UserID]bool{"1": true, "2": false, "3": true} {
+		if _, cached := us.cache.Get(id); cached != want {
+			t.Errorf("user %s cached = %v, want %v", id, cached, want)
+		}
+	}
+	if n := stub.count("ANY($1)"); n != 2 {
+		t.Errorf("3 unique IDs in chunks of 2 ran %d queries, want 2", n)
+	}
+}
+
+func TestIDAsString(t *testing.T) {
+	big := User{ID: "2147483000", Username: "alice", Email: "alice@example.com", Active: true}
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		return userRows(big)
+	})
+	handler := us.routes()
+
+	tests := []struct {
+		target, want string
+	}{
+		{"/users/2147483000", `"id":2147483000`},
+		{"/users/2147483000?id_as_string=true", `"id":"2147483000"`},
+		{"/users/2147483000?id_as_string=true&fields=id,username", `"id":"2147483000"`},
+		{"/users?id_as_string=true", `"id":"2147483000"`},
+		{"/users?id_as_string=true&envelope=true", `"id":"2147483000"`},
+	}
+	for _, tt := range tests {
+		rec := serve(handler, newRequest("GET", tt.target, ""))
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%s: status = %d, body %s; want %s", tt.target, rec.Code, rec.Body, tt.want)
+		}
+	}
+}
+
+func TestServerTimeoutsFromEnv(t *testing.T) {
+	t.Setenv("READ_TIMEOUT", "3s")
+	t.Setenv("READ_HEADER_TIMEOUT", "1s")
+	t.Setenv("WRITE_TIMEOUT", "4s")
+	t.Setenv("IDLE_TIMEOUT", "30s")
+	us, _ := newTestService(t, testConfig(t), nil)
+
+	server := us.newServer(http.NotFoundHandler())
+	got := []time.Duration{server.ReadTimeout, server.ReadHeaderTimeout, server.WriteTimeout, server.IdleTimeout}
+	want := []time.Duration{3 * time.Second, time.Second, 4 * time.Second, 30 * time.Second}
+	if !slices.Equal(got, want) {
+		t.Errorf("server timeouts = %v, want %v", got, want)
+	}
+}
+
+func TestServerCutsOffStalledHeaders(t *testing.T) {
+	config := testConfig(t)
+	config.ReadHeaderTimeout = 100 * time.Millisecond
+	us, _ := newTestService(t, config, nil)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := us.newServer(http.NotFoundHandler())
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Send part of the headers, then stall like a slowloris client
+	if _, err := conn.Write([]byte("GET /users HTTP/1.1\r\nHost: example.com\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(conn)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("server kept the stalled connection open")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("stalled connection closed after %v, want about %v", elapsed, config.ReadHeaderTimeout)
+	}
+}
+
+func TestUpdateBio(t *testing.T) {
+	var written []driver.Value
+	us, stub := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		if strings.HasPrefix(q.sql, "UPDATE users SET bio = $1") {
+			written = q.args
+			updated := alice
+			updated.Bio = q.args[0].(string)
+			return userRows(updated)
+		}
+		return stubResult{}
+	})
+	handler := us.routes()
+	us.cache.Set(&alice)
+
+	rec := serve(handler, newRequest("PUT", "/users/1/bio", `{"bio":"  new bio  "}`))
+	var user User
+	decodeBody(t, rec, &user)
+	if rec.Code != http.StatusOK || user.Bio != "new bio" || written[0] != "new bio" {
+		t.Fatalf("status = %d, body %s, written %v; want the trimmed bio stored", rec.Code, rec.Body, written)
+	}
+	if _, cached := us.cache.Get("1"); cached {
+		t.Error("bio update left the cached user in place")
+	}
+
+	stub.reset()
+	rec = serve(handler, newRequest("PUT", "/users/1/bio", `{"bio":"`+strings.Repeat("x", 1001)+`"}`))
+	if rec.Code != http.StatusUnprocessableEntity || errorCode(t, rec) != codeInvalidUserData {
+		t.Errorf("over-length bio: status = %d, body %s; want 422", rec.Code, rec.Body)
+	}
+	if len(stub.queries) != 0 {
+		t.Errorf("over-length bio reached the database: %v", stub.queries)
+	}
+
+	if rec := serve(handler, newRequest("PUT", "/users/1/bio", `{"username":"bob"}`)); rec.Code != http.StatusBadRequest {
+		t.Errorf("missing bio: status = %d, want 400", rec.Code)
+	}
+}
+
+// emailError returns the validation message for an otherwise valid user
+// with email, or "" if it is accepted.
+func emailError(us *UserService, email string) string {
+	user := User{Username: "alice", Email: email}
+	for _, err := range us.validateUserFields(&user, nil) {
+		if err.Field == "email" {
+			return err.Message
+		}
+	}
+	return ""
+}
+
+func TestAllowedEmailDomains(t *testing.T) {
+	t.Setenv("ALLOWED_EMAIL_DOMAINS", "Example.com, corp.example")
+	us, _ := newTestService(t, testConfig(t), nil)
+
+	for email, want := range map[string]string{
+		"alice@example.com":      "",
+		"alice@EXAMPLE.com":      "",
+		"alice@corp.example":     "",
+		"alice@gmail.com":        "email domain is not allowed",
+		"alice@sub.example.com":  "email domain is not allowed",
+		"alice@example.com.evil": "email domain is not allowed",
+	} {
+		if got := emailError(us, email); got != want {
+			t.Errorf("%s: error = %q, want %q", email, got, want)
+		}
+	}
+}
+
+func TestEmptyAllowlistAllowsEveryDomain(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), nil)
+	if got := emailError(us, "alice@anything.example"); got != "" {
+		t.Errorf("error = %q, want none", got)
+	}
+}
+
+func TestDisposableEmailsRejected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disposable.txt")
+	if err := os.WriteFile(path, []byte("# known throwaway providers\nMailinator.com\n\nguerrillamail.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("REJECT_DISPOSABLE_EMAILS", "true")
+	t.Setenv("DISPOSABLE_EMAIL_DOMAINS_FILE", path)
+	us, stub := newTestService(t, testConfig(t), nil)
+
+	rec := serve(http.HandlerFunc(us.CreateUser), newRequest("POST", "/users", `{"username":"alice","email":"alice@mailinator.com"}`))
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "disposable email addresses are not accepted") {
+		t.Errorf("disposable domain: status = %d, body %s; want 422", rec.Code, rec.Body)
+	}
+	if len(stub.queries) != 0 {
+		t.Errorf("rejected signup reached the database: %v", stub.queries)
+	}
+	if got := emailError(us, "alice@example.com"); got != "" {
+		t.Errorf("normal domain: error = %q, want none", got)
+	}
+}
+
+func TestDisposableEmailsAllowedByDefault(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), nil)
+	if got := emailError(us, "alice@mailinator.com"); got != "" {
+		t.Errorf("error = %q, want none with the check disabled", got)
+	}
+}
+
+func TestMetricsLite(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		return userRows(alice)
+	})
+	handler := us.routes()
+
+	summary := func() map[string]float64 {
+		rec := serve(handler, newRequest("GET", "/metrics-lite", ""))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+		}
+		var body map[string]float64
+		decodeBody(t, rec, &body)
+		return body
+	}
+
+	before := summary()
+	// A miss then a hit
+	for i := 0; i < 2; i++ {
+		serve(handler, newRequest("GET", "/users/1", ""))
+	}
+	after := summary()
+
+	for _, key := range []string{"total_requests", "error_rate", "cache_hit_ratio", "active_db_connections"} {
+		if _, ok := after[key]; !ok {
+			t.Errorf("summary is missing %q: %v", key, after)
+		}
+	}
+	// The first summary request is itself counted
+	if got := after["total_requests"] - before["total_requests"]; got != 3 {
+		t.Errorf("total_requests grew by %v, want 3", got)
+	}
+	for _, key := range []string{"error_rate", "cache_hit_ratio"} {
+		if after[key] < 0 || after[key] > 1 {
+			t.Errorf("%s = %v, want a ratio", key, after[key])
+		}
+	}
+	if after["cache_hit_ratio"] == 0 {
+		t.Error("cache_hit_ratio is 0 after a cache hit")
+	}
+	if after["active_db_connections"] < 0 {
+		t.Errorf("active_db_connections = %v", after["active_db_connections"])
+	}
+}
+
+func TestRequestCountsTrackListCalls(t *testing.T) {
+	config := testConfig(t)
+	config.AdminToken = testAdminToken
+	us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+		return userRows(alice)
+	})
+	handler := us.routes()
+
+	counts := func() map[string]int64 {
+		rec := serve(handler, adminRequest("GET", "/admin/request-counts", ""))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+		}
+		var body map[string]int64
+		decodeBody(t, rec, &body)
+		return body
+	}
+
+	before := counts()["/users"]
+	const calls = 20
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(handler, newRequest("GET", "/users", ""))
+		}()
+	}
+	wg.Wait()
+
+	if got := counts()["/users"] - before; got != calls {
+		t.Errorf("/users count grew by %d, want %d", got, calls)
+	}
+}
+
+func TestLogLevelSuppressesDebug(t *testing.T) {
+	config := testConfig(t)
+	if config.LogLevel != slog.LevelInfo || config.LogFormat != "json" {
+		t.Fatalf("defaults = %v/%s, want info/json", config.LogLevel, config.LogFormat)
+	}
+
+	var out bytes.Buffer
+	logger := newLogger(config, &out)
+	logger.Debug("hidden detail")
+	logger.Info("visible event")
+	if strings.Contains(out.String(), "hidden detail") {
+		t.Errorf("debug log written at info level: %s", out.String())
+	}
+	if !strings.Contains(out.String(), `"msg":"visible event"`) {
+		t.Errorf("info log missing or not JSON: %s", out.String())
+	}
+}
+
+func TestLogLevelAndFormatFromEnv(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "debug")
+	t.Setenv("LOG_FORMAT", "text")
+	config := testConfig(t)
+
+	var out bytes.Buffer
+	newLogger(config, &out).Debug("shown detail")
+	if !strings.Contains(out.String(), "level=DEBUG msg=\"shown detail\"") {
+		t.Errorf("expected a text debug line, got %q", out.String())
+	}
+}
+
+// unreachableCache is a Cache whose backend can't be reached.
+type unreachableCache struct {
+	Cache
+}
+
+func (unreachableCache) Ping(context.Context) error {
+	return errors.New("connection refused")
+}
+
+func TestReadiness(t *testing.T) {
+	tests := []struct {
+		name     string
+		dbDown   bool
+		cacheBad bool
+		status   int
+		code     string
+	}{
+		{"healthy", false, false, http.StatusOK, ""},
+		{"cache down", false, true, http.StatusServiceUnavailable, codeCacheUnavailable},
+		{"database down", true, false, http.StatusServiceUnavailable, codeDatabaseUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us, stub := newTestService(t, testConfig(t), nil)
+			if tt.cacheBad {
+				us.cache = unreachableCache{us.cache}
+			}
+			if tt.dbDown {
+				stub.setDown(errors.New("connection refused"))
+			}
+
+			rec := serve(us.routes(), newRequest("GET", "/readyz", ""))
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, body %s; want %d", rec.Code, rec.Body, tt.status)
+			}
+			if tt.code != "" {
+				if code := errorCode(t, rec); code != tt.code {
+					t.Errorf("code = %s, want %s", code, tt.code)
+				}
+				if rec.Header().Get("Retry-After") == "" {
+					t.Error("503 without Retry-After")
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryCachePing(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), nil)
+	if err := us.cache.Ping(context.Background()); err != nil {
+		t.Errorf("memory cache Ping = %v, want nil", err)
+	}
+}
+
+func TestIsolationLevelPassedToTransactions(t *testing.T) {
+	for setting, want := range map[string]sql.IsolationLevel{
+		"read-committed":  sql.LevelReadCommitted,
+		"repeatable-read": sql.LevelRepeatableRead,
+		"serializable":    sql.LevelSerializable,
+	} {
+		t.Run(setting, func(t *testing.T) {
+			t.Setenv("DB_ISOLATION", setting)
+			var written []driver.Value
+			us, stub := newTestService(t, testConfig(t), patchStore(alice, &written))
+
+			r := withVars(newRequest("PATCH", "/users/1", `{"bio":"x"}`), map[string]string{"id": "1"})
+			if rec := serve(http.HandlerFunc(us.PatchUser), r); rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+			}
+			if len(stub.txOptions) != 1 || stub.txOptions[0].Isolation != driver.IsolationLevel(want) {
+				t.Errorf("transactions began with %+v, want isolation %v", stub.txOptions, want)
+			}
+		})
+	}
+}
+
+func TestBioWhitespaceModes(t *testing.T) {
+	bio := "First  paragraph,\tstill   first.\n\nSecond  one\nwith a break."
+	tests := []struct {
+		mode, want string
+	}{
+		{"", "First paragraph,\tstill  first.\n\nSecond one\nwith a break."},
+		{bioWhitespaceCollapse, "First paragraph,\tstill  first.\n\nSecond one\nwith a break."},
+		{bioWhitespacePreserveNewlines, "First paragraph, still first.\n\nSecond one\nwith a break."},
+	}
+	for _, tt := range tests {
+		t.Run("mode "+tt.mode, func(t *testing.T) {
+			t.Setenv("BIO_WHITESPACE", tt.mode)
+			us, _ := newTestService(t, testConfig(t), nil)
+
+			user := User{Bio: bio}
+			if got := us.processUserData(&user, false).Bio; got != tt.want {
+				t.Errorf("bio = %q, want %q", got, tt.want)
+			}
+			if user.Bio != bio {
+				t.Error("processUserData modified its input")
+			}
+		})
+	}
+}
+
+// insertingStore answers CreateUser's insert with the new row, numbering
+// IDs from 1, and finds no duplicates.
+func insertingStore() func(q stubQuery) stubResult {
+	var nextID atomic.Int64
+	return func(q stubQuery) stubResult {
+		if strings.HasPrefix(strings.TrimSpace(q.sql), "INSERT INTO users") {
+			id := strconv.FormatInt(nextID.Add(1), 10)
+			return userRows(User{ID: UserID(id), Username: q.args[0].(string), Email: q.args[1].(string), Bio: q.args[2].(string), Active: true})
+		}
+		return userRows()
+	}
+}
+
+// TestConcurrentCreates is meant for go test -race: concurrent creates
+// share the cache, the tombstone map and the event hub.
+func TestConcurrentCreates(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), insertingStore())
+	handler := us.routes()
+
+	const creates = 50
+	var wg sync.WaitGroup
+	statuses := make([]int, creates)
+	for i := 0; i < creates; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"username":"user%d","email":"user%d@example.com"}`, i, i)
+			statuses[i] = serve(handler, newRequest("POST", "/users", body)).Code
+		}()
+		go func() {
+			defer wg.Done()
+			serve(handler, newRequest("GET", fmt.Sprintf("/users/%d", i+1), ""))
+		}()
+	}
+	wg.Wait()
+
+	for i, status := range statuses {
+		if status != http.StatusCreated {
+			t.Errorf("create %d: status = %d", i, status)
+		}
+	}
+	if n := us.cache.Len(); n != creates {
+		t.Errorf("cache holds %d users, want %d", n, creates)
+	}
+}
+
+func TestSearchCountOnlyMatchesResults(t *testing.T) {
+	matches := []User{alice, {ID: "2", Username: "alina", Email: "alina@example.com", Active: true}}
+	var countWhere, searchWhere string
+	us, stub := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		if rest, ok := strings.CutPrefix(q.sql, "SELECT COUNT(*) FROM (SELECT 1 FROM users "); ok {
+			countWhere, _, _ = strings.Cut(rest, " LIMIT")
+			return scalarRow(int64(len(matches)))
+		}
+		if _, rest, ok := strings.Cut(q.sql, " FROM users "); ok {
+			searchWhere, _, _ = strings.Cut(rest, "  LIMIT")
+			return userRows(matches...)
+		}
+		return stubResult{}
+	})
+
+	rec := serve(http.HandlerFunc(us.SearchUsers), newRequest("GET", "/users/search?q=ali&count_only=true", ""))
+	var count map[string]int
+	decodeBody(t, rec, &count)
+	if len(stub.queries) != stub.count("SELECT COUNT(*)") {
+		t.Errorf("count_only fetched rows: %v", stub.queries)
+	}
+
+	rec = serve(http.HandlerFunc(us.SearchUsers), newRequest("GET", "/users/search?q=ali", ""))
+	if full := usernames(t, rec); count["count"] != len(full) {
+		t.Errorf("count = %d, full search returned %d", count["count"], len(full))
+	}
+	if countWhere == "" || countWhere != searchWhere {
+		t.Errorf("count WHERE %q differs from search WHERE %q", countWhere, searchWhere)
+	}
+}
+
+func TestFieldsProjection(t *testing.T) {
+	us, stub := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		all := userRows(alice)
+		columns, _, _ := strings.Cut(strings.TrimPrefix(q.sql, "SELECT "), " FROM")
+		projected := stubResult{columns: strings.Split(columns, ", ")}
+		for _, row := range all.rows {
+			var values []driver.Value
+			for _, column := range projected.columns {
+				values = append(values, row[slices.Index(userFields, column)])
+			}
+			projected.rows = append(projected.rows, values)
+		}
+		return projected
+	})
+	handler := us.routes()
+
+	rec := serve(handler, newRequest("GET", "/users/1?fields=id,username", ""))
+	var user map[string]interface{}
+	decodeBody(t, rec, &user)
+	if rec.Code != http.StatusOK || !maps.Equal(user, map[string]interface{}{"id": float64(1), "username": "alice"}) {
+		t.Errorf("GetUser projection: status = %d, body %s", rec.Code, rec.Body)
+	}
+	if stub.count("SELECT id, username FROM users WHERE id = $1") != 1 {
+		t.Errorf("GetUser didn't project in SQL: %v", stub.queries)
+	}
+	if _, cached := us.cache.Get("1"); cached {
+		t.Error("a partial row was cached")
+	}
+
+	rec = serve(handler, newRequest("GET", "/users?fields=username", ""))
+	var users []map[string]interface{}
+	decodeBody(t, rec, &users)
+	if rec.Code != http.StatusOK || len(users) != 1 || !maps.Equal(users[0], map[string]interface{}{"username": "alice"}) {
+		t.Errorf("ListUsers projection: status = %d, body %s", rec.Code, rec.Body)
+	}
+
+	for _, target := range []string{"/users/1?fields=id,password", "/users?fields=secret"} {
+		rec := serve(handler, newRequest("GET", target, ""))
+		if rec.Code != http.StatusBadRequest || errorCode(t, rec) != codeInvalidFields {
+			t.Errorf("%s: status = %d, body %s; want 400 %s", target, rec.Code, rec.Body, codeInvalidFields)
+		}
+	}
+}
+
+func TestIdentifierLengthBoundaries(t *testing.T) {
+	us, stub := newTestService(t, testConfig(t), insertingStore())
+	// local@example.com padded to exactly n characters
+	email := func(n int) string {
+		return strings.Repeat("a", n-len("@example.com")) + "@example.com"
+	}
+
+	tests := []struct {
+		name, username, email string
+		status                int
+	}{
+		{"shortest username", "abc", "a@example.com", http.StatusCreated},
+		{"username too short", "ab", "a@example.com", http.StatusUnprocessableEntity},
+		{"longest username", strings.Repeat("u", 20), "a@example.com", http.StatusCreated},
+		{"username too long", strings.Repeat("u", 21), "a@example.com", http.StatusUnprocessableEntity},
+		{"longest email", "alice", email(maxEmailLength), http.StatusCreated},
+		{"email too long", "alice", email(maxEmailLength + 1), http.StatusUnprocessableEntity},
+		{"120 character email", "alice", email(120), http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub.reset()
+			body := fmt.Sprintf(`{"username":%q,"email":%q}`, tt.username, tt.email)
+			rec := serve(http.HandlerFunc(us.CreateUser), newRequest("POST", "/users", body))
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, body %s; want %d", rec.Code, rec.Body, tt.status)
+			}
+			if tt.status == http.StatusUnprocessableEntity && stub.count("INSERT INTO users") != 0 {
+				t.Error("an invalid user reached the insert")
+			}
+		})
+	}
+}
+
+func TestRebuildCacheMatchesDB(t *testing.T) {
+	config := testConfig(t)
+	config.AdminToken = testAdminToken
+	config.CacheRebuildLimit = 2
+	fresh := alice
+	fresh.Bio = "edited directly in the DB"
+	bob := User{ID: "2", Username: "bob", Email: "bob@example.com", Active: true}
+	var limit driver.Value
+	us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+		limit = q.args[0]
+		return userRows(fresh, bob)
+	})
+	us.cache.Set(&alice)
+	us.cache.Set(&User{ID: "9", Username: "gone", Email: "gone@example.com"})
+
+	rec := serve(us.routes(), adminRequest("POST", "/cache/rebuild", ""))
+	var body map[string]int
+	decodeBody(t, rec, &body)
+	if rec.Code != http.StatusOK || body["loaded"] != 2 {
+		t.Fatalf("status = %d, body %s; want 2 loaded", rec.Code, rec.Body)
+	}
+	if limit != int64(2) {
+		t.Errorf("rebuild limit = %v, want CACHE_REBUILD_LIMIT", limit)
+	}
+	if us.cache.Len() != 2 {
+		t.Errorf("cache holds %d users, want the 2 loaded", us.cache.Len())
+	}
+	if _, stale := us.cache.Get("9"); stale {
+		t.Error("a user missing from the DB survived the rebuild")
+	}
+	if cached, _ := us.cache.Get("1"); cached == nil || cached.Bio != fresh.Bio {
+		t.Errorf("cached user 1 = %+v, want the DB row", cached)
+	}
+}
+
+func TestRebuildCacheCancelled(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		result := userRows(alice, alice, alice)
+		result.rowDelay = time.Second
+		return result
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	rec := serve(http.HandlerFunc(us.RebuildCache), newRequest("POST", "/cache/rebuild", "").WithContext(ctx))
+	if rec.Code != http.StatusServiceUnavailable || errorCode(t, rec) != codeRequestCancelled {
+		t.Errorf("status = %d, body %s; want 503 %s", rec.Code, rec.Body, codeRequestCancelled)
+	}
+}
+
+// gzipped compresses body.
+func gzipped(t *testing.T, body []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGzipRequestBody(t *testing.T) {
+	config := testConfig(t)
+	config.MaxBodyBytes = 1024
+	us, _ := newTestService(t, config, insertingStore())
+	handler := us.routes()
+
+	body := gzipped(t, []byte(`{"username":"alice","email":"alice@example.com","bio":"compressed"}`))
+	r := newRequest("POST", "/users", string(body))
+	r.Header.Set("Content-Encoding", "gzip")
+	rec := serve(handler, r)
+	var user User
+	decodeBody(t, rec, &user)
+	if rec.Code != http.StatusCreated || user.Bio != "compressed" {
+		t.Fatalf("gzip create: status = %d, body %s", rec.Code, rec.Body)
+	}
+
+	// Well under the limit compressed, far over it decompressed
+	bomb := gzipped(t, []byte(`{"username":"alice","email":"alice@example.com","bio":"`+strings.Repeat("a", 64*1024)+`"}`))
+	if len(bomb) >= int(config.MaxBodyBytes) {
+		t.Fatalf("compressed bomb is %d bytes, expected it under the limit", len(bomb))
+	}
+	r = newRequest("POST", "/users", string(bomb))
+	r.Header.Set("Content-Encoding", "gzip")
+	rec = serve(handler, r)
+	if rec.Code != http.StatusRequestEntityTooLarge || errorCode(t, rec) != codeBodyTooLarge {
+		t.Errorf("over-limit decompressed body: status = %d, body %s; want 413", rec.Code, rec.Body)
+	}
+
+	r = newRequest("POST", "/users", "not gzip")
+	r.Header.Set("Content-Encoding", "gzip")
+	if rec := serve(handler, r); rec.Code != http.StatusBadRequest {
+		t.Errorf("corrupt gzip: status = %d, want 400", rec.Code)
+	}
+}
+
+// keysetStore answers warmCache's keyset query from users, which are
+// ordered by descending ID.
+func keysetStore(users []User) func(q stubQuery) stubResult {
+	return func(q stubQuery) stubResult {
+		if !strings.Contains(q.sql, "WHERE id < $1 AND deleted_at IS NULL ORDER BY id DESC LIMIT $2") {
+			return stubResult{}
+		}
+		before, _ := strconv.ParseInt(q.args[0].(string), 10, 64)
+		var page []User
+		for _, user := range users {
+			id, _ := strconv.ParseInt(string(user.ID), 10, 64)
+			if id < before && int64(len(page)) < q.args[1].(int64) {
+				page = append(page, user)
+			}
+		}
+		return userRows(page...)
+	}
+}
+
+func TestWarmCacheBatches(t *testing.T) {
+	var users []User
+	for id := 7; id >= 1; id-- {
+		users = append(users, User{ID: UserID(strconv.Itoa(id)), Username: fmt.Sprintf("user%d", id), Email: "u@example.com"})
+	}
+	config := testConfig(t)
+	config.CacheWarmLimit = 6
+	config.CacheWarmBatch = 2
+	config.CacheWarmDelay = 5 * time.Second
+	us, stub := newTestService(t, config, keysetStore(users))
+
+	// The fake clock fires at once, noting how many batches had been
+	// queried at each pause
+	var pauses []int
+	after := func(d time.Duration) <-chan time.Time {
+		if d != config.CacheWarmDelay {
+			t.Errorf("paused for %v, want CACHE_WARM_DELAY", d)
+		}
+		pauses = append(pauses, stub.count("ORDER BY id DESC"))
+		ready := make(chan time.Time, 1)
+		ready <- time.Time{}
+		return ready
+	}
+
+	loaded, err := us.warmCache(context.Background(), after)
+	if err != nil || loaded != 6 {
+		t.Fatalf("warmCache = %d, %v; want 6 loaded", loaded, err)
+	}
+	if !slices.Equal(pauses, []int{1, 2}) {
+		t.Errorf("paused after batches %v, want a pause between each of 3 batches", pauses)
+	}
+	for id := 2; id <= 7; id++ {
+		if _, cached := us.cache.Get(UserID(strconv.Itoa(id))); !cached {
+			t.Errorf("user %d not warmed", id)
+		}
+	}
+	if _, cached := us.cache.Get("1"); cached {
+		t.Error("warmed past CACHE_WARM_LIMIT")
+	}
+}
+
+func TestWarmCacheStopsWhenCancelled(t *testing.T) {
+	config := testConfig(t)
+	config.CacheWarmLimit = 10
+	config.CacheWarmBatch = 1
+	us, stub := newTestService(t, config, keysetStore([]User{{ID: "2"}, {ID: "1"}}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	never := func(time.Duration) <-chan time.Time {
+		cancel()
+		return nil
+	}
+	loaded, err := us.warmCache(ctx, never)
+	if loaded != 1 || !errors.Is(err, context.Canceled) {
+		t.Errorf("warmCache = %d, %v; want 1 loaded then cancelled", loaded, err)
+	}
+	if n := stub.count("ORDER BY id DESC"); n != 1 {
+		t.Errorf("ran %d batches after cancellation, want 1", n)
+	}
+}
+
+// updateStore answers UpdateUser's UPDATE ... RETURNING with stored
+// overwritten by the written columns and a server-set updated time.
+func updateStore(stored User, updated string) func(q stubQuery) stubResult {
+	return func(q stubQuery) stubResult {
+		if !strings.HasPrefix(q.sql, "UPDATE users SET username=$1, email=$2, bio=$3") {
+			return stubResult{}
+		}
+		row := stored
+		row.Username, row.Email, row.Bio = q.args[0].(string), q.args[1].(string), q.args[2].(string)
+		row.Updated = updated
+		return userRows(row)
+	}
+}
+
+func TestUpdateUserKeepsStoredCreated(t *testing.T) {
+	stored := alice
+	stored.Created = "2023-06-01T12:00:00Z"
+	us, _ := newTestService(t, testConfig(t), updateStore(stored, "2024-02-03T04:05:06Z"))
+
+	body := `{"username":"alice2","email":"alice@example.com","created":"1999-01-01T00:00:00Z"}`
+	rec := serve(us.routes(), newRequest("PUT", "/users/1", body))
+	var user User
+	decodeBody(t, rec, &user)
+	if rec.Code != http.StatusOK || user.Created != stored.Created {
+		t.Errorf("status = %d, created %q; want the stored %q", rec.Code, user.Created, stored.Created)
+	}
+}
+
+func TestUpdateUserReturnsServerFields(t *testing.T) {
+	stored := alice
+	stored.Active = false
+	us, stub := newTestService(t, testConfig(t), updateStore(stored, "2024-02-03T04:05:06Z"))
+
+	rec := serve(us.routes(), newRequest("PUT", "/users/1", `{"username":"alice2","email":"alice@example.com","active":true}`))
+	var user User
+	decodeBody(t, rec, &user)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+	}
+	if user.Updated != "2024-02-03T04:05:06Z" || user.Active || user.ID != "1" || user.Username != "alice2" {
+		t.Errorf("response %+v doesn't reflect the returned row", user)
+	}
+	if stub.count("RETURNING "+userColumns) != 1 || stub.count("SELECT ") != 0 {
+		t.Errorf("expected a single UPDATE ... RETURNING, ran %v", stub.queries)
+	}
+}
+
+// webhookRow is one row of a fakeWebhookTable.
+type webhookRow struct {
+	id       int64
+	event    string
+	status   string
+	attempts int64
+	leased   bool
+}
+
+// fakeWebhookTable emulates webhook_deliveries for deliverDueWebhooks:
+// claims return pending rows not already leased, and outcome updates are
+// applied to the row, which clears its lease (every retry is due at once),
+// as does releasing the claim.
+type fakeWebhookTable struct {
+	mutex sync.Mutex
+	rows  []*webhookRow
+}
+
+func (ft *fakeWebhookTable) handle(q stubQuery) stubResult {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	find := func(id driver.Value) *webhookRow {
+		for _, row := range ft.rows {
+			if row.id == id.(int64) {
+				return row
+			}
+		}
+		return nil
+	}
+
+	switch {
+	case strings.Contains(q.sql, "RETURNING id, event, payload, attempts"):
+		result := stubResult{columns: []string{"id", "event", "payload", "attempts"}}
+		for _, row := range ft.rows {
+			if row.status == q.args[0] && !row.leased && int64(len(result.rows)) < q.args[2].(int64) {
+				row.leased = true
+				result.rows = append(result.rows, []driver.Value{row.id, row.event, []byte(`{}`), row.attempts})
+			}
+		}
+		return result
+	case strings.HasPrefix(q.sql, "UPDATE webhook_deliveries SET status = $1, attempts = $2"):
+		row := find(q.args[len(q.args)-1])
+		row.status, row.attempts, row.leased = q.args[0].(string), q.args[1].(int64), false
+	case strings.HasPrefix(q.sql, "UPDATE webhook_deliveries SET attempts = $1"):
+		row := find(q.args[3])
+		row.attempts, row.leased = q.args[0].(int64), false
+	case strings.HasPrefix(q.sql, "UPDATE webhook_deliveries SET next_attempt_at = NOW()"):
+		for _, id := range strings.Split(strings.Trim(q.args[0].(string), "{}"), ",") {
+			n, _ := strconv.ParseInt(id, 10, 64)
+			find(n).leased = false
+		}
+	}
+	return stubResult{affected: 1}
+}
+
+func (ft *fakeWebhookTable) row(id int64) webhookRow {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	for _, row := range ft.rows {
+		if row.id == id {
+			return *row
+		}
+	}
+	return webhookRow{}
+}
+
+func TestWebhookSucceedsAfterRetries(t *testing.T) {
+	var calls atomic.Int64
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer endpoint.Close()
+
+	config := testConfig(t)
+	config.WebhookURL = endpoint.URL
+	config.WebhookAttempts = 5
+	table := &fakeWebhookTable{rows: []*webhookRow{{id: 1, event: "user.created", status: webhookPending}}}
+	us, stub := newTestService(t, config, table.handle)
+
+	for pass := 1; pass <= 3; pass++ {
+		if n, err := us.deliverDueWebhooks(context.Background()); n != 1 || err != nil {
+			t.Fatalf("pass %d: deliverDueWebhooks = %d, %v; want 1 attempted", pass, n, err)
+		}
+	}
+	if row := table.row(1); row.status != webhookDelivered || row.attempts != 3 {
+		t.Errorf("delivery = %+v, want delivered on attempt 3", row)
+	}
+	if n, _ := us.deliverDueWebhooks(context.Background()); n != 0 {
+		t.Errorf("a delivered webhook was attempted again")
+	}
+	if stub.count("BEGIN") != 0 {
+		t.Error("deliveries were sent inside a transaction")
+	}
+}
+
+func TestWebhookDeadLetters(t *testing.T) {
+	receiver, url := newWebhookReceiver(t, http.StatusInternalServerError)
+	config := testConfig(t)
+	config.WebhookURL = url
+	config.WebhookAttempts = 3
+	table := &fakeWebhookTable{rows: []*webhookRow{{id: 1, event: "user.deleted", status: webhookPending}}}
+	us, _ := newTestService(t, config, table.handle)
+
+	for pass := 0; pass < 5; pass++ {
+		if _, err := us.deliverDueWebhooks(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if row := table.row(1); row.status != webhookDead || row.attempts != 3 {
+		t.Errorf("delivery = %+v, want dead after 3 attempts", row)
+	}
+	if n := len(receiver.received()); n != 3 {
+		t.Errorf("endpoint called %d times, want WEBHOOK_ATTEMPTS", n)
+	}
+}
+
+func TestWebhookClaimLeasesTheBatch(t *testing.T) {
+	received := make(chan string, 2)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("X-Webhook-Event")
+	}))
+	defer endpoint.Close()
+
+	config := testConfig(t)
+	config.WebhookURL = endpoint.URL
+	var lease driver.Value
+	us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+		if strings.Contains(q.sql, "RETURNING id, event, payload, attempts") {
+			lease = q.args[1]
+			// Out of order, as RETURNING may be
+			return stubResult{
+				columns: []string{"id", "event", "payload", "attempts"},
+				rows:    [][]driver.Value{{int64(9), "b", []byte(`{}`), int64(0)}, {int64(4), "a", []byte(`{}`), int64(0)}},
+			}
+		}
+		return stubResult{affected: 1}
+	})
+
+	if n, err := us.deliverDueWebhooks(context.Background()); n != 2 || err != nil {
+		t.Fatalf("deliverDueWebhooks = %d, %v", n, err)
+	}
+	if order := []string{<-received, <-received}; !slices.Equal(order, []string{"a", "b"}) {
+		t.Errorf("sent %v, want oldest first", order)
+	}
+	if want := (config.WebhookTimeout * webhookBatchSize).Milliseconds(); lease != want {
+		t.Errorf("lease = %v ms, want %d covering a whole batch", lease, want)
+	}
+}
+
+func TestAuthSkipsExemptPaths(t *testing.T) {
+	config := testConfig(t)
+	config.APIToken = "api-token"
+	us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+		return userRows(alice)
+	})
+	handler := us.routes()
+
+	for _, path := range []string{"/health", "/readyz", "/metrics", "/metrics-lite", "/version"} {
+		if rec := serve(handler, newRequest("GET", path, "")); rec.Code != http.StatusOK {
+			t.Errorf("%s without a token: status = %d, want 200", path, rec.Code)
+		}
+	}
+
+	rec := serve(handler, newRequest("GET", "/users", ""))
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("/users without a token: status = %d, want 401 with a challenge", rec.Code)
+	}
+	r := newRequest("GET", "/users", "")
+	r.Header.Set("Authorization", "Bearer api-token")
+	if rec := serve(handler, r); rec.Code != http.StatusOK {
+		t.Errorf("/users with the token: status = %d, want 200", rec.Code)
+	}
+}
+
+func TestExemptPathPatterns(t *testing.T) {
+	t.Setenv("AUTH_EXEMPT_PATHS", "/health,/debug/*")
+	us, _ := newTestService(t, testConfig(t), nil)
+
+	for path, want := range map[string]bool{
+		"/health":             true,
+		"/health/extra":       false,
+		"/debug":              true,
+		"/debug/pprof/heap":   true,
+		"/debugger":           false,
+		"/version":            false,
+		"/users":              false,
+		"/metrics-lite-other": false,
+	} {
+		if got := us.exemptPath(path); got != want {
+			t.Errorf("exemptPath(%s) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestMethodOverride(t *testing.T) {
+	t.Setenv("METHOD_OVERRIDE", "true")
+	us, stub := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		return stubResult{affected: 1}
+	})
+	handler := us.routes()
+	us.cache.Set(&alice)
+
+	r := newRequest("POST", "/users/1", "")
+	r.Header.Set("X-HTTP-Method-Override", "delete")
+	if rec := serve(handler, r); rec.Code != http.StatusNoContent {
+		t.Fatalf("overridden DELETE: status = %d, body %s", rec.Code, rec.Body)
+	}
+	if _, cached := us.cache.Get("1"); cached {
+		t.Error("the delete handler didn't run")
+	}
+	if len(stub.queries) != 1 {
+		t.Errorf("expected only the delete statement, ran %v", stub.queries)
+	}
+
+	r = newRequest("POST", "/users/1", "")
+	r.Header.Set("X-HTTP-Method-Override", "TRACE")
+	if rec := serve(handler, r); rec.Code != http.StatusBadRequest || errorCode(t, rec) != codeInvalidMethodOverride {
+		t.Errorf("invalid override: status = %d, body %s", rec.Code, rec.Body)
+	}
+
+	// Only POST may be overridden
+	stub.reset()
+	r = newRequest("GET", "/users/1/exists", "")
+	r.Header.Set("X-HTTP-Method-Override", "DELETE")
+	serve(handler, r)
+	if stub.count("EXISTS") != 1 {
+		t.Errorf("overridden GET didn't stay a GET: %v", stub.queries)
+	}
+}
+
+func TestMethodOverrideDisabledByDefault(t *testing.T) {
+	us, stub := newTestService(t, testConfig(t), nil)
+
+	r := newRequest("POST", "/users/1", "")
+	r.Header.Set("X-HTTP-Method-Override", "DELETE")
+	if rec := serve(us.routes(), r); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d, want 405 with overrides off", rec.Code)
+	}
+	if len(stub.queries) != 0 {
+		t.Errorf("ran %v", stub.queries)
+	}
+}
+
+func TestSearchEscapesLikeMetacharacters(t *testing.T) {
+	var patterns []driver.Value
+	us, stub := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		if strings.Contains(q.sql, "LIKE $1") {
+			patterns = append(patterns, q.args[0])
+		}
+		return userRows()
+	})
+
+	for _, term := range []string{"50%_off", "under_score", `back\slash`} {
+		serve(http.HandlerFunc(us.SearchUsers), newRequest("GET", "/users/search?q="+url.QueryEscape(term), ""))
+	}
+	want := []driver.Value{`%50\%\_off%`, `%under\_score%`, `%back\\slash%`}
+	if !slices.Equal(patterns, want) {
+		t.Errorf("LIKE patterns = %q, want %q", patterns, want)
+	}
+	if stub.count(`LIKE $1 ESCAPE '\'`) != len(want) {
+		t.Errorf("searches didn't declare the escape character: %v", stub.queries)
+	}
+}
+
+// orderedStore answers listing queries from users the way Postgres would:
+// sorted by the query's ORDER BY, with rows that tie on every sort key in
+// an arbitrary order that can change between queries.
+func orderedStore(users []User) func(q stubQuery) stubResult {
+	var calls atomic.Int64
+	return func(q stubQuery) stubResult {
+		_, orderBy, ok := strings.Cut(q.sql, "ORDER BY ")
+		if !ok {
+			return stubResult{}
+		}
+		orderBy, _, _ = strings.Cut(orderBy, " LIMIT")
+		keys := strings.Split(orderBy, ", ")
+
+		rows := slices.Clone(users)
+		// A different tie order on each call
+		shift := int(calls.Add(1)) % len(rows)
+		rows = append(rows[shift:], rows[:shift]...)
+		slices.SortStableFunc(rows, func(a, b User) int {
+			for _, key := range keys {
+				column, direction, _ := strings.Cut(key, " ")
+				var c int
+				switch column {
+				case "created":
+					c = strings.Compare(a.Created, b.Created)
+				case "id":
+					x, _ := strconv.Atoi(string(a.ID))
+					y, _ := strconv.Atoi(string(b.ID))
+					c = x - y
+				}
+				if direction == "DESC" {
+					c = -c
+				}
+				if c != 0 {
+					return c
+				}
+			}
+			return 0
+		})
+
+		limit, offset := int(q.args[len(q.args)-2].(int64)), int(q.args[len(q.args)-1].(int64))
+		rows = rows[min(offset, len(rows)):min(offset+limit, len(rows))]
+		return userRows(rows...)
+	}
+}
+
+func TestListUsersPagesStablyOverTiedTimestamps(t *testing.T) {
+	var users []User
+	for id := 1; id <= 7; id++ {
+		users = append(users, User{ID: UserID(strconv.Itoa(id)), Username: fmt.Sprintf("user%d", id), Email: "u@example.com", Active: true, Created: "2024-01-01T00:00:00Z"})
+	}
+
+	for _, sort := range []string{"desc", "asc"} {
+		t.Run(sort, func(t *testing.T) {
+			config := testConfig(t)
+			config.ListSort = sort
+			us, _ := newTestService(t, config, orderedStore(users))
+
+			var seen []string
+			for offset := 0; offset < len(users); offset += 3 {
+				rec := serve(http.HandlerFunc(us.ListUsers), newRequest("GET", fmt.Sprintf("/users?limit=3&offset=%d", offset), ""))
+				seen = append(seen, usernames(t, rec)...)
+			}
+
+			want := []string{"user7", "user6", "user5", "user4", "user3", "user2", "user1"}
+			if sort == "asc" {
+				slices.Reverse(want)
+			}
+			if !slices.Equal(seen, want) {
+				t.Errorf("paged through %v, want each user once in id order %v", seen, want)
+			}
+		})
+	}
+}
+
+func TestDeactivateHidesUserFromDefaultList(t *testing.T) {
+	var mutex sync.Mutex
+	stored := alice
+	users := map[string]*User{"1": &stored, "2": {ID: "2", Username: "bob", Email: "bob@example.com", Active: true}}
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch {
+		case strings.Contains(q.sql, "SET active"):
+			user, ok := users[fmt.Sprint(q.args[1])]
+			if !ok {
+				return stubResult{columns: userFields}
+			}
+			user.Active = q.args[0].(bool)
+			return userRows(*user)
+		case strings.Contains(q.sql, "WHERE id = $1"):
+			if user, ok := users[fmt.Sprint(q.args[0])]; ok {
+				return userRows(*user)
+			}
+			return stubResult{columns: userFields}
+		case strings.Contains(q.sql, "ORDER BY"):
+			var listed []User
+			for _, id := range []string{"2", "1"} {
+				if users[id].Active || !strings.Contains(q.sql, "WHERE active") {
+					listed = append(listed, *users[id])
+				}
+			}
+			return userRows(listed...)
+		}
+		return stubResult{}
+	})
+	handler := us.routes()
+
+	// Cache alice so the toggle has an entry to invalidate
+	serve(handler, newRequest("GET", "/users/1", ""))
+
+	rec := serve(handler, newRequest("POST", "/users/1/deactivate", ""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("deactivate status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+
+	if got := usernames(t, serve(handler, newRequest("GET", "/users", ""))); !slices.Equal(got, []string{"bob"}) {
+		t.Errorf("default list = %v, want only bob", got)
+	}
+	if got := usernames(t, serve(handler, newRequest("GET", "/users?include_inactive=true", ""))); !slices.Equal(got, []string{"bob", "alice"}) {
+		t.Errorf("include_inactive list = %v, want bob and alice", got)
+	}
+
+	var user User
+	decodeBody(t, serve(handler, newRequest("GET", "/users/1", "")), &user)
+	if user.Active {
+		t.Error("lookup by ID still reports alice active, cached entry not invalidated")
+	}
+
+	serve(handler, newRequest("POST", "/users/1/activate", ""))
+	if got := usernames(t, serve(handler, newRequest("GET", "/users", ""))); !slices.Equal(got, []string{"bob", "alice"}) {
+		t.Errorf("list after reactivating = %v, want bob and alice", got)
+	}
+
+	if rec := serve(handler, newRequest("POST", "/users/9/deactivate", "")); rec.Code != http.StatusNotFound {
+		t.Errorf("deactivating a missing user: status = %d, want 404", rec.Code)
+	}
+}
+
+func TestMemoryCacheEvictsLeastRecentlyUsedPastMaxBytes(t *testing.T) {
+	user := func(id string, bio string) *User {
+		return &User{ID: UserID(id), Username: "user" + id, Email: "u" + id + "@example.com", Bio: bio}
+	}
+	size := entrySize(user("1", ""))
+	cache := newMemoryCache(3 * size)
+
+	cache.Set(user("1", ""))
+	cache.Set(user("2", ""))
+	cache.Set(user("3", ""))
+	// Touch 1 so 2 is now the least recently used
+	cache.Get("1")
+	cache.Set(user("4", ""))
+
+	cached := func() []string {
+		var ids []string
+		for _, id := range []UserID{"1", "2", "3", "4", "5"} {
+			if _, ok := cache.Inspect(id); ok {
+				ids = append(ids, string(id))
+			}
+		}
+		return ids
+	}
+	if got := cached(); !slices.Equal(got, []string{"1", "3", "4"}) {
+		t.Errorf("cached after exceeding the limit = %v, want 2 evicted", got)
+	}
+	if cache.bytes != 3*size || metricValue(t, cacheBytes) != float64(3*size) {
+		t.Errorf("bytes = %d, gauge = %v, want %d", cache.bytes, metricValue(t, cacheBytes), 3*size)
+	}
+
+	// A large bio costs several small entries
+	cache.Set(user("5", strings.Repeat("x", int(size))))
+	if got := cached(); !slices.Equal(got, []string{"4", "5"}) {
+		t.Errorf("cached after a large entry = %v, want [4 5]", got)
+	}
+	if cache.bytes > cache.maxBytes {
+		t.Errorf("bytes = %d, over the %d limit", cache.bytes, cache.maxBytes)
+	}
+
+	// Replacing an entry recounts its size rather than adding to it
+	cache.Set(user("4", ""))
+	if cache.bytes != 3*size {
+		t.Errorf("bytes after replacing 4 = %d, want %d", cache.bytes, 3*size)
+	}
+
+	unbounded := newMemoryCache(0)
+	for id := range 100 {
+		unbounded.Set(user(strconv.Itoa(id), strings.Repeat("x", 1000)))
+	}
+	if unbounded.Len() != 100 {
+		t.Errorf("unbounded cache holds %d entries, want 100", unbounded.Len())
+	}
+}
+
+// conflictingStore emulates INSERT ... ON CONFLICT DO NOTHING against the
+// username and case-insensitive email unique indexes. The duplicate
+// pre-check finds nothing, and waits until all racers have run it, so every
+// create gets past it and only the insert can tell them apart.
+func conflictingStore(racers int) func(q stubQuery) stubResult {
+	var mutex sync.Mutex
+	var checked sync.WaitGroup
+	checked.Add(racers)
+	taken := map[string]bool{}
+	var nextID int64
+	return func(q stubQuery) stubResult {
+		switch {
+		case strings.Contains(q.sql, "CASE WHEN username"):
+			checked.Done()
+			checked.Wait()
+			return stubResult{columns: []string{"field"}}
+		case strings.Contains(q.sql, "INSERT INTO users"):
+			mutex.Lock()
+			defer mutex.Unlock()
+			username, email := q.args[0].(string), strings.ToLower(q.args[1].(string))
+			if taken["u:"+username] || taken["e:"+email] {
+				return stubResult{columns: userFields}
+			}
+			taken["u:"+username], taken["e:"+email] = true, true
+			nextID++
+			return userRows(User{ID: UserID(strconv.FormatInt(nextID, 10)), Username: username, Email: q.args[1].(string), Active: true})
+		}
+		return stubResult{}
+	}
+}
+
+func TestRacingCreatesResolveToOneCreated(t *testing.T) {
+	for name, bodies := range map[string][2]string{
+		"identical":  {`{"username":"alice","email":"alice@example.com"}`, `{"username":"alice","email":"alice@example.com"}`},
+		"email case": {`{"username":"alice","email":"alice@example.com"}`, `{"username":"alice2","email":"Alice@Example.COM"}`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config := testConfig(t)
+			config.DuplicatePrecheck = true
+			us, _ := newTestService(t, config, conflictingStore(len(bodies)))
+			handler := us.routes()
+
+			var wg sync.WaitGroup
+			recs := make([]*httptest.ResponseRecorder, len(bodies))
+			for i, body := range bodies {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					recs[i] = serve(handler, newRequest("POST", "/users", body))
+				}()
+			}
+			wg.Wait()
+
+			statuses := []int{recs[0].Code, recs[1].Code}
+			slices.Sort(statuses)
+			if !slices.Equal(statuses, []int{http.StatusCreated, http.StatusConflict}) {
+				t.Fatalf("statuses = %v, want one 201 and one 409", statuses)
+			}
+			for _, rec := range recs {
+				if rec.Code == http.StatusConflict {
+					if code := errorCode(t, rec); code != codeDuplicateUser {
+						t.Errorf("conflict code = %q, want %q", code, codeDuplicateUser)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidUTF8Bodies(t *testing.T) {
+	sequences := map[string]string{
+		"stray continuation": "\x80",
+		"invalid start":      "\xff",
+		"truncated":          "\xe2\x82",
+		"overlong":           "\xc0\xaf",
+		"surrogate":          "\xed\xa0\x80",
+	}
+
+	for name, bad := range sequences {
+		body := `{"username":"alice","email":"alice@example.com","bio":"caf` + bad + `"}`
+
+		t.Run("reject/"+name, func(t *testing.T) {
+			config := testConfig(t)
+			config.InvalidUTF8 = invalidUTF8Reject
+			us, stub := newTestService(t, config, insertingStore())
+			handler := us.routes()
+
+			for _, target := range []string{"/users", "/users/validate"} {
+				rec := serve(handler, newRequest("POST", target, body))
+				if rec.Code != http.StatusUnprocessableEntity || errorCode(t, rec) != codeInvalidUTF8 {
+					t.Errorf("POST %s: status = %d, body %s, want 422 %s", target, rec.Code, rec.Body, codeInvalidUTF8)
+				}
+			}
+			if n := stub.count("INSERT INTO users"); n != 0 {
+				t.Errorf("%d inserts issued for rejected bodies", n)
+			}
+		})
+
+		t.Run("replace/"+name, func(t *testing.T) {
+			us, _ := newTestService(t, testConfig(t), insertingStore())
+			rec := serve(us.routes(), newRequest("POST", "/users", body))
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("status = %d, want 201: %s", rec.Code, rec.Body)
+			}
+			var user User
+			decodeBody(t, rec, &user)
+			if !utf8.ValidString(user.Bio) || !strings.HasPrefix(user.Bio, "caf\uFFFD") {
+				t.Errorf("bio = %q, want invalid bytes replaced with U+FFFD", user.Bio)
+			}
+		})
+	}
+
+	// Valid multi-byte text is untouched in either mode
+	config := testConfig(t)
+	config.InvalidUTF8 = invalidUTF8Reject
+	us, _ := newTestService(t, config, insertingStore())
+	rec := serve(us.routes(), newRequest("POST", "/users", `{"username":"alice","email":"alice@example.com","bio":"café ☕"}`))
+	var user User
+	decodeBody(t, rec, &user)
+	if rec.Code != http.StatusCreated || user.Bio != "café ☕" {
+		t.Errorf("valid UTF-8: status = %d, bio = %q", rec.Code, user.Bio)
+	}
+}
+
+// TestReindexRefreshesSearchResults emulates a trigram index that lags a
+// bulk import: fuzzy searches only see indexed usernames until REINDEX has
+// rebuilt it.
+func TestReindexRefreshesSearchResults(t *testing.T) {
+	withTrigram(t, true)
+	imported := []User{alice, {ID: "2", Username: "bob", Email: "bob@example.com", Active: true}}
+
+	var mutex sync.Mutex
+	indexed := imported[:1]
+	release := make(chan struct{})
+	config := testConfig(t)
+	config.AdminToken = testAdminToken
+	us, stub := newTestService(t, config, func(q stubQuery) stubResult {
+		switch {
+		case strings.HasPrefix(q.sql, "REINDEX"):
+			<-release
+			mutex.Lock()
+			indexed = imported
+			mutex.Unlock()
+		case strings.Contains(q.sql, "pg_stat_progress_create_index"):
+			return stubResult{columns: []string{"phase", "blocks_done", "blocks_total"}, rows: [][]driver.Value{{"building index", int64(3), int64(10)}}}
+		case strings.Contains(q.sql, "similarity("):
+			mutex.Lock()
+			defer mutex.Unlock()
+			var matched []User
+			for _, user := range indexed {
+				if strings.Contains(user.Username, q.args[0].(string)) {
+					matched = append(matched, user)
+				}
+			}
+			return userRows(matched...)
+		}
+		return stubResult{}
+	})
+	handler := us.routes()
+	search := func() []string {
+		t.Helper()
+		rec := serve(handler, newRequest("GET", "/users/search?q=bob&fuzzy=true", ""))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("search status = %d: %s", rec.Code, rec.Body)
+		}
+		return usernames(t, rec)
+	}
+	status := func() map[string]interface{} {
+		t.Helper()
+		var status map[string]interface{}
+		decodeBody(t, serve(handler, adminRequest("GET", "/admin/reindex", "")), &status)
+		return status
+	}
+
+	if got := search(); len(got) != 0 {
+		t.Fatalf("search before reindex = %v, want the stale index to miss bob", got)
+	}
+
+	rec := serve(handler, adminRequest("POST", "/admin/reindex", ""))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("start status = %d, want 202: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(handler, adminRequest("POST", "/admin/reindex", "")); rec.Code != http.StatusConflict || errorCode(t, rec) != codeReindexRunning {
+		t.Errorf("second start: status = %d, body %s, want 409 %s", rec.Code, rec.Body, codeReindexRunning)
+	}
+	if s := status(); s["running"] != true || s["phase"] != "building index" || s["blocks_done"] != 3.0 || s["blocks_total"] != 10.0 {
+		t.Errorf("status while running = %v, want progress", s)
+	}
+	// Searches are still served while the index is rebuilt
+	search()
+
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for status()["running"] == true {
+		if time.Now().After(deadline) {
+			t.Fatal("reindex never finished")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if got := search(); !slices.Equal(got, []string{"bob"}) {
+		t.Errorf("search after reindex = %v, want [bob]", got)
+	}
+	if s := status(); s["finished"] == nil || s["error"] != nil {
+		t.Errorf("status after reindex = %v, want finished without error", s)
+	}
+
+	// The rebuild outlives STATEMENT_TIMEOUT, the pooled connection gets its
+	// timeout back afterwards
+	queries := strings.Join(stub.queries, "\n")
+	unbounded := strings.Index(queries, "SET statement_timeout = 0")
+	reindex := strings.Index(queries, "REINDEX INDEX CONCURRENTLY "+trigramIndex)
+	reset := strings.Index(queries, "RESET statement_timeout")
+	if unbounded < 0 || !(unbounded < reindex && reindex < reset) {
+		t.Errorf("queries = %q, want the reindex run between lifting and restoring statement_timeout", stub.queries)
+	}
+}
+
+func TestShutdownLetsInFlightRequestsUseTheDB(t *testing.T) {
+	config := testConfig(t)
+	logs := captureLogs(t, config)
+	us, _ := newTestService(t, config, func(q stubQuery) stubResult { return scalarRow(int64(1)) })
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	server := us.newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		var n int
+		if err := us.db.QueryRowContext(r.Context(), "SELECT 1").Scan(&n); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- us.run(ctx, server, listener) }()
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			t.Errorf("in-flight request failed: %v", err)
+			close(responses)
+			return
+		}
+		resp.Body.Close()
+		responses <- resp
+	}()
+	<-started
+
+	// Only let the handler reach the DB once shutdown is under way
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for !slices.Contains(logs.messages(t), "Server shutting down") {
+		if time.Now().After(deadline) {
+			t.Fatal("shutdown never started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	if resp := <-responses; resp != nil && resp.StatusCode != http.StatusOK {
+		t.Errorf("in-flight request status = %d, want 200 from a still-open DB", resp.StatusCode)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	var steps []string
+	for _, entry := range logs.entries(t) {
+		if entry["msg"] == "Shutdown step complete" {
+			steps = append(steps, entry["step"].(string))
+		}
+	}
+	if !slices.Equal(steps, []string{"http", "cache", "database"}) {
+		t.Errorf("shutdown steps = %v, want http, cache, database in order", steps)
+	}
+	if err := us.db.Ping(); err == nil {
+		t.Error("DB still open after shutdown")
+	}
+}
+
+func TestPatchUserMergePatch(t *testing.T) {
+	tests := []struct {
+		name, body                       string
+		wantStatus                       int
+		wantUsername, wantEmail, wantBio string
+	}{
+		{"null clears bio", `{"bio":null}`, http.StatusOK, "alice", "alice@example.com", ""},
+		{"absent keys untouched", `{"email":"alice@example.org"}`, http.StatusOK, "alice", "alice@example.org", "hello"},
+		{"empty object changes nothing", `{}`, http.StatusOK, "alice", "alice@example.com", "hello"},
+		{"unknown members ignored", `{"bio":"hi","nickname":"al"}`, http.StatusOK, "alice", "alice@example.com", "hi"},
+		{"null username fails validation", `{"username":null}`, http.StatusUnprocessableEntity, "", "", ""},
+		{"non-object rejected", `["bio"]`, http.StatusBadRequest, "", "", ""},
+		{"non-string member rejected", `{"bio":42}`, http.StatusBadRequest, "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var written []driver.Value
+			us, _ := newTestService(t, testConfig(t), patchStore(alice, &written))
+
+			r := withVars(newRequest("PATCH", "/users/1", tt.body), map[string]string{"id": "1"})
+			r.Header.Set("Content-Type", "application/merge-patch+json; charset=utf-8")
+			rec := serve(http.HandlerFunc(us.PatchUser), r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if written != nil {
+					t.Errorf("wrote %v for a rejected patch", written)
+				}
+				return
+			}
+			want := []driver.Value{tt.wantUsername, tt.wantEmail, tt.wantBio}
+			if !slices.Equal(written[:3], want) {
+				t.Errorf("wrote username, email, bio = %v, want %v", written[:3], want)
+			}
+		})
+	}
+
+	// The same body as plain JSON keeps the pointer semantics, null is a no-op
+	var written []driver.Value
+	us, _ := newTestService(t, testConfig(t), patchStore(alice, &written))
+	serve(http.HandlerFunc(us.PatchUser), withVars(newRequest("PATCH", "/users/1", `{"bio":null}`), map[string]string{"id": "1"}))
+	if written[2] != "hello" {
+		t.Errorf("application/json null bio wrote %q, want it left as hello", written[2])
+	}
+}
+
+func TestUpdateBatchMixedResults(t *testing.T) {
+	bob := User{ID: "2", Username: "bob", Email: "bob@example.com", Active: true}
+	stored := map[string]User{"1": alice, "2": bob}
+	config := testConfig(t)
+	config.AdminToken = testAdminToken
+	us, stub := newTestService(t, config, func(q stubQuery) stubResult {
+		switch {
+		case strings.Contains(q.sql, "FOR UPDATE"):
+			if user, ok := stored[fmt.Sprint(q.args[0])]; ok {
+				return userRows(user)
+			}
+			return stubResult{columns: userFields}
+		case strings.HasPrefix(q.sql, "UPDATE users SET username=$1"):
+			if q.args[0] == "bob" && q.args[3] != "2" {
+				return stubResult{err: &pq.Error{Code: "23505"}}
+			}
+			updated := stored[fmt.Sprint(q.args[3])]
+			updated.Username, updated.Email, updated.Bio = q.args[0].(string), q.args[1].(string), q.args[2].(string)
+			return userRows(updated)
+		}
+		return stubResult{}
+	})
+	us.cache.Set(&User{ID: "1", Username: "stale"})
+	us.cache.Set(&User{ID: "2", Username: "bob"})
+
+	body := `[
+		{"id": "1", "fields": {"bio": "hello, again"}},
+		{"id": "99", "fields": {"bio": "nobody"}},
+		{"id": "2", "fields": {"username": ""}},
+		{"id": "1", "fields": {"username": "bob"}},
+		{"id": "abc", "fields": {"bio": "x"}}
+	]`
+	rec := serve(us.routes(), adminRequest("POST", "/users/update-batch", body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var results []BatchResult
+	decodeBody(t, rec, &results)
+
+	want := []struct {
+		status int
+		code   string
+	}{
+		{http.StatusOK, ""},
+		{http.StatusNotFound, codeUserNotFound},
+		{http.StatusUnprocessableEntity, codeInvalidUserData},
+		{http.StatusConflict, codeDuplicateUser},
+		{http.StatusBadRequest, codeInvalidUserID},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d: %s", len(results), len(want), rec.Body)
+	}
+	for i, w := range want {
+		if results[i].Status != w.status || results[i].Code != w.code {
+			t.Errorf("item %d: status %d code %q, want %d %q", i, results[i].Status, results[i].Code, w.status, w.code)
+		}
+	}
+	if results[0].User == nil || results[0].User.Bio != "hello, again" {
+		t.Errorf("item 0 user = %+v, want the updated bio", results[0].User)
+	}
+
+	// Failures roll back to their own savepoint, the batch still commits once
+	if n := stub.count("ROLLBACK TO SAVEPOINT batch_item"); n != 1 {
+		t.Errorf("%d savepoint rollbacks, want 1 for the conflict", n)
+	}
+	if n := stub.count("COMMIT"); n != 1 {
+		t.Errorf("%d commits, want 1", n)
+	}
+	if _, ok := us.cache.Get("1"); ok {
+		t.Error("updated user 1 still cached")
+	}
+	if _, ok := us.cache.Get("2"); !ok {
+		t.Error("user 2 evicted although its update failed")
+	}
+}
+
+func TestResponseCacheServesUntilAWrite(t *testing.T) {
+	var mutex sync.Mutex
+	users := []User{alice}
+	config := testConfig(t)
+	config.ResponseCacheTTL = time.Minute
+	config.CORSOrigins = []string{"*"}
+	us, stub := newTestService(t, config, func(q stubQuery) stubResult {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch {
+		case strings.Contains(q.sql, "INSERT INTO users"):
+			user := User{ID: "2", Username: q.args[0].(string), Email: q.args[1].(string), Active: true}
+			users = append([]User{user}, users...)
+			return userRows(user)
+		case strings.Contains(q.sql, "ORDER BY"):
+			return userRows(users...)
+		}
+		return stubResult{}
+	})
+	handler := us.routes()
+	list := func(origin, requestID string) *httptest.ResponseRecorder {
+		r := newRequest("GET", "/users", "")
+		r.Header.Set("Origin", origin)
+		r.Header.Set("X-Request-ID", requestID)
+		return serve(handler, r)
+	}
+
+	first := list("https://a.example", "req-1")
+	if first.Header().Get("X-Cache") != "MISS" || !slices.Equal(usernames(t, first), []string{"alice"}) {
+		t.Fatalf("first list: X-Cache %q, body %s", first.Header().Get("X-Cache"), first.Body)
+	}
+
+	second := list("https://b.example", "req-2")
+	if second.Header().Get("X-Cache") != "HIT" || second.Body.String() != first.Body.String() {
+		t.Errorf("second list: X-Cache %q, body %s, want the cached body", second.Header().Get("X-Cache"), second.Body)
+	}
+	if n := stub.count("ORDER BY"); n != 1 {
+		t.Errorf("%d list queries, want 1 with the second served from cache", n)
+	}
+	// Per-request headers come from this request, not the cached one
+	if got := second.Header().Get("X-Request-ID"); got != "req-2" {
+		t.Errorf("cached response X-Request-ID = %q, want req-2", got)
+	}
+	if got := second.Header().Get("Access-Control-Allow-Origin"); got != "https://b.example" {
+		t.Errorf("cached response Access-Control-Allow-Origin = %q, want https://b.example", got)
+	}
+	if got := second.Header().Values("Vary"); len(slices.DeleteFunc(slices.Clone(got), func(v string) bool { return v != "Origin" })) != 1 {
+		t.Errorf("cached response Vary = %v, Origin repeated", got)
+	}
+	if got := second.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("cached response Content-Type = %q, want the handler's application/json", got)
+	}
+
+	// Changing a served response must not reach back into the cache
+	second.Header()["Content-Type"][0] = "text/plain"
+	if got := list("https://a.example", "req-3").Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type after a served copy was modified = %q", got)
+	}
+
+	if rec := serve(handler, newRequest("POST", "/users", `{"username":"bob","email":"bob@example.com"}`)); rec.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", rec.Code, rec.Body)
+	}
+	after := list("https://a.example", "req-4")
+	if after.Header().Get("X-Cache") != "MISS" || !slices.Equal(usernames(t, after), []string{"bob", "alice"}) {
+		t.Errorf("list after create: X-Cache %q, users %v, want a fresh list with bob", after.Header().Get("X-Cache"), usernames(t, after))
+	}
+}
+
+func TestDBBulkhead(t *testing.T) {
+	// saturate fills every slot with a handler blocked until release is called
+	saturate := func(t *testing.T, queueTimeout time.Duration) (http.HandlerFunc, func()) {
+		config := testConfig(t)
+		config.DBMaxConcurrency = 2
+		config.DBQueueTimeout = queueTimeout
+		us, _ := newTestService(t, config, nil)
+
+		// Buffered so requests after the first ones don't block getting in
+		entered, release := make(chan struct{}, 8), make(chan struct{})
+		handler := us.limitDBConcurrency(func(w http.ResponseWriter, r *http.Request) {
+			entered <- struct{}{}
+			<-release
+		})
+		for range config.DBMaxConcurrency {
+			go serve(handler, newRequest("GET", "/users", ""))
+			<-entered
+		}
+		var once sync.Once
+		unblock := func() { once.Do(func() { close(release) }) }
+		t.Cleanup(unblock)
+		return handler, unblock
+	}
+
+	t.Run("rejects after the queue timeout", func(t *testing.T) {
+		handler, _ := saturate(t, 20*time.Millisecond)
+		rec := serve(handler, newRequest("GET", "/users", ""))
+		if rec.Code != http.StatusServiceUnavailable || errorCode(t, rec) != codeServerBusy {
+			t.Errorf("status = %d, body %s, want 503 %s", rec.Code, rec.Body, codeServerBusy)
+		}
+		if rec.Header().Get("Retry-After") == "" {
+			t.Error("503 without Retry-After")
+		}
+		if got := metricValue(t, dbQueued); got != 0 {
+			t.Errorf("db_bulkhead_queued = %v after the request gave up, want 0", got)
+		}
+	})
+
+	t.Run("queued request runs once a slot frees", func(t *testing.T) {
+		handler, release := saturate(t, 5*time.Second)
+		done := make(chan int, 1)
+		go func() { done <- serve(handler, newRequest("GET", "/users", "")).Code }()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for metricValue(t, dbQueued) != 1 {
+			if time.Now().After(deadline) {
+				t.Fatal("request never queued")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		release()
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("queued request status = %d, want 200", code)
+		}
+		if got := metricValue(t, dbQueued); got != 0 {
+			t.Errorf("db_bulkhead_queued = %v after the request ran, want 0", got)
+		}
+	})
+}
+
+func TestErrorCodes(t *testing.T) {
+	dbDown := errors.New("connection reset")
+	config := testConfig(t)
+	config.DuplicatePrecheck = true
+	us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+		id := ""
+		if len(q.args) > 0 {
+			id = fmt.Sprint(q.args[len(q.args)-1])
+		}
+		switch {
+		case strings.Contains(q.sql, "CASE WHEN username"):
+			switch {
+			case q.args[0] == "takenname":
+				return scalarRow("username")
+			case q.args[1] == "taken@example.com":
+				return scalarRow("email")
+			}
+			return stubResult{columns: []string{"field"}}
+		case strings.Contains(q.sql, "INSERT INTO users"):
+			if q.args[0] == "racer" {
+				return stubResult{columns: userFields}
+			}
+			return userRows(User{ID: "5", Username: q.args[0].(string), Email: q.args[1].(string), Active: true})
+		case strings.Contains(q.sql, "FROM users WHERE id = $1"):
+			switch fmt.Sprint(q.args[0]) {
+			case "1", "3":
+				return userRows(alice)
+			case "2":
+				return stubResult{err: dbDown}
+			}
+			return stubResult{columns: userFields}
+		case strings.HasPrefix(q.sql, "UPDATE users SET username=$1"):
+			switch id {
+			case "1":
+				return userRows(alice)
+			case "3":
+				return stubResult{err: &pq.Error{Code: "23505"}}
+			}
+			return stubResult{columns: userFields}
+		}
+		return stubResult{}
+	})
+	handler := us.routes()
+	valid := `{"username":"bob","email":"bob@example.com"}`
+
+	tests := []struct {
+		method, target, body string
+		status               int
+		code                 string
+	}{
+		{"GET", "/users/99999999999", "", http.StatusBadRequest, codeInvalidUserID},
+		{"GET", "/users/404", "", http.StatusNotFound, codeUserNotFound},
+		{"GET", "/users/2", "", http.StatusInternalServerError, codeDatabaseError},
+		{"GET", "/users?fields=password", "", http.StatusBadRequest, codeInvalidFields},
+		{"GET", "/users/search?q=", "", http.StatusBadRequest, codeInvalidSearch},
+		{"POST", "/users", `{"username":`, http.StatusBadRequest, codeInvalidJSON},
+		{"POST", "/users", `{"username":"","email":"bob@example.com"}`, http.StatusUnprocessableEntity, codeInvalidUserData},
+		{"POST", "/users", `{"username":"takenname","email":"bob@example.com"}`, http.StatusConflict, codeDuplicateUsername},
+		{"POST", "/users", `{"username":"bob","email":"taken@example.com"}`, http.StatusConflict, codeDuplicateEmail},
+		{"POST", "/users", `{"username":"racer","email":"racer@example.com"}`, http.StatusConflict, codeDuplicateUser},
+		{"PUT", "/users/99999999999", valid, http.StatusBadRequest, codeInvalidUserID},
+		{"PUT", "/users/404", valid, http.StatusNotFound, codeUserNotFound},
+		{"PUT", "/users/1", `{"username":"bob"}`, http.StatusUnprocessableEntity, codeInvalidUserData},
+		{"PUT", "/users/3", valid, http.StatusConflict, codeDuplicateUser},
+		{"PATCH", "/users/404", `{"bio":"x"}`, http.StatusNotFound, codeUserNotFound},
+		{"PATCH", "/users/2", `{"bio":"x"}`, http.StatusInternalServerError, codeDatabaseError},
+		{"PATCH", "/users/3", `{"username":"bob"}`, http.StatusConflict, codeDuplicateUser},
+		{"DELETE", "/users/99999999999", "", http.StatusBadRequest, codeInvalidUserID},
+		{"POST", "/cache/preload", `{"ids":["1"]}`, http.StatusForbidden, codeAdminDisabled},
+		{"GET", "/no-such-route", "", http.StatusNotFound, codeNotFound},
+		{"DELETE", "/users", "", http.StatusMethodNotAllowed, codeMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			rec := serve(handler, newRequest(tt.method, tt.target, tt.body))
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if code := errorCode(t, rec); code != tt.code {
+				t.Errorf("code = %q, want %q", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestPreferReturnMinimal(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		switch {
+		case strings.Contains(q.sql, "INSERT INTO users"):
+			return userRows(User{ID: "5", Username: q.args[0].(string), Email: q.args[1].(string), Active: true})
+		case strings.HasPrefix(q.sql, "UPDATE users"), strings.Contains(q.sql, "FOR UPDATE"):
+			return userRows(alice)
+		}
+		return stubResult{}
+	})
+	handler := us.routes()
+
+	tests := []struct {
+		method, target, body string
+		full, minimal        int
+		location             string
+	}{
+		{"POST", "/users", `{"username":"bob","email":"bob@example.com"}`, http.StatusCreated, http.StatusCreated, "/users/5"},
+		{"PUT", "/users/1", `{"username":"alice","email":"alice@example.com"}`, http.StatusOK, http.StatusNoContent, "/users/1"},
+		{"PATCH", "/users/1", `{"bio":"hi"}`, http.StatusOK, http.StatusNoContent, "/users/1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+"/minimal", func(t *testing.T) {
+			r := newRequest(tt.method, tt.target, tt.body)
+			r.Header.Set("Prefer", "respond-async, return=minimal")
+			rec := serve(handler, r)
+			if rec.Code != tt.minimal || rec.Body.Len() != 0 {
+				t.Errorf("status = %d, body %q, want %d with no body", rec.Code, rec.Body, tt.minimal)
+			}
+			if got := rec.Header().Get("Location"); got != tt.location {
+				t.Errorf("Location = %q, want %q", got, tt.location)
+			}
+			if got := rec.Header().Get("Preference-Applied"); got != "return=minimal" {
+				t.Errorf("Preference-Applied = %q, want return=minimal", got)
+			}
+		})
+
+		t.Run(tt.method+"/representation", func(t *testing.T) {
+			for _, prefer := range []string{"", "return=representation"} {
+				r := newRequest(tt.method, tt.target, tt.body)
+				if prefer != "" {
+					r.Header.Set("Prefer", prefer)
+				}
+				rec := serve(handler, r)
+				var user User
+				decodeBody(t, rec, &user)
+				if rec.Code != tt.full || userLocation(user.ID) != tt.location {
+					t.Errorf("Prefer %q: status = %d, user %+v, want %d with the full user", prefer, rec.Code, user, tt.full)
+				}
+				if rec.Header().Get("Preference-Applied") != "" {
+					t.Errorf("Prefer %q: Preference-Applied set without return=minimal", prefer)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateUserSetsLocation(t *testing.T) {
+	for _, id := range []string{"42", "0f8fad5b-d9cb-469f-a165-70867728950e"} {
+		t.Run(id, func(t *testing.T) {
+			config := testConfig(t)
+			if !isIntegerID(id) {
+				config.IDType = idTypeUUID
+			}
+			us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+				if strings.Contains(q.sql, "INSERT INTO users") {
+					if q.args[0] == "taken" {
+						return stubResult{columns: userFields}
+					}
+					return userRows(User{ID: UserID(id), Username: q.args[0].(string), Email: q.args[1].(string), Active: true})
+				}
+				return stubResult{columns: userFields}
+			})
+			handler := us.routes()
+
+			rec := serve(handler, newRequest("POST", "/users", `{"username":"bob","email":"bob@example.com"}`))
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			location := rec.Header().Get("Location")
+			if location != "/users/"+id {
+				t.Errorf("Location = %q, want /users/%s", location, id)
+			}
+
+			// The Location resolves to the created user
+			got := serve(handler, newRequest("GET", location, ""))
+			var user User
+			decodeBody(t, got, &user)
+			if got.Code != http.StatusOK || user.Username != "bob" {
+				t.Errorf("GET %s: status %d, user %+v, want bob", location, got.Code, user)
+			}
+
+			if rec := serve(handler, newRequest("POST", "/users", `{"username":"taken","email":"taken@example.com"}`)); rec.Header().Get("Location") != "" {
+				t.Errorf("failed create set Location %q", rec.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestOptionsListsRegisteredMethods(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), nil)
+	handler := us.routes()
+
+	tests := []struct{ target, allow string }{
+		{"/users", "GET, POST"},
+		{"/users/1", "DELETE, GET, PATCH, PUT"},
+		{"/users/1/deactivate", "POST"},
+	}
+	for _, tt := range tests {
+		rec := serve(handler, newRequest("OPTIONS", tt.target, ""))
+		if rec.Code != http.StatusNoContent || rec.Body.Len() != 0 {
+			t.Errorf("OPTIONS %s: status = %d, body %q, want 204 with no body", tt.target, rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get("Allow"); got != tt.allow {
+			t.Errorf("OPTIONS %s: Allow = %q, want %q", tt.target, got, tt.allow)
+		}
+		// 405 responses come from the same route table
+		if got := serve(handler, newRequest("TRACE", tt.target, "")).Header().Get("Allow"); got != tt.allow {
+			t.Errorf("TRACE %s: Allow = %q, want %q", tt.target, got, tt.allow)
+		}
+	}
+
+	if rec := serve(handler, newRequest("OPTIONS", "/no-such-route", "")); rec.Code != http.StatusNotFound {
+		t.Errorf("OPTIONS on an unknown path: status = %d, want 404", rec.Code)
+	}
+}
+
+func TestSSEHubDropsEventsForSlowSubscribers(t *testing.T) {
+	hub := newSSEHub(2, 1)
+	slow, _ := hub.subscribe()
+	fast, _ := hub.subscribe()
+	if _, ok := hub.subscribe(); ok {
+		t.Error("third subscriber accepted past the limit of 2")
+	}
+
+	dropped := metricValue(t, sseDropped)
+	const events = 5
+	for i := range events {
+		published := make(chan struct{})
+		go func() {
+			hub.publish(sseEvent{name: "user.updated", data: []byte(strconv.Itoa(i))})
+			close(published)
+		}()
+		select {
+		case <-published:
+		case <-time.After(5 * time.Second):
+			t.Fatal("publish blocked on the slow subscriber")
+		}
+		if event := <-fast; string(event.data) != strconv.Itoa(i) {
+			t.Errorf("fast subscriber got %q, want event %d", event.data, i)
+		}
+	}
+
+	// The slow subscriber kept what fit in its buffer, the rest were dropped
+	if event := <-slow; string(event.data) != "0" {
+		t.Errorf("slow subscriber's buffered event = %q, want the first", event.data)
+	}
+	if got := metricValue(t, sseDropped) - dropped; got != events-1 {
+		t.Errorf("sse dropped events = %v, want %d", got, events-1)
+	}
+
+	// Leaving frees a slot
+	hub.unsubscribe(slow)
+	if _, ok := hub.subscribe(); !ok {
+		t.Error("subscribe refused after a subscriber left")
+	}
+}
+
+func TestStreamEventsRefusesPastMaxSubscribers(t *testing.T) {
+	config := testConfig(t)
+	config.SSEMaxSubscribers = 1
+	us, _ := newTestService(t, config, nil)
+	server := httptest.NewServer(us.routes())
+	t.Cleanup(server.Close)
+
+	resp, err := http.Get(server.URL + "/users/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("first subscriber: status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	rec := serve(us.routes(), newRequest("GET", "/users/events", ""))
+	if rec.Code != http.StatusServiceUnavailable || errorCode(t, rec) != codeTooManySubscribers {
+		t.Errorf("second subscriber: status = %d, body %s, want 503 %s", rec.Code, rec.Body, codeTooManySubscribers)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("503 without Retry-After")
+	}
+
+	// The first stream still receives events
+	us.events.publish(sseEvent{name: "user.created", data: []byte(`{"id":1}`)})
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "event: user.created\n" {
+		t.Errorf("stream read %q, %v; want the published event", line, err)
+	}
+	us.events.close()
+}
+
+func TestConcurrentIdenticalRequestsAreCoalesced(t *testing.T) {
+	tests := []struct {
+		operation, target, query string
+	}{
+		{"search", "/users/search?q=alice", "LIKE $1"},
+		{"get_user", "/users/1", "WHERE id = $1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.operation, func(t *testing.T) {
+			release := make(chan struct{})
+			us, stub := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+				if strings.Contains(q.sql, tt.query) {
+					<-release
+					return userRows(alice)
+				}
+				return stubResult{}
+			})
+			handler := us.routes()
+			coalesced := metricValue(t, requestsCoalesced.WithLabelValues(tt.operation))
+
+			const requests = 10
+			var started, done sync.WaitGroup
+			started.Add(requests)
+			done.Add(requests)
+			statuses := make([]int, requests)
+			for i := range requests {
+				go func() {
+					defer done.Done()
+					started.Done()
+					statuses[i] = serve(handler, newRequest("GET", tt.target, "")).Code
+				}()
+			}
+			// Give every request time to join the first one's flight
+			started.Wait()
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+			done.Wait()
+
+			for i, status := range statuses {
+				if status != http.StatusOK {
+					t.Errorf("request %d: status = %d, want 200", i, status)
+				}
+			}
+			queries := stub.count(tt.query)
+			shared := metricValue(t, requestsCoalesced.WithLabelValues(tt.operation)) - coalesced
+			if queries >= requests || shared != float64(requests-queries) {
+				t.Errorf("%d queries and %v coalesced for %d requests, want the rest of the requests counted as coalesced", queries, shared, requests)
+			}
+		})
+	}
+}
+
+// softDeleteTable emulates the users table's deleted_at column. Queries
+// only skip deleted rows when they filter on deleted_at IS NULL, so a read
+// or write that forgets the filter sees them.
+type softDeleteTable struct {
+	mutex   sync.Mutex
+	users   []User
+	deleted map[UserID]bool
+}
+
+func (st *softDeleteTable) handle(q stubQuery) stubResult {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	visible := func(user User) bool {
+		return !st.deleted[user.ID] || !strings.Contains(q.sql, "deleted_at IS NULL")
+	}
+	byID := func(id driver.Value) (User, bool) {
+		for _, user := range st.users {
+			if string(user.ID) == fmt.Sprint(id) && visible(user) {
+				return user, true
+			}
+		}
+		return User{}, false
+	}
+
+	switch {
+	case strings.Contains(q.sql, "INSERT INTO users"):
+		user := User{ID: UserID(strconv.Itoa(len(st.users) + 1)), Username: q.args[0].(string), Email: q.args[1].(string), Bio: q.args[2].(string), Active: true}
+		st.users = append(st.users, user)
+		return userRows(user)
+	case strings.Contains(q.sql, "SET deleted_at"):
+		if user, ok := byID(q.args[0]); ok {
+			st.deleted[user.ID] = true
+			return stubResult{affected: 1}
+		}
+		return stubResult{affected: 0}
+	case strings.Contains(q.sql, "SELECT EXISTS"):
+		_, ok := byID(q.args[0])
+		return scalarRow(ok)
+	case strings.Contains(q.sql, "WHERE id = $1"):
+		if user, ok := byID(q.args[0]); ok {
+			return userRows(user)
+		}
+	case strings.HasPrefix(q.sql, "UPDATE users"):
+		if user, ok := byID(q.args[len(q.args)-1]); ok {
+			return userRows(user)
+		}
+	case strings.Contains(q.sql, "SELECT COUNT(*)"), strings.Contains(q.sql, "ORDER BY"), strings.Contains(q.sql, "LIKE $1"):
+		var rows []User
+		for _, user := range st.users {
+			if visible(user) {
+				rows = append(rows, user)
+			}
+		}
+		if strings.Contains(q.sql, "SELECT COUNT(*)") {
+			return scalarRow(int64(len(rows)))
+		}
+		return userRows(rows...)
+	}
+	return stubResult{columns: userFields}
+}
+
+func TestSoftDeletedUsersAreHidden(t *testing.T) {
+	bob := User{ID: "2", Username: "bob", Email: "bob@example.com", Active: true}
+	table := &softDeleteTable{users: []User{alice, bob}, deleted: map[UserID]bool{}}
+	config := testConfig(t)
+	config.AdminToken = testAdminToken
+	us, stub := newTestService(t, config, table.handle)
+	handler := us.routes()
+
+	// Cached before the delete, so the delete has to evict it
+	serve(handler, newRequest("GET", "/users/1", ""))
+
+	if rec := serve(handler, newRequest("DELETE", "/users/1", "")); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d: %s", rec.Code, rec.Body)
+	}
+	if !table.deleted["1"] || len(table.users) != 2 {
+		t.Fatal("delete removed the row instead of setting deleted_at")
+	}
+
+	tests := []struct {
+		method, target, body string
+		status               int
+	}{
+		{"DELETE", "/users/1", "", http.StatusNotFound},
+		{"GET", "/users/1", "", http.StatusNotFound},
+		{"GET", "/users/1?fields=username", "", http.StatusNotFound},
+		{"PUT", "/users/1", `{"username":"alice","email":"alice@example.com"}`, http.StatusNotFound},
+		{"PATCH", "/users/1", `{"bio":"back"}`, http.StatusNotFound},
+		{"PUT", "/users/1/bio", `{"bio":"back"}`, http.StatusNotFound},
+		{"POST", "/users/1/activate", "", http.StatusNotFound},
+		{"GET", "/users/2", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rec := serve(handler, newRequest(tt.method, tt.target, tt.body)); rec.Code != tt.status {
+			t.Errorf("%s %s after delete: status = %d, want %d", tt.method, tt.target, rec.Code, tt.status)
+		}
+	}
+
+	var exists map[string]bool
+	decodeBody(t, serve(handler, newRequest("GET", "/users/1/exists", "")), &exists)
+	if exists["exists"] {
+		t.Error("exists reports a deleted user")
+	}
+	for _, target := range []string{"/users", "/users?include_inactive=true", "/users?verified=false", "/users/search?q=example"} {
+		if got := usernames(t, serve(handler, newRequest("GET", target, ""))); !slices.Equal(got, []string{"bob"}) {
+			t.Errorf("GET %s = %v, want only bob", target, got)
+		}
+	}
+	var count map[string]int
+	decodeBody(t, serve(handler, newRequest("GET", "/users/search?q=example&count_only=true", "")), &count)
+	if count["count"] != 1 {
+		t.Errorf("search count = %v, want 1", count)
+	}
+
+	serve(handler, adminRequest("POST", "/cache/preload", `["1", "2"]`))
+	var rebuilt map[string]int
+	decodeBody(t, serve(handler, adminRequest("POST", "/cache/rebuild", "")), &rebuilt)
+	if rebuilt["loaded"] != 1 {
+		t.Errorf("cache rebuild loaded %v, want only bob", rebuilt)
+	}
+
+	// Every users query filters deleted rows, except the duplicate
+	// pre-check, which must still see their usernames and emails
+	for _, query := range stub.queries {
+		if strings.Contains(query, "users") && !strings.Contains(query, "deleted_at") && !strings.Contains(query, "CASE WHEN username") {
+			t.Errorf("query ignores deleted_at: %s", query)
+		}
+	}
+}
+
+func TestPurgeDeletedKeepsRecentDeletes(t *testing.T) {
+	now := time.Now()
+	type row struct {
+		id        int
+		deletedAt time.Time
+	}
+	var mutex sync.Mutex
+	var rows []row
+	for id := 1; id <= 5; id++ {
+		rows = append(rows, row{id, now.Add(-40 * 24 * time.Hour)})
+	}
+	rows = append(rows, row{6, now.Add(-24 * time.Hour)}, row{7, time.Time{}}, row{8, time.Time{}})
+
+	config := testConfig(t)
+	config.AdminToken = testAdminToken
+	config.PurgeBatchSize = 2
+	config.SoftDeleteRetention = 30 * 24 * time.Hour
+	us, stub := newTestService(t, config, func(q stubQuery) stubResult {
+		if !strings.Contains(q.sql, "WHERE deleted_at < $1 LIMIT $2") {
+			return stubResult{}
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		cutoff, limit := q.args[0].(time.Time), q.args[1].(int64)
+		kept := rows[:0]
+		var purged int64
+		for _, r := range rows {
+			if !r.deletedAt.IsZero() && r.deletedAt.Before(cutoff) && purged < limit {
+				purged++
+				continue
+			}
+			kept = append(kept, r)
+		}
+		rows = kept
+		return stubResult{affected: purged}
+	})
+
+	rec := serve(us.routes(), adminRequest("POST", "/admin/purge-deleted", ""))
+	var result map[string]interface{}
+	decodeBody(t, rec, &result)
+	if rec.Code != http.StatusOK || result["purged"] != 5.0 || result["complete"] != true {
+		t.Fatalf("status = %d, result %v, want 5 purged", rec.Code, result)
+	}
+	if n := stub.count("DELETE FROM users"); n != 3 {
+		t.Errorf("%d delete batches, want 3 of at most 2 rows", n)
+	}
+
+	var remaining []int
+	for _, r := range rows {
+		remaining = append(remaining, r.id)
+	}
+	if !slices.Equal(remaining, []int{6, 7, 8}) {
+		t.Errorf("remaining rows = %v, want the recent delete and the live users", remaining)
+	}
+}
+
+func TestListUsersNDJSON(t *testing.T) {
+	bob := User{ID: "2", Username: "bob", Email: "bob@example.com", Bio: "line one\nline two", Active: true}
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		if strings.Contains(q.sql, "ORDER BY") {
+			if strings.HasPrefix(q.sql, "SELECT username, created, updated ") {
+				return stubResult{columns: []string{"username", "created", "updated"}, rows: [][]driver.Value{
+					{"bob", testCreated, testCreated}, {"alice", testCreated, testCreated},
+				}}
+			}
+			return userRows(bob, alice)
+		}
+		return stubResult{}
+	})
+	handler := us.routes()
+
+	r := newRequest("GET", "/users", "")
+	r.Header.Set("Accept", "application/x-ndjson")
+	rec := serve(handler, r)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("status = %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	lines := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want one per user: %q", len(lines), rec.Body)
+	}
+	for i, want := range []string{"bob", "alice"} {
+		var user User
+		if err := json.Unmarshal([]byte(lines[i]), &user); err != nil {
+			t.Fatalf("line %d doesn't parse on its own: %v: %q", i, err, lines[i])
+		}
+		if user.Username != want {
+			t.Errorf("line %d is %q, want %q", i, user.Username, want)
+		}
+	}
+
+	// Projections apply per line
+	r = newRequest("GET", "/users?fields=username", "")
+	r.Header.Set("Accept", "application/x-ndjson")
+	for i, line := range strings.Split(strings.TrimSpace(serve(handler, r).Body.String()), "\n") {
+		var projected map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &projected); err != nil || len(projected) != 1 || projected["username"] == nil {
+			t.Errorf("projected line %d = %q, want only username", i, line)
+		}
+	}
+}
+
+// flushCounter counts flushes reaching the underlying writer.
+type flushCounter struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (fc *flushCounter) Flush() {
+	fc.flushes++
+	fc.ResponseRecorder.Flush()
+}
+
+func TestNDJSONFlushesPeriodically(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), nil)
+	w := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+	us.respondWithNDJSON(w, 2*ndjsonFlushEvery+1, func(i int) interface{} {
+		return map[string]int{"n": i}
+	})
+
+	if want := 3; w.flushes != want {
+		t.Errorf("%d flushes for %d lines, want %d", w.flushes, 2*ndjsonFlushEvery+1, want)
+	}
+	if lines := strings.Count(w.Body.String(), "\n"); lines != 2*ndjsonFlushEvery+1 {
+		t.Errorf("wrote %d lines, want %d", lines, 2*ndjsonFlushEvery+1)
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	config := testConfig(t)
+	config.RequestIDHeader = "X-Correlation-ID"
+	logs := captureLogs(t, config)
+	us, _ := newTestService(t, config, nil)
+	handler := us.routes()
+	generated := func(id string) bool {
+		_, err := strconv.ParseUint(id[:16], 16, 64)
+		return len(id) == 32 && err == nil
+	}
+
+	tests := []struct {
+		name, header, value string
+		keep                bool
+	}{
+		{"configured header", "X-Correlation-ID", "abc-123", true},
+		{"traceparent value", "X-Correlation-ID", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"absent", "", "", false},
+		{"other header ignored", "X-Request-ID", "abc-123", false},
+		{"not printable", "X-Correlation-ID", "abc 123", false},
+		{"too long", "X-Correlation-ID", strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+	for _, tt := range tests {
+		for _, route := range []struct{ method, target string }{{"GET", "/version"}, {"GET", "/no-such-route"}, {"DELETE", "/users"}} {
+			t.Run(tt.name+" "+route.method+" "+route.target, func(t *testing.T) {
+				r := newRequest(route.method, route.target, "")
+				if tt.header != "" {
+					r.Header.Set(tt.header, tt.value)
+				}
+				rec := serve(handler, r)
+
+				id := rec.Header().Get("X-Correlation-ID")
+				if tt.keep && id != tt.value {
+					t.Errorf("echoed ID = %q, want %q", id, tt.value)
+				}
+				if !tt.keep && (id == tt.value || !generated(id)) {
+					t.Errorf("echoed ID = %q, want a generated 32-character hex ID", id)
+				}
+
+				entries := logs.entries(t)
+				last := entries[len(entries)-1]
+				if last["msg"] != "Request handled" || last["request_id"] != id {
+					t.Errorf("last log = %v, want the request logged with request_id %q", last, id)
+				}
+			})
+		}
+	}
+}
+
+func TestJSONEscapeHTML(t *testing.T) {
+	const bio = "<b>Tom & Jerry</b>"
+	stored := alice
+	stored.Bio = bio
+
+	for _, escape := range []bool{false, true} {
+		t.Run(fmt.Sprintf("escape=%v", escape), func(t *testing.T) {
+			t.Setenv("JSON_ESCAPE_HTML", strconv.FormatBool(escape))
+			config := testConfig(t)
+			if config.EscapeHTML != escape {
+				t.Fatalf("JSON_ESCAPE_HTML=%v loaded as %v", escape, config.EscapeHTML)
+			}
+			us, _ := newTestService(t, config, func(q stubQuery) stubResult { return userRows(stored) })
+			handler := us.routes()
+
+			for _, target := range []string{"/users/1", "/users/1?pretty=true", "/users"} {
+				r := newRequest("GET", target, "")
+				if target == "/users" {
+					r.Header.Set("Accept", "application/x-ndjson")
+				}
+				rec := serve(handler, r)
+				raw := rec.Body.String()
+				if strings.Contains(raw, bio) == escape {
+					t.Errorf("GET %s with escaping %v: body %s", target, escape, raw)
+				}
+
+				var user User
+				if err := json.Unmarshal([]byte(strings.TrimSpace(raw)), &user); err != nil || user.Bio != bio {
+					t.Errorf("GET %s: decoded bio %q, %v; want %q either way", target, user.Bio, err, bio)
+				}
+			}
+		})
+	}
+}
+
+// TestConcurrentUserOperations runs every kind of user operation at once,
+// for go test -race. Between them they take the negative-cache mutex, the
+// cache LRU lock, the response cache, the singleflight groups and the SSE
+// hub; a lock ordering mistake shows up as a deadlock and fails the test.
+func TestConcurrentUserOperations(t *testing.T) {
+	table := &softDeleteTable{deleted: map[UserID]bool{}}
+	for id := 1; id <= 10; id++ {
+		table.users = append(table.users, User{ID: UserID(strconv.Itoa(id)), Username: fmt.Sprintf("seed%d", id), Email: fmt.Sprintf("seed%d@example.com", id), Active: true})
+	}
+	config := testConfig(t)
+	config.ResponseCacheTTL = time.Second
+	config.NegativeCacheTTL = time.Second
+	// Small enough that entries are evicted while others read them
+	config.CacheMaxBytes = 4 * cacheEntryOverhead
+	us, _ := newTestService(t, config, table.handle)
+	handler := us.routes()
+
+	// A subscriber keeps the event hub busy alongside the writes
+	events, _ := us.events.subscribe()
+	go func() {
+		for range events {
+		}
+	}()
+	defer us.events.unsubscribe(events)
+
+	const workers, operations = 8, 100
+	var wg sync.WaitGroup
+	failures := make(chan string, workers*operations)
+	for worker := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range operations {
+				id := strconv.Itoa(1 + (worker+i)%20)
+				var r *http.Request
+				switch i % 8 {
+				case 0:
+					r = newRequest("POST", "/users", fmt.Sprintf(`{"username":"user%d_%d","email":"user%d_%d@example.com"}`, worker, i, worker, i))
+				case 1, 2:
+					r = newRequest("GET", "/users/"+id, "")
+				case 3:
+					r = newRequest("PUT", "/users/"+id, fmt.Sprintf(`{"username":"put%d_%d","email":"put%d_%d@example.com","bio":"hi"}`, worker, i, worker, i))
+				case 4:
+					r = newRequest("PATCH", "/users/"+id, `{"bio":"patched"}`)
+				case 5:
+					r = newRequest("DELETE", "/users/"+id, "")
+				case 6:
+					r = newRequest("GET", "/users", "")
+				case 7:
+					r = newRequest("GET", "/users/search?q=seed", "")
+				}
+				if rec := serve(handler, r); rec.Code >= 500 {
+					failures <- fmt.Sprintf("%s %s: status %d: %s", r.Method, r.URL, rec.Code, rec.Body)
+				}
+			}
+		}()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(30 * time.Second):
+		t.Fatal("concurrent operations did not finish, likely a deadlock")
+	}
+	close(failures)
+	for failure := range failures {
+		t.Error(failure)
+	}
+
+	// The LRU's byte accounting survived the interleaving
+	cache := us.cache.(*memoryCache)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	var total int64
+	for element := cache.order.Front(); element != nil; element = element.Next() {
+		total += entrySize(element.Value.(*memoryEntry).user)
+	}
+	if total != cache.bytes || cache.order.Len() != len(cache.users) || cache.bytes > cache.maxBytes {
+		t.Errorf("cache holds %d entries of %d bytes, accounted as %d entries of %d bytes (max %d)",
+			cache.order.Len(), total, len(cache.users), cache.bytes, cache.maxBytes)
+	}
+}
+
+func TestConcurrentCacheMissesReadTheDBOnce(t *testing.T) {
+	us, stub := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		if strings.Contains(q.sql, "WHERE id = $1") {
+			// Long enough for the other requests to miss the cache too
+			time.Sleep(20 * time.Millisecond)
+			return userRows(alice)
+		}
+		return stubResult{}
+	})
+	handler := us.routes()
+
+	const requests = 50
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, requests)
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recs[i] = serve(handler, newRequest("GET", "/users/1", ""))
+		}()
+	}
+	wg.Wait()
+
+	// Requests that arrive after the load finished re-check the cache inside
+	// the flight, so this holds however the requests interleave
+	if n := stub.count("WHERE id = $1"); n != 1 {
+		t.Errorf("%d DB reads for %d concurrent misses, want 1", n, requests)
+	}
+	for i, rec := range recs {
+		if rec.Code != http.StatusOK || rec.Body.String() != recs[0].Body.String() {
+			t.Errorf("request %d: status %d, body %s", i, rec.Code, rec.Body)
+		}
+	}
+	if _, ok := us.cache.Get("1"); !ok {
+		t.Error("loaded user not cached")
+	}
+}
+
+// writeTestCert writes a self-signed localhost certificate and key to dir.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSRejectsDisallowedClients(t *testing.T) {
+	const allowed, other = tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256
+	tests := []struct {
+		name       string
+		minVersion uint16
+		suites     []uint16
+		client     *tls.Config
+		wantOK     bool
+	}{
+		{"1.2 client against min 1.3", tls.VersionTLS13, nil, &tls.Config{MaxVersion: tls.VersionTLS12}, false},
+		{"1.3 client against min 1.3", tls.VersionTLS13, nil, &tls.Config{MinVersion: tls.VersionTLS13}, true},
+		{"1.1 client against the default", tls.VersionTLS12, nil, &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}, false},
+		{"1.2 client against the default", tls.VersionTLS12, nil, &tls.Config{MaxVersion: tls.VersionTLS12}, true},
+		{"suite outside the allowlist", tls.VersionTLS12, []uint16{allowed}, &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{other}}, false},
+		{"suite in the allowlist", tls.VersionTLS12, []uint16{allowed}, &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{allowed}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(t)
+			config.TLSCertFile, config.TLSKeyFile = writeTestCert(t, t.TempDir())
+			config.TLSMinVersion = tt.minVersion
+			config.TLSCipherSuites = tt.suites
+			us, _ := newTestService(t, config, nil)
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- us.run(ctx, us.newServer(http.NotFoundHandler()), listener) }()
+			t.Cleanup(func() {
+				cancel()
+				<-done
+			})
+
+			tt.client.InsecureSkipVerify = true
+			conn, err := tls.Dial("tcp", listener.Addr().String(), tt.client)
+			if err == nil {
+				conn.Close()
+			}
+			if ok := err == nil; ok != tt.wantOK {
+				t.Errorf("handshake error = %v, want success %v", err, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestTLSSettingsFromEnv(t *testing.T) {
+	if config := testConfig(t); config.TLSMinVersion != tls.VersionTLS12 || config.TLSCipherSuites != nil {
+		t.Errorf("defaults: min version %x, suites %v; want TLS 1.2 and Go's defaults", config.TLSMinVersion, config.TLSCipherSuites)
+	}
+	t.Setenv("TLS_MIN_VERSION", "1.3")
+	t.Setenv("TLS_CIPHER_SUITES", "tls_ecdhe_ecdsa_with_aes_128_gcm_sha256, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	config := testConfig(t)
+	if config.TLSMinVersion != tls.VersionTLS13 {
+		t.Errorf("TLS_MIN_VERSION=1.3 loaded as %x", config.TLSMinVersion)
+	}
+	want := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	if !slices.Equal(config.TLSCipherSuites, want) {
+		t.Errorf("TLS_CIPHER_SUITES loaded as %v, want %v", config.TLSCipherSuites, want)
+	}
+
+	for _, weak := range []string{"TLS_RSA_WITH_RC4_128_SHA", "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA", "TLS_NOT_A_SUITE"} {
+		if _, err := parseCipherSuites(weak); err == nil {
+			t.Errorf("parseCipherSuites(%q) accepted it", weak)
+		}
+	}
+	if _, ok := tlsVersions["1.1"]; ok {
+		t.Error("TLS 1.1 accepted as a minimum version")
+	}
+}
+
+func TestListUsersVerifiedFilter(t *testing.T) {
+	verified := map[string]bool{"alice": true, "bob": false, "carol": false}
+	all := []User{{ID: "1", Username: "alice", Active: true}, {ID: "2", Username: "bob", Active: true}, {ID: "3", Username: "carol", Active: true}}
+	handle := func(q stubQuery) stubResult {
+		if !strings.Contains(q.sql, "FROM users") {
+			return stubResult{}
+		}
+		var matched []User
+		for _, user := range all {
+			if strings.Contains(q.sql, "email_verified = $1") && verified[user.Username] != q.args[0].(bool) {
+				continue
+			}
+			matched = append(matched, user)
+		}
+		return userRows(matched...)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"alice", "bob", "carol"}},
+		{"?verified=true", []string{"alice"}},
+		{"?verified=false", []string{"bob", "carol"}},
+		{"?verified=0", []string{"bob", "carol"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			us, stub := newTestService(t, testConfig(t), handle)
+			rec := serve(us.routes(), newRequest(http.MethodGet, "/users"+tt.query, ""))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+			}
+			if got := usernames(t, rec); !slices.Equal(got, tt.want) {
+				t.Errorf("users = %v, want %v", got, tt.want)
+			}
+			if tt.query == "" && stub.count("email_verified") != 0 {
+				t.Error("unfiltered list queried email_verified")
+			}
+		})
+	}
+
+	us, stub := newTestService(t, testConfig(t), handle)
+	rec := serve(us.routes(), newRequest(http.MethodGet, "/users?verified=maybe", ""))
+	if rec.Code != http.StatusBadRequest || errorCode(t, rec) != codeInvalidFilter {
+		t.Errorf("?verified=maybe: status %d, body %s; want 400 %s", rec.Code, rec.Body, codeInvalidFilter)
+	}
+	if stub.count("FROM users") != 0 {
+		t.Error("invalid filter still queried the database")
+	}
+}
+
+func TestPaginationDefaultsPerEndpoint(t *testing.T) {
+	config := testConfig(t)
+	config.ListPageSize, config.ListMaxPageSize = 3, 5
+	config.SearchPageSize, config.SearchMaxResults = 7, 9
+
+	var mutex sync.Mutex
+	var window []driver.Value
+	us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+		if strings.Contains(q.sql, "LIMIT $") {
+			mutex.Lock()
+			window = q.args[len(q.args)-2:]
+			mutex.Unlock()
+		}
+		return userRows()
+	})
+	h := us.routes()
+
+	tests := []struct {
+		target     string
+		wantLimit  int64
+		wantOffset int64
+	}{
+		{"/users", 3, 0},
+		{"/users?limit=5&offset=10", 5, 10},
+		{"/users?verified=true&limit=2", 2, 0},
+		{"/users/search?q=al", 7, 0},
+		{"/users/search?q=al&limit=9&offset=4", 9, 4},
+	}
+	for _, tt := range tests {
+		window = nil
+		rec := serve(h, newRequest(http.MethodGet, tt.target, ""))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d, body %s", tt.target, rec.Code, rec.Body)
+			continue
+		}
+		want := []driver.Value{tt.wantLimit, tt.wantOffset}
+		if !slices.Equal(window, want) {
+			t.Errorf("%s: LIMIT/OFFSET %v, want %v", tt.target, window, want)
+		}
+	}
+
+	for _, target := range []string{
+		"/users?limit=6", "/users?limit=0", "/users?limit=ten", "/users?offset=-1",
+		"/users/search?q=al&limit=10", "/users/search?q=al&offset=x",
+	} {
+		rec := serve(h, newRequest(http.MethodGet, target, ""))
+		if rec.Code != http.StatusBadRequest || errorCode(t, rec) != codeInvalidPage {
+			t.Errorf("%s: status %d, body %s; want 400 %s", target, rec.Code, rec.Body, codeInvalidPage)
+		}
+	}
+}
+
+func TestPageSizesFromEnv(t *testing.T) {
+	t.Setenv("LIST_PAGE_SIZE", "10")
+	t.Setenv("LIST_MAX_PAGE_SIZE", "50")
+	t.Setenv("SEARCH_MAX_RESULTS", "40")
+	config := testConfig(t)
+	if config.ListPageSize != 10 || config.ListMaxPageSize != 50 {
+		t.Errorf("list page size %d max %d, want 10 and 50", config.ListPageSize, config.ListMaxPageSize)
+	}
+	if config.SearchPageSize != 40 {
+		t.Errorf("search page size %d, want it to follow SEARCH_MAX_RESULTS down to 40", config.SearchPageSize)
+	}
+}
+
+func TestListPageSizeFollowsMaxDown(t *testing.T) {
+	t.Setenv("LIST_MAX_PAGE_SIZE", "10")
+	if config := testConfig(t); config.ListPageSize != 10 || config.ListMaxPageSize != 10 {
+		t.Errorf("list page size %d max %d, want the default to follow LIST_MAX_PAGE_SIZE down to 10", config.ListPageSize, config.ListMaxPageSize)
+	}
+}
+
+func TestGetUserDurationBySource(t *testing.T) {
+	samples := func(source string) float64 {
+		return metricValue(t, getUserDuration.WithLabelValues(source).(prometheus.Histogram))
+	}
+	fromCache, fromDB := samples("cache"), samples("db")
+
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		if strings.Contains(q.sql, "WHERE id = $1") {
+			return userRows(User{ID: "1", Username: "alice", Active: true})
+		}
+		return stubResult{}
+	})
+	h := us.routes()
+	for range 2 {
+		if rec := serve(h, newRequest(http.MethodGet, "/users/1", "")); rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+		}
+	}
+	if got := samples("db") - fromDB; got != 1 {
+		t.Errorf("db samples +%v after a miss then a hit, want +1", got)
+	}
+	if got := samples("cache") - fromCache; got != 1 {
+		t.Errorf("cache samples +%v after a miss then a hit, want +1", got)
+	}
+
+	serve(h, newRequest(http.MethodGet, "/users/99999999999", ""))
+	if samples("db")-fromDB != 1 || samples("cache")-fromCache != 1 {
+		t.Error("a rejected ID was observed")
+	}
+}
+
+// signupStore answers CountSignups' query over created, doing date_trunc's
+// grouping in Go.
+func signupStore(created []time.Time) func(q stubQuery) stubResult {
+	return func(q stubQuery) stubResult {
+		if !strings.Contains(q.sql, "date_trunc($1, created)") {
+			return stubResult{}
+		}
+		interval, from, to := q.args[0].(string), q.args[1].(time.Time), q.args[2].(time.Time)
+		counts := map[time.Time]int64{}
+		for _, c := range created {
+			if c.Before(from) || !c.Before(to) {
+				continue
+			}
+			bucket := time.Date(c.Year(), c.Month(), c.Day(), 0, 0, 0, 0, time.UTC)
+			switch interval {
+			case "week":
+				bucket = bucket.AddDate(0, 0, -(int(bucket.Weekday())+6)%7)
+			case "month":
+				bucket = bucket.AddDate(0, 0, 1-bucket.Day())
+			}
+			counts[bucket]++
+		}
+		result := stubResult{columns: []string{"bucket", "count"}}
+		for _, bucket := range slices.SortedFunc(maps.Keys(counts), time.Time.Compare) {
+			result.rows = append(result.rows, []driver.Value{bucket, counts[bucket]})
+		}
+		return result
+	}
+}
+
+func TestCountSignups(t *testing.T) {
+	day := func(d, hour int) time.Time { return time.Date(2024, 3, d, hour, 0, 0, 0, time.UTC) }
+	// Friday 1st to Tuesday 12th: two on the 1st, one on the 4th (a Monday),
+	// three on the 5th, one on the 11th
+	created := []time.Time{day(1, 9), day(1, 23), day(4, 0), day(5, 1), day(5, 2), day(5, 3), day(11, 12)}
+	us, stub := newTestService(t, testConfig(t), signupStore(created))
+	h := us.routes()
+
+	tests := []struct {
+		query string
+		want  []SignupBucket
+	}{
+		{"?from=2024-03-01&to=2024-03-06", []SignupBucket{
+			{"2024-03-01T00:00:00Z", 2}, {"2024-03-04T00:00:00Z", 1}, {"2024-03-05T00:00:00Z", 3},
+		}},
+		{"?interval=week&from=2024-03-01&to=2024-03-31", []SignupBucket{
+			{"2024-02-26T00:00:00Z", 2}, {"2024-03-04T00:00:00Z", 4}, {"2024-03-11T00:00:00Z", 1},
+		}},
+		{"?interval=month&from=2024-01-01&to=2024-04-01", []SignupBucket{{"2024-03-01T00:00:00Z", 7}}},
+		{"?from=2024-03-05T02:00:00Z&to=2024-03-11T00:00:00Z", []SignupBucket{{"2024-03-05T00:00:00Z", 2}}},
+		{"?from=2024-04-01&to=2024-05-01", []SignupBucket{}},
+	}
+	for _, tt := range tests {
+		rec := serve(h, newRequest(http.MethodGet, "/users/signups"+tt.query, ""))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d, body %s", tt.query, rec.Code, rec.Body)
+			continue
+		}
+		var got []SignupBucket
+		decodeBody(t, rec, &got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: buckets %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	stub.reset()
+	for _, query := range []string{
+		"?interval=year", "?interval=day'; DROP TABLE users; --", "?from=March", "?from=2024-03-05&to=2024-03-05",
+	} {
+		rec := serve(h, newRequest(http.MethodGet, "/users/signups?"+url.PathEscape(query[1:]), ""))
+		if rec.Code != http.StatusBadRequest || errorCode(t, rec) != codeInvalidFilter {
+			t.Errorf("%s: status %d, body %s; want 400 %s", query, rec.Code, rec.Body, codeInvalidFilter)
+		}
+	}
+	if stub.count("date_trunc") != 0 {
+		t.Error("a rejected request still queried the database")
+	}
+}
+
+func TestIdentifiersAreTrimmed(t *testing.T) {
+	tests := []struct {
+		name, username, email string
+		trim                  bool
+		wantStatus            int
+	}{
+		{"trailing space", "alice ", "alice@example.com", true, http.StatusCreated},
+		{"leading tab and newline", "\talice", "\nalice@example.com ", true, http.StatusCreated},
+		{"internal space", "al ice", "alice@example.com", true, http.StatusUnprocessableEntity},
+		{"only spaces", "   ", "alice@example.com", true, http.StatusUnprocessableEntity},
+		{"trimming disabled", "alice ", " alice@example.com", false, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(t)
+			config.TrimIdentifiers = tt.trim
+			config.DuplicatePrecheck = false
+			var mutex sync.Mutex
+			var inserted []driver.Value
+			insert := insertingStore()
+			us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+				if strings.HasPrefix(strings.TrimSpace(q.sql), "INSERT INTO users") {
+					mutex.Lock()
+					inserted = q.args[:2]
+					mutex.Unlock()
+				}
+				return insert(q)
+			})
+
+			body, _ := json.Marshal(map[string]string{"username": tt.username, "email": tt.email})
+			rec := serve(us.routes(), newRequest(http.MethodPost, "/users", string(body)))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusCreated {
+				if code := errorCode(t, rec); code != codeInvalidUserData {
+					t.Errorf("code = %q, want %q", code, codeInvalidUserData)
+				}
+				return
+			}
+			if want := []driver.Value{"alice", "alice@example.com"}; !slices.Equal(inserted, want) {
+				t.Errorf("inserted %q, want %q", inserted, want)
+			}
+			var user User
+			decodeBody(t, rec, &user)
+			if user.Username != "alice" || user.Email != "alice@example.com" {
+				t.Errorf("response has %q <%s>, want the trimmed values", user.Username, user.Email)
+			}
+		})
+	}
+}
+
+// withConfigFile writes settings to a CONFIG_FILE for the test. The file's
+// variables are unset for the test and restored afterwards, since
+// applyConfigFile exports them into the environment.
+func withConfigFile(t *testing.T, settings string, names ...string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(settings), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	for _, name := range names {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+}
+
+func TestConfigFileOnly(t *testing.T) {
+	withConfigFile(t, `{
+		"PORT": 9090,
+		"MAX_BODY_BYTES": 10000000,
+		"FUZZY_THRESHOLD": 0.25,
+		"RENDER_MARKDOWN": false,
+		"LOG_FORMAT": "text",
+		"TRUSTED_PROXIES": ["10.0.0.0/8", "192.168.0.0/16"]
+	}`, "PORT", "MAX_BODY_BYTES", "FUZZY_THRESHOLD", "RENDER_MARKDOWN", "LOG_FORMAT", "TRUSTED_PROXIES")
+
+	config := testConfig(t)
+	if config.Port != "9090" {
+		t.Errorf("Port = %q, want 9090", config.Port)
+	}
+	if config.MaxBodyBytes != 10000000 {
+		t.Errorf("MaxBodyBytes = %d, want 10000000", config.MaxBodyBytes)
+	}
+	if config.FuzzyThreshold != 0.25 {
+		t.Errorf("FuzzyThreshold = %v, want 0.25", config.FuzzyThreshold)
+	}
+	if config.RenderMarkdown {
+		t.Error("RenderMarkdown still on")
+	}
+	if config.LogFormat != "text" {
+		t.Errorf("LogFormat = %q, want text", config.LogFormat)
+	}
+	want := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.168.0.0/16")}
+	if !slices.Equal(config.TrustedProxies, want) {
+		t.Errorf("TrustedProxies = %v, want %v", config.TrustedProxies, want)
+	}
+}
+
+func TestEnvOverridesConfigFile(t *testing.T) {
+	withConfigFile(t, `{"PORT": 9090, "LOG_FORMAT": "text"}`, "LOG_FORMAT")
+	t.Setenv("PORT", "7070")
+
+	config := testConfig(t)
+	if config.Port != "7070" {
+		t.Errorf("Port = %q, want the env's 7070 over the file's 9090", config.Port)
+	}
+	if config.LogFormat != "text" {
+		t.Errorf("LogFormat = %q, want the file's text", config.LogFormat)
+	}
+}
+
+func TestMissingConfigFileFallsBack(t *testing.T) {
+	t.Setenv("CONFIG_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	t.Setenv("PORT", "7070")
+
+	config := testConfig(t)
+	if config.Port != "7070" {
+		t.Errorf("Port = %q, want the env's 7070", config.Port)
+	}
+	if config.LogFormat != "json" || config.MaxBodyBytes != loadConfig().MaxBodyBytes {
+		t.Errorf("LogFormat = %q, MaxBodyBytes = %d; want the defaults", config.LogFormat, config.MaxBodyBytes)
+	}
+}
+
+func TestConfigFileRejectsMalformedSettings(t *testing.T) {
+	dir := t.TempDir()
+	for name, settings := range map[string]string{
+		"not JSON":      `PORT=8080`,
+		"trailing data": `{"PORT": 8080} {"PORT": 9090}`,
+		"nested object": `{"PORT": {"value": 8080}}`,
+		"null":          `{"PORT": null}`,
+	} {
+		path := filepath.Join(dir, "config.json")
+		if err := os.WriteFile(path, []byte(settings), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := applyConfigFile(path); err == nil {
+			t.Errorf("%s: applyConfigFile accepted %s", name, settings)
+		}
+	}
+}
+
+func TestSearchServedStaleWhileDBFails(t *testing.T) {
+	setup := func(t *testing.T, serveStale bool, ttl time.Duration) (http.Handler, *atomic.Bool) {
+		config := testConfig(t)
+		config.ServeStaleOnError = serveStale
+		config.StaleSearchTTL = ttl
+		var failing atomic.Bool
+		us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+			if failing.Load() {
+				return stubResult{err: errors.New("connection refused")}
+			}
+			if strings.Contains(q.sql, "LIKE $1") {
+				return userRows(User{ID: "1", Username: "alice", Active: true})
+			}
+			return userRows()
+		})
+		h := us.routes()
+		if rec := serve(h, newRequest(http.MethodGet, "/users/search?q=al", "")); rec.Code != http.StatusOK {
+			t.Fatalf("warming search: status %d, body %s", rec.Code, rec.Body)
+		}
+		failing.Store(true)
+		return h, &failing
+	}
+
+	t.Run("recent search", func(t *testing.T) {
+		h, failing := setup(t, true, time.Minute)
+		rec := serve(h, newRequest(http.MethodGet, "/users/search?q=al", ""))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, body %s; want the stale result", rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get("Warning"); !strings.HasPrefix(got, "110") {
+			t.Errorf("Warning = %q, want 110 stale", got)
+		}
+		if got := usernames(t, rec); !slices.Equal(got, []string{"alice"}) {
+			t.Errorf("users = %v, want [alice]", got)
+		}
+
+		failing.Store(false)
+		rec = serve(h, newRequest(http.MethodGet, "/users/search?q=al", ""))
+		if rec.Code != http.StatusOK || rec.Header().Get("Warning") != "" {
+			t.Errorf("after recovery: status %d, Warning %q; want a fresh 200", rec.Code, rec.Header().Get("Warning"))
+		}
+	})
+
+	t.Run("search never run", func(t *testing.T) {
+		h, _ := setup(t, true, time.Minute)
+		rec := serve(h, newRequest(http.MethodGet, "/users/search?q=bo", ""))
+		if rec.Code != http.StatusInternalServerError || errorCode(t, rec) != codeDatabaseError {
+			t.Errorf("status = %d, body %s; want 500 %s", rec.Code, rec.Body, codeDatabaseError)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		h, _ := setup(t, true, time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+		if rec := serve(h, newRequest(http.MethodGet, "/users/search?q=al", "")); rec.Code != http.StatusInternalServerError {
+			t.Errorf("status = %d, want 500 once STALE_SEARCH_TTL has passed", rec.Code)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		h, _ := setup(t, false, time.Minute)
+		if rec := serve(h, newRequest(http.MethodGet, "/users/search?q=al", "")); rec.Code != http.StatusInternalServerError {
+			t.Errorf("status = %d, want 500 without SERVE_STALE_ON_ERROR", rec.Code)
+		}
+	})
+}
+
+func TestCreateUserReturnsDBCreated(t *testing.T) {
+	config := testConfig(t)
+	config.DuplicatePrecheck = false
+	dbNow := "2001-09-09T01:46:40Z"
+	var insertArgs []driver.Value
+	us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+		if !strings.HasPrefix(strings.TrimSpace(q.sql), "INSERT INTO users") {
+			return userRows()
+		}
+		if strings.Contains(q.sql, "created") && !strings.Contains(q.sql, "RETURNING") {
+			t.Errorf("insert names created: %s", q.sql)
+		}
+		insertArgs = q.args
+		return userRows(User{ID: "7", Username: q.args[0].(string), Email: q.args[1].(string), Created: dbNow, Active: true})
+	})
+
+	body := `{"username":"alice","email":"alice@example.com","created":"1999-01-01T00:00:00Z","active":false}`
+	rec := serve(us.routes(), newRequest(http.MethodPost, "/users", body))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+	}
+	if len(insertArgs) != 3 {
+		t.Errorf("insert args %v, want only username, email and bio", insertArgs)
+	}
+	var user User
+	decodeBody(t, rec, &user)
+	if user.Created != dbNow || user.Updated != dbNow {
+		t.Errorf("created %q updated %q, want the DB's %q", user.Created, user.Updated, dbNow)
+	}
+	if user.ID != "7" || !user.Active {
+		t.Errorf("id %q active %v, want the stored row's 7 and true", user.ID, user.Active)
+	}
+}
+
+func TestUUIDMode(t *testing.T) {
+	const id = "0f8fad5b-d9cb-469f-a165-70867728950e"
+	config := testConfig(t)
+	config.IDType = idTypeUUID
+	config.DuplicatePrecheck = false
+	var mutex sync.Mutex
+	stored := map[string]User{}
+	us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch {
+		case strings.HasPrefix(strings.TrimSpace(q.sql), "INSERT INTO users"):
+			user := User{ID: id, Username: q.args[0].(string), Email: q.args[1].(string), Active: true}
+			stored[id] = user
+			return userRows(user)
+		case strings.Contains(q.sql, "WHERE id = $1"):
+			if user, ok := stored[q.args[0].(string)]; ok {
+				return userRows(user)
+			}
+		}
+		return userRows()
+	})
+	h := us.routes()
+
+	rec := serve(h, newRequest(http.MethodPost, "/users", `{"username":"alice","email":"alice@example.com"}`))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status %d, body %s", rec.Code, rec.Body)
+	}
+	var created map[string]interface{}
+	decodeBody(t, rec, &created)
+	if created["id"] != id {
+		t.Errorf("created id = %#v, want the string %q", created["id"], id)
+	}
+
+	for _, path := range []string{"/users/" + id, "/users/" + strings.ToUpper(id)} {
+		us.cache.Delete(id)
+		rec := serve(h, newRequest(http.MethodGet, path, ""))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s: status %d, body %s", path, rec.Code, rec.Body)
+			continue
+		}
+		var user User
+		decodeBody(t, rec, &user)
+		if user.ID != id || user.Username != "alice" {
+			t.Errorf("GET %s: got %+v", path, user)
+		}
+	}
+
+	for _, path := range []string{"/users/42", "/users/" + id[:35]} {
+		if rec := serve(h, newRequest(http.MethodGet, path, "")); rec.Code != http.StatusNotFound || errorCode(t, rec) != codeNotFound {
+			t.Errorf("GET %s in UUID mode: status %d, body %s; want 404 %s", path, rec.Code, rec.Body, codeNotFound)
+		}
+	}
+
+	integer, _ := newTestService(t, testConfig(t), nil)
+	if rec := serve(integer.routes(), newRequest(http.MethodGet, "/users/"+id, "")); rec.Code != http.StatusNotFound {
+		t.Errorf("GET a UUID in integer mode: status %d, want 404", rec.Code)
+	}
+}
+
+func TestUserIDJSONEncoding(t *testing.T) {
+	for id, want := range map[UserID]string{"42": `42`, "0f8fad5b-d9cb-469f-a165-70867728950e": `"0f8fad5b-d9cb-469f-a165-70867728950e"`, "007": `"007"`} {
+		got, err := json.Marshal(id)
+		if err != nil || string(got) != want {
+			t.Errorf("Marshal(%q) = %s, %v; want %s", id, got, err, want)
+		}
+	}
+	for raw, want := range map[string]UserID{`42`: "42", `"42"`: "42", `"0f8fad5b-d9cb-469f-a165-70867728950e"`: "0f8fad5b-d9cb-469f-a165-70867728950e"} {
+		var id UserID
+		if err := json.Unmarshal([]byte(raw), &id); err != nil || id != want {
+			t.Errorf("Unmarshal(%s) = %q, %v; want %q", raw, id, err, want)
+		}
+	}
+	var id UserID
+	if err := json.Unmarshal([]byte(`4.2`), &id); err == nil {
+		t.Errorf("Unmarshal(4.2) accepted as %q", id)
+	}
+}
+
+func TestDisabledRoutes(t *testing.T) {
+	tests := []struct {
+		name     string
+		disabled []string
+		status   int
+		want     map[string]int
+	}{
+		{"search off", []string{"/users/search"}, http.StatusServiceUnavailable, map[string]int{
+			"GET /users/search?q=al": http.StatusServiceUnavailable,
+			"GET /users":             http.StatusOK,
+			"GET /users/1":           http.StatusOK,
+		}},
+		{"search off as 404", []string{"/users/search"}, http.StatusNotFound, map[string]int{
+			"GET /users/search?q=al": http.StatusNotFound,
+			"GET /users":             http.StatusOK,
+		}},
+		{"one method", []string{" DELETE /users/{id}", "/users/signups"}, http.StatusServiceUnavailable, map[string]int{
+			"DELETE /users/1": http.StatusServiceUnavailable,
+			"GET /users/1":    http.StatusOK,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DISABLED_ROUTES", strings.Join(tt.disabled, ","))
+			t.Setenv("DISABLED_ROUTE_STATUS", strconv.Itoa(tt.status))
+			config := testConfig(t)
+			us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+				return userRows(User{ID: "1", Username: "alice", Active: true})
+			})
+			h := us.routes()
+			for request, want := range tt.want {
+				method, target, _ := strings.Cut(request, " ")
+				rec := serve(h, newRequest(method, target, ""))
+				if rec.Code != want {
+					t.Errorf("%s: status %d, want %d; body %s", request, rec.Code, want, rec.Body)
+				}
+				if want == http.StatusServiceUnavailable && errorCode(t, rec) != codeRouteDisabled {
+					t.Errorf("%s: code %q, want %q", request, errorCode(t, rec), codeRouteDisabled)
+				}
+			}
+		})
+	}
+}
+
+func TestDisabledRoutesReloadOnHangup(t *testing.T) {
+	// Catch SIGHUP ourselves first, so one arriving before reloadOnHangup
+	// subscribes can't kill the test binary
+	hangups := make(chan os.Signal, 16)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	path := filepath.Join(t.TempDir(), "disabled")
+	if err := os.WriteFile(path, []byte("# incident 12\n/users/search\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig(t)
+	config.DisabledRoutesFile = path
+	config.DisabledRoutes = []string{"/users/signups"}
+	us, _ := newTestService(t, config, func(q stubQuery) stubResult { return userRows() })
+	h := us.routes()
+	status := func(target string) int { return serve(h, newRequest(http.MethodGet, target, "")).Code }
+
+	if status("/users/search?q=al") != http.StatusServiceUnavailable || status("/users/signups") != http.StatusServiceUnavailable {
+		t.Fatal("routes from DISABLED_ROUTES_FILE and DISABLED_ROUTES not disabled at startup")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		us.reloadOnHangup(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if err := os.WriteFile(path, []byte("/users\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for status("/users") != http.StatusServiceUnavailable {
+		if time.Now().After(deadline) {
+			t.Fatal("SIGHUP did not reload DISABLED_ROUTES_FILE")
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status("/users/search?q=al") != http.StatusOK {
+		t.Error("search still disabled after it was removed from the file")
+	}
+	if status("/users/signups") != http.StatusServiceUnavailable {
+		t.Error("DISABLED_ROUTES entry lost on reload")
+	}
+
+	// A broken file keeps the routes already in effect
+	os.Remove(path)
+	os.Mkdir(path, 0o700)
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	time.Sleep(50 * time.Millisecond)
+	if status("/users") != http.StatusServiceUnavailable {
+		t.Error("failed reload discarded the previous disabled routes")
+	}
+}
+
+func TestResponseWarnings(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult { return userRows(alice) })
+	h := us.routes()
+
+	rec := serve(h, newRequest(http.MethodGet, "/users?envelope=false", ""))
+	warnings := rec.Header().Values("Warning")
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0], "299 - ") || !strings.Contains(warnings[0], "envelope=true") {
+		t.Errorf("bare array Warning = %q, want one 299 deprecation pointing at ?envelope=true", warnings)
+	}
+
+	rec = serve(h, newRequest(http.MethodGet, "/users?envelope=true", ""))
+	if got := rec.Header().Values("Warning"); got != nil {
+		t.Errorf("envelope Warning = %q, want none", got)
+	}
+	if strings.Contains(rec.Body.String(), `"warnings"`) {
+		t.Errorf("envelope without warnings has a warnings field: %s", rec.Body)
+	}
+
+	// Warnings added before the handler builds its envelope land in both
+	// the header and the body
+	warned := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addWarning(w, warnStale, `Response is "Stale"`)
+		us.ListUsers(w, r)
+	})
+	rec = serve(warned, newRequest(http.MethodGet, "/users?envelope=true", ""))
+	var list UserList
+	decodeBody(t, rec, &list)
+	if want := []string{`Response is "Stale"`}; !slices.Equal(list.Warnings, want) {
+		t.Errorf("envelope warnings = %q, want %q", list.Warnings, want)
+	}
+	if !hasWarning(rec.Header(), warnStale) || hasWarning(rec.Header(), warnDeprecate) {
+		t.Errorf("Warning = %q, want only the 110", rec.Header().Values("Warning"))
+	}
+}
+
+func TestBareArraySunsetHeader(t *testing.T) {
+	t.Setenv("LIST_SUNSET", "2027-01-31")
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult { return userRows(alice) })
+	h := us.routes()
+
+	rec := serve(h, newRequest(http.MethodGet, "/users?envelope=false", ""))
+	if got := rec.Header().Get("Deprecation"); got != "true" {
+		t.Errorf("Deprecation = %q, want true", got)
+	}
+	if got, want := rec.Header().Get("Sunset"), "Sun, 31 Jan 2027 00:00:00 GMT"; got != want {
+		t.Errorf("Sunset = %q, want %q", got, want)
+	}
+
+	rec = serve(h, newRequest(http.MethodGet, "/users?envelope=true", ""))
+	if rec.Header().Get("Deprecation") != "" || rec.Header().Get("Sunset") != "" {
+		t.Errorf("envelope: Deprecation %q, Sunset %q; want neither", rec.Header().Get("Deprecation"), rec.Header().Get("Sunset"))
+	}
+
+	t.Setenv("LIST_SUNSET", "")
+	us, _ = newTestService(t, testConfig(t), func(q stubQuery) stubResult { return userRows(alice) })
+	rec = serve(us.routes(), newRequest(http.MethodGet, "/users?envelope=false", ""))
+	if rec.Header().Get("Deprecation") != "true" || rec.Header().Get("Sunset") != "" {
+		t.Errorf("without LIST_SUNSET: Deprecation %q, Sunset %q; want only Deprecation", rec.Header().Get("Deprecation"), rec.Header().Get("Sunset"))
+	}
+}
+
+func TestPerIPConcurrencyLimit(t *testing.T) {
+	config := testConfig(t)
+	config.PerIPConcurrency = 2
+	us, _ := newTestService(t, config, nil)
+
+	entered := make(chan struct{}, 8)
+	release := make(chan struct{})
+	h := us.middlewarePerIPConcurrency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			entered <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	from := func(ip, path string) *http.Request {
+		r := newRequest(http.MethodGet, path, "")
+		r.RemoteAddr = ip + ":1234"
+		return r
+	}
+
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(h, from("192.0.2.1", "/slow"))
+		}()
+	}
+	for range 2 {
+		<-entered
+	}
+
+	rec := serve(h, from("192.0.2.1", "/users"))
+	if rec.Code != http.StatusTooManyRequests || errorCode(t, rec) != codeTooManyConcurrent {
+		t.Errorf("third request from a busy IP: status %d, body %s; want 429 %s", rec.Code, rec.Body, codeTooManyConcurrent)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("429 without Retry-After")
+	}
+	for _, r := range []*http.Request{from("192.0.2.2", "/users"), from("192.0.2.1", "/health"), from("192.0.2.1", "/metrics"), from("192.0.2.1", "/users/events")} {
+		if rec := serve(h, r); rec.Code != http.StatusOK {
+			t.Errorf("%s %s while 192.0.2.1 is at its cap: status %d, want 200", r.RemoteAddr, r.URL.Path, rec.Code)
+		}
+	}
+
+	close(release)
+	wg.Wait()
+	if rec := serve(h, from("192.0.2.1", "/users")); rec.Code != http.StatusOK {
+		t.Errorf("after the slow requests finished: status %d, want 200", rec.Code)
+	}
+	us.ipMutex.Lock()
+	defer us.ipMutex.Unlock()
+	if len(us.ipInFlight) != 0 {
+		t.Errorf("idle IPs still tracked: %v", us.ipInFlight)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	// working behaves like the users table: the throwaway user reads back
+	// until it is soft-deleted. stillThere ignores the delete.
+	working := func(stillThere bool) func(q stubQuery) stubResult {
+		var deleted atomic.Bool
+		return func(q stubQuery) stubResult {
+			switch {
+			case strings.HasPrefix(q.sql, "INSERT INTO users"):
+				return scalarRow(int64(99))
+			case strings.HasPrefix(q.sql, "SELECT"):
+				if deleted.Load() && !stillThere {
+					return stubResult{columns: userFields}
+				}
+				return userRows(User{ID: "99", Username: "selftest_x", Active: true})
+			case strings.HasPrefix(q.sql, "UPDATE users SET deleted_at"):
+				deleted.Store(true)
+			}
+			return stubResult{affected: 1}
+		}
+	}
+	failAt := func(fragment string) func() func(q stubQuery) stubResult {
+		return func() func(q stubQuery) stubResult {
+			next := working(false)
+			return func(q stubQuery) stubResult {
+				if strings.HasPrefix(q.sql, fragment) {
+					return stubResult{err: errors.New("connection reset")}
+				}
+				return next(q)
+			}
+		}
+	}
+
+	tests := []struct {
+		name     string
+		handle   func() func(q stubQuery) stubResult
+		wantStep string
+	}{
+		{"working", func() func(q stubQuery) stubResult { return working(false) }, ""},
+		{"begin fails", failAt("BEGIN"), "begin"},
+		{"insert fails", failAt("INSERT"), "insert"},
+		{"select fails", failAt("SELECT"), "select"},
+		{"delete fails", failAt("UPDATE"), "delete"},
+		{"delete leaves the user", func() func(q stubQuery) stubResult { return working(true) }, "delete"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(t)
+			config.AdminToken = testAdminToken
+			us, stub := newTestService(t, config, tt.handle())
+			rec := serve(us.routes(), adminRequest(http.MethodGet, "/selftest", ""))
+
+			var body struct {
+				OK         bool               `json:"ok"`
+				FailedStep string             `json:"failed_step"`
+				Steps      map[string]float64 `json:"steps"`
+			}
+			decodeBody(t, rec, &body)
+			if tt.wantStep == "" {
+				if rec.Code != http.StatusOK || !body.OK {
+					t.Fatalf("status %d, body %s; want 200 ok", rec.Code, rec.Body)
+				}
+				for _, step := range []string{"begin", "insert", "select", "delete", "rollback"} {
+					if _, ok := body.Steps[step]; !ok {
+						t.Errorf("no timing for %s in %v", step, body.Steps)
+					}
+				}
+			} else {
+				if rec.Code != http.StatusServiceUnavailable || body.OK || body.FailedStep != tt.wantStep {
+					t.Errorf("status %d, body %s; want 503 failed at %s", rec.Code, rec.Body, tt.wantStep)
+				}
+				if rec.Header().Get("Retry-After") == "" {
+					t.Error("503 without Retry-After")
+				}
+			}
+			if stub.count("COMMIT") != 0 {
+				t.Error("self-test committed its throwaway row")
+			}
+			if tt.wantStep != "begin" && stub.count("ROLLBACK") != 1 {
+				t.Errorf("%d rollbacks, want 1", stub.count("ROLLBACK"))
+			}
+		})
+	}
+
+	config := testConfig(t)
+	config.AdminToken = testAdminToken
+	us, stub := newTestService(t, config, working(false))
+	if rec := serve(us.routes(), newRequest(http.MethodGet, "/selftest", "")); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without the admin token: status %d, want 401", rec.Code)
+	}
+	if stub.count("BEGIN") != 0 {
+		t.Error("unauthorized self-test touched the DB")
+	}
+}
+
+func usernameError(us *UserService, username string) string {
+	user := User{Username: username, Email: "someone@example.com"}
+	for _, err := range us.validateUserFields(&user, nil) {
+		if err.Field == "username" {
+			return err.Message
+		}
+	}
+	return ""
+}
+
+func TestReservedUsernames(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), nil)
+	for _, name := range []string{"admin", "Admin", "ROOT", "support"} {
+		if got := usernameError(us, name); got != "is reserved" {
+			t.Errorf("%q: error %q, want is reserved", name, got)
+		}
+	}
+	for _, name := range []string{"alice", "admin2", "rooted"} {
+		if got := usernameError(us, name); got != "" {
+			t.Errorf("%q: error %q, want none", name, got)
+		}
+	}
+
+	rec := serve(us.routes(), newRequest(http.MethodPost, "/users", `{"username":"Admin","email":"admin@example.com"}`))
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), `"is reserved"`) {
+		t.Errorf("creating Admin: status %d, body %s; want 422 with the reserved field error", rec.Code, rec.Body)
+	}
+
+	t.Setenv("RESERVED_USERNAMES", "Alice, bob")
+	us, _ = newTestService(t, testConfig(t), nil)
+	if usernameError(us, "alice") != "is reserved" || usernameError(us, "admin") != "" {
+		t.Error("RESERVED_USERNAMES did not replace the default list")
+	}
+
+	t.Setenv("RESERVED_USERNAMES", "")
+	us, _ = newTestService(t, testConfig(t), nil)
+	if got := usernameError(us, "admin"); got != "" {
+		t.Errorf("empty RESERVED_USERNAMES still rejects admin: %q", got)
+	}
+}
+
+func TestDebugCacheEntry(t *testing.T) {
+	config := testConfig(t)
+	config.AdminToken = testAdminToken
+	us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+		if strings.Contains(q.sql, "WHERE id = $1") && fmt.Sprint(q.args[0]) == "1" {
+			return userRows(User{ID: "1", Username: "alice", Email: "alice@example.com", Active: true})
+		}
+		return userRows()
+	})
+	h := us.routes()
+
+	if rec := serve(h, adminRequest(http.MethodGet, "/debug/cache/1", "")); rec.Code != http.StatusNotFound || errorCode(t, rec) != codeNotCached {
+		t.Errorf("before caching: status %d, body %s; want 404 %s", rec.Code, rec.Body, codeNotCached)
+	}
+
+	before := time.Now()
+	if rec := serve(h, newRequest(http.MethodGet, "/users/1", "")); rec.Code != http.StatusOK {
+		t.Fatalf("GET /users/1: status %d, body %s", rec.Code, rec.Body)
+	}
+	after := time.Now()
+
+	rec := serve(h, adminRequest(http.MethodGet, "/debug/cache/1", ""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+	}
+	var entry struct {
+		Cached       bool     `json:"cached"`
+		User         User     `json:"user"`
+		Stored       string   `json:"stored"`
+		AgeSeconds   float64  `json:"age_seconds"`
+		TTLRemaining *float64 `json:"ttl_remaining_seconds"`
+	}
+	decodeBody(t, rec, &entry)
+	if !entry.Cached || entry.User.ID != "1" || entry.User.Username != "alice" {
+		t.Errorf("entry = %+v, want alice cached", entry)
+	}
+	stored, err := time.Parse(time.RFC3339Nano, entry.Stored)
+	if err != nil || stored.Before(before) || stored.After(after) {
+		t.Errorf("stored = %q, want between %v and %v", entry.Stored, before, after)
+	}
+	if entry.AgeSeconds < 0 || entry.AgeSeconds > time.Since(before).Seconds() {
+		t.Errorf("age_seconds = %v", entry.AgeSeconds)
+	}
+	if entry.TTLRemaining != nil {
+		t.Errorf("ttl_remaining_seconds = %v, want null for the memory cache", *entry.TTLRemaining)
+	}
+
+	if rec := serve(h, newRequest(http.MethodGet, "/debug/cache/1", "")); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without the admin token: status %d, want 401", rec.Code)
+	}
+}
+
+func TestEmptyResultsEncodeAsArrays(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult { return userRows() })
+	h := us.routes()
+
+	for _, target := range []string{"/users?envelope=false", "/users?envelope=false&fields=username", "/users/search?q=zz", "/users/search?q=zz&fields=username"} {
+		rec := serve(h, newRequest(http.MethodGet, target, ""))
+		if got := strings.TrimSpace(rec.Body.String()); rec.Code != http.StatusOK || got != "[]" {
+			t.Errorf("%s: status %d, body %s; want 200 []", target, rec.Code, got)
+		}
+	}
+	for _, target := range []string{"/users?envelope=true", "/users?envelope=true&fields=username"} {
+		rec := serve(h, newRequest(http.MethodGet, target, ""))
+		var body map[string]json.RawMessage
+		decodeBody(t, rec, &body)
+		if string(body["data"]) != "[]" || string(body["count"]) != "0" {
+			t.Errorf("%s: body %s, want data [] and count 0", target, rec.Body)
+		}
+	}
+}
+
+func TestSearchFields(t *testing.T) {
+	users := []User{
+		{ID: "1", Username: "gopher", Email: "g@example.com", Bio: "", Active: true},
+		{ID: "2", Username: "alice", Email: "gopher@example.com", Bio: "", Active: true},
+		{ID: "3", Username: "bob", Email: "bob@example.com", Bio: "gopher at heart", Active: true},
+	}
+	// Match only on the columns the query actually names
+	handle := func(q stubQuery) stubResult {
+		if !strings.Contains(q.sql, "LIKE $1") {
+			return userRows()
+		}
+		term := strings.Trim(q.args[0].(string), "%")
+		var matched []User
+		for _, user := range users {
+			for field, value := range map[string]string{"username": user.Username, "email": user.Email, "bio": user.Bio} {
+				if strings.Contains(q.sql, "LOWER("+field+")") && strings.Contains(value, term) {
+					matched = append(matched, user)
+					break
+				}
+			}
+		}
+		return userRows(matched...)
+	}
+
+	tests := []struct {
+		fields string
+		want   []string
+	}{
+		{"", []string{"gopher", "alice", "bob"}},
+		{"username,email", []string{"gopher", "alice"}},
+		{"Username", []string{"gopher"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fields, func(t *testing.T) {
+			t.Setenv("SEARCH_FIELDS", tt.fields)
+			us, stub := newTestService(t, testConfig(t), handle)
+			rec := serve(us.routes(), newRequest(http.MethodGet, "/users/search?q=gopher", ""))
+			if got := usernames(t, rec); !slices.Equal(got, tt.want) {
+				t.Errorf("matches %v, want %v", got, tt.want)
+			}
+			if tt.fields != "" && stub.count("LOWER(bio)") != 0 {
+				t.Error("bio searched though SEARCH_FIELDS leaves it out")
+			}
+		})
+	}
+
+	config := testConfig(t)
+	config.SearchFields = []string{"username", "bio"}
+	us, _ := newTestService(t, config, nil)
+	where, orderBy, _ := us.searchFilter("gopher", true, true)
+	if strings.Contains(where, "bio") || strings.Contains(where, "email") || !strings.Contains(where, "similarity(username, $1) >= $2") {
+		t.Errorf("fuzzy where = %q, want username similarity only", where)
+	}
+	if orderBy != "ORDER BY GREATEST(similarity(username, $1)) DESC, id" {
+		t.Errorf("fuzzy order = %q", orderBy)
+	}
+}
+
+func TestServiceUnavailableSetsRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(us *UserService, stub *stubDB)
+		target string
+		code   string
+		want   string
+	}{
+		{"database down", func(us *UserService, stub *stubDB) { stub.setDown(errors.New("connection refused")) }, "/readyz", codeDatabaseUnavailable, "5"},
+		{"shutting down", func(us *UserService, stub *stubDB) { us.shuttingDown.Store(true) }, "/readyz", codeShuttingDown, "5"},
+		{"route disabled", func(us *UserService, stub *stubDB) {
+			us.disabledRoutes.Store(&map[string]bool{"/users/search": true})
+		}, "/users/search?q=al", codeRouteDisabled, "60"},
+		{"subscribers full", func(us *UserService, stub *stubDB) { us.events = newSSEHub(0, 1) }, "/users/events", codeTooManySubscribers, "5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us, stub := newTestService(t, testConfig(t), nil)
+			tt.setup(us, stub)
+			rec := serve(us.routes(), newRequest(http.MethodGet, tt.target, ""))
+			if rec.Code != http.StatusServiceUnavailable || errorCode(t, rec) != tt.code {
+				t.Fatalf("status %d, body %s; want 503 %s", rec.Code, rec.Body, tt.code)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.want {
+				t.Errorf("Retry-After = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for after, want := range map[time.Duration]string{0: "1", 200 * time.Millisecond: "1", 1500 * time.Millisecond: "2", time.Minute: "60"} {
+		rec := httptest.NewRecorder()
+		setRetryAfter(rec, after)
+		if got := rec.Header().Get("Retry-After"); got != want {
+			t.Errorf("setRetryAfter(%v) = %q, want %q", after, got, want)
+		}
+	}
+}
+
+func TestUserInputKeyAliases(t *testing.T) {
+	want := User{ID: "7", Username: "alice", Email: "alice@example.com", Created: "2024-01-02T03:04:05Z", Updated: "2024-02-03T04:05:06Z", Active: true}
+	for name, body := range map[string]string{
+		"canonical":  `{"id":7,"username":"alice","email":"alice@example.com","created":"2024-01-02T03:04:05Z","updated":"2024-02-03T04:05:06Z","active":true}`,
+		"snake_case": `{"id":7,"user_name":"alice","email":"alice@example.com","created_at":"2024-01-02T03:04:05Z","updated_at":"2024-02-03T04:05:06Z","is_active":true}`,
+		"camelCase":  `{"id":7,"userName":"alice","email":"alice@example.com","createdAt":"2024-01-02T03:04:05Z","updatedAt":"2024-02-03T04:05:06Z","isActive":true}`,
+	} {
+		var user User
+		if err := json.Unmarshal([]byte(body), &user); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if user != want {
+			t.Errorf("%s: decoded %+v, want %+v", name, user, want)
+		}
+	}
+
+	var user User
+	if err := json.Unmarshal([]byte(`{"username":"alice","user_name":"bob"}`), &user); err != nil || user.Username != "alice" {
+		t.Errorf("canonical next to alias: username %q, %v; want the canonical alice", user.Username, err)
+	}
+	if err := json.Unmarshal([]byte(`["alice"]`), &user); err == nil {
+		t.Error("non-object decoded into a User")
+	}
+
+	out, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, alias := range slices.Collect(maps.Keys(userKeyAliases)) {
+		if strings.Contains(string(out), `"`+alias+`"`) {
+			t.Errorf("output uses alias %s: %s", alias, out)
+		}
+	}
+
+	var patch UserPatch
+	if err := json.Unmarshal([]byte(`{"user_name":"bob"}`), &patch); err != nil || patch.Username == nil || *patch.Username != "bob" {
+		t.Errorf("patch with user_name decoded as %+v, %v", patch, err)
+	}
+}
+
+func TestMergePatchAcceptsAliases(t *testing.T) {
+	stored := User{ID: "1", Username: "alice", Email: "alice@example.com", Active: true}
+	var written []driver.Value
+	us, _ := newTestService(t, testConfig(t), patchStore(stored, &written))
+	r := withVars(newRequest(http.MethodPatch, "/users/1", `{"user_name":"alicia"}`), map[string]string{"id": "1"})
+	r.Header.Set("Content-Type", "application/merge-patch+json")
+	rec := serve(http.HandlerFunc(us.PatchUser), r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+	}
+	var user User
+	decodeBody(t, rec, &user)
+	if user.Username != "alicia" {
+		t.Errorf("username = %q, want alicia from user_name", user.Username)
+	}
+}
+
+// routeLabels returns the distinct path labels httpRequests has series for.
+func routeLabels(t *testing.T) map[string]bool {
+	t.Helper()
+	metrics := make(chan prometheus.Metric, 1024)
+	httpRequests.Collect(metrics)
+	close(metrics)
+	labels := map[string]bool{}
+	for m := range metrics {
+		var metric dto.Metric
+		if err := m.Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+		for _, pair := range metric.GetLabel() {
+			if pair.GetName() == "path" {
+				labels[pair.GetValue()] = true
+			}
+		}
+	}
+	return labels
+}
+
+func TestUnmatchedRoutesShareOneMetricLabel(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), nil)
+	h := us.routes()
+	notFound := httpRequests.WithLabelValues(unmatchedRouteLabel, "GET", "404")
+	notAllowed := httpRequests.WithLabelValues(unmatchedRouteLabel, "PUT", "405")
+	before, beforeNotAllowed := metricValue(t, notFound), metricValue(t, notAllowed)
+	labelsBefore := routeLabels(t)
+
+	const probes = 25
+	for i := range probes {
+		if rec := serve(h, newRequest(http.MethodGet, fmt.Sprintf("/wp-admin/%d/%x.php", i, i*7919), "")); rec.Code != http.StatusNotFound {
+			t.Fatalf("probe %d: status %d, want 404", i, rec.Code)
+		}
+	}
+	serve(h, newRequest(http.MethodPut, "/users", `{}`))
+
+	if got := metricValue(t, notFound) - before; got != probes {
+		t.Errorf("%s 404s = +%v, want +%d", unmatchedRouteLabel, got, probes)
+	}
+	if got := metricValue(t, notAllowed) - beforeNotAllowed; got != 1 {
+		t.Errorf("%s 405s = +%v, want +1", unmatchedRouteLabel, got)
+	}
+	labels := routeLabels(t)
+	if !labels[unmatchedRouteLabel] {
+		t.Fatalf("no %s series among %v", unmatchedRouteLabel, labels)
+	}
+	for label := range labels {
+		if !labelsBefore[label] && label != unmatchedRouteLabel {
+			t.Errorf("unmatched request created route label %q", label)
+		}
+	}
+}
+
+// countingCache records how a handler writes to the cache it wraps.
+type countingCache struct {
+	Cache
+	mutex                           sync.Mutex
+	sets, deletes, setMany, delMany int
+	deleted                         []UserID
+}
+
+func (c *countingCache) Set(user *User) {
+	c.mutex.Lock()
+	c.sets++
+	c.mutex.Unlock()
+	c.Cache.Set(user)
+}
+
+func (c *countingCache) Delete(id UserID) {
+	c.mutex.Lock()
+	c.deletes++
+	c.mutex.Unlock()
+	c.Cache.Delete(id)
+}
+
+func (c *countingCache) SetMany(users []User) {
+	c.mutex.Lock()
+	c.setMany++
+	c.mutex.Unlock()
+	c.Cache.SetMany(users)
+}
+
+func (c *countingCache) DeleteMany(ids []UserID) {
+	c.mutex.Lock()
+	c.delMany++
+	c.deleted = append(c.deleted, ids...)
+	c.mutex.Unlock()
+	c.Cache.DeleteMany(ids)
+}
+
+func TestUpdateBatchInvalidatesInOneCall(t *testing.T) {
+	stored := map[string]User{}
+	for i := 1; i <= 4; i++ {
+		id := strconv.Itoa(i)
+		stored[id] = User{ID: UserID(id), Username: "user" + id, Email: "user" + id + "@example.com", Active: true}
+	}
+	config := testConfig(t)
+	config.AdminToken = testAdminToken
+	us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+		switch {
+		case strings.Contains(q.sql, "FOR UPDATE"):
+			if user, ok := stored[fmt.Sprint(q.args[0])]; ok {
+				return userRows(user)
+			}
+			return stubResult{columns: userFields}
+		case strings.HasPrefix(q.sql, "UPDATE users SET username=$1"):
+			updated := stored[fmt.Sprint(q.args[3])]
+			updated.Bio = q.args[2].(string)
+			return userRows(updated)
+		}
+		return stubResult{}
+	})
+	cache := &countingCache{Cache: us.cache}
+	us.cache = cache
+	for _, user := range stored {
+		us.cache.Set(&user)
+	}
+	cache.sets = 0
+
+	body := `[{"id": "1", "fields": {"bio": "a"}}, {"id": "2", "fields": {"bio": "b"}}, {"id": "99", "fields": {"bio": "c"}}, {"id": "3", "fields": {"bio": "d"}}]`
+	if rec := serve(us.routes(), adminRequest(http.MethodPost, "/users/update-batch", body)); rec.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+	}
+	if cache.delMany != 1 || cache.deletes != 0 || cache.sets != 0 {
+		t.Errorf("%d DeleteMany, %d Delete, %d Set calls; want one DeleteMany", cache.delMany, cache.deletes, cache.sets)
+	}
+	if want := []UserID{"1", "2", "3"}; !slices.Equal(cache.deleted, want) {
+		t.Errorf("invalidated %v, want %v", cache.deleted, want)
+	}
+	for _, id := range []UserID{"1", "2", "3"} {
+		if _, ok := us.cache.Get(id); ok {
+			t.Errorf("updated user %s still cached", id)
+		}
+	}
+	if _, ok := us.cache.Get("4"); !ok {
+		t.Error("untouched user 4 evicted")
+	}
+}
+
+func TestMemoryCacheSetManyDeleteMany(t *testing.T) {
+	mc := newMemoryCache(0)
+	users := []User{{ID: "1", Username: "alice"}, {ID: "2", Username: "bob"}, {ID: "3", Username: "carol"}}
+	mc.SetMany(users)
+	users[0].Username = "mallory"
+	if got, ok := mc.Get("1"); !ok || got.Username != "alice" {
+		t.Errorf("Get(1) = %+v, %v; SetMany must copy its input", got, ok)
+	}
+	if mc.Len() != 3 {
+		t.Errorf("Len = %d, want 3", mc.Len())
+	}
+
+	mc.DeleteMany([]UserID{"1", "3", "404"})
+	if mc.Len() != 1 {
+		t.Errorf("Len = %d after deleting two, want 1", mc.Len())
+	}
+	if _, ok := mc.Get("2"); !ok {
+		t.Error("user 2 deleted though not listed")
+	}
+	mc.DeleteMany([]UserID{"2"})
+	if mc.bytes != 0 {
+		t.Errorf("bytes = %d with the cache empty, want 0", mc.bytes)
+	}
+
+	// A SetMany over the byte budget keeps the most recently stored users
+	one := entrySize(&User{ID: "1", Username: "alice"})
+	small := newMemoryCache(2 * one)
+	small.SetMany([]User{{ID: "1", Username: "alice"}, {ID: "2", Username: "bobby"}, {ID: "3", Username: "carol"}})
+	if _, ok := small.Get("1"); ok || small.Len() != 2 {
+		t.Errorf("Len = %d, user 1 cached %v; want the oldest evicted", small.Len(), ok)
+	}
+}
+
+func BenchmarkCacheBulkInvalidation(b *testing.B) {
+	const batch = 100
+	users := make([]User, batch)
+	ids := make([]UserID, batch)
+	for i := range users {
+		ids[i] = UserID(strconv.Itoa(i + 1))
+		users[i] = User{ID: ids[i], Username: "user" + string(ids[i]), Email: "user" + string(ids[i]) + "@example.com"}
+	}
+
+	b.Run("Delete", func(b *testing.B) {
+		mc := newMemoryCache(0)
+		for b.Loop() {
+			for i := range users {
+				mc.Set(&users[i])
+			}
+			for _, id := range ids {
+				mc.Delete(id)
+			}
+		}
+	})
+	b.Run("DeleteMany", func(b *testing.B) {
+		mc := newMemoryCache(0)
+		for b.Loop() {
+			mc.SetMany(users)
+			mc.DeleteMany(ids)
+		}
+	})
+}
+
+func TestReadinessFailsAsSoonAsShutdownBegins(t *testing.T) {
+	config := testConfig(t)
+	config.ShutdownDelay = 300 * time.Millisecond
+	us, _ := newTestService(t, config, nil)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.Handle("/", us.routes())
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + listener.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- us.run(ctx, us.newServer(mux), listener) }()
+
+	ready := func() int {
+		resp, err := http.Get(base + "/readyz")
+		if err != nil {
+			t.Fatalf("readiness probe: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := ready(); status != http.StatusOK {
+		t.Fatalf("readiness before shutdown = %d, want 200", status)
+	}
+
+	slow := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(base + "/slow")
+		if err != nil {
+			t.Errorf("in-flight request: %v", err)
+			slow <- 0
+			return
+		}
+		resp.Body.Close()
+		slow <- resp.StatusCode
+	}()
+	<-started
+
+	signalled := time.Now()
+	cancel()
+	for ready() != http.StatusServiceUnavailable {
+		if time.Since(signalled) > config.ShutdownDelay {
+			t.Fatal("readiness still passing after SHUTDOWN_READINESS_DELAY")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	close(release)
+	if status := <-slow; status != http.StatusOK {
+		t.Errorf("in-flight request status = %d, want 200", status)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if elapsed := time.Since(signalled); elapsed < config.ShutdownDelay {
+		t.Errorf("shutdown finished after %v, before SHUTDOWN_READINESS_DELAY", elapsed)
+	}
+}
+
+func TestSearchStreamTruncatesAtMaxDuration(t *testing.T) {
+	var matches []User
+	for i := 1; i <= 10; i++ {
+		matches = append(matches, User{ID: UserID(strconv.Itoa(i)), Username: fmt.Sprintf("user%02d", i), Active: true})
+	}
+	stream := func(t *testing.T, rowDelay, maxDuration time.Duration) ([]string, context.Context) {
+		config := testConfig(t)
+		config.SearchMaxDuration = maxDuration
+		var queryCtx context.Context
+		us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+			if !strings.Contains(q.sql, "LIKE $1") {
+				return userRows()
+			}
+			queryCtx = q.ctx
+			result := userRows(matches...)
+			result.rowDelay = rowDelay
+			return result
+		})
+		r := newRequest(http.MethodGet, "/users/search?q=user", "")
+		r.Header.Set("Accept", "application/x-ndjson")
+		rec := serve(us.routes(), r)
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+			t.Fatalf("status %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+		}
+		return strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n"), queryCtx
+	}
+
+	t.Run("slow query", func(t *testing.T) {
+		lines, queryCtx := stream(t, 20*time.Millisecond, 70*time.Millisecond)
+		if len(lines) < 2 || len(lines) > len(matches) {
+			t.Fatalf("got %d lines, want some matches then the marker: %q", len(lines), lines)
+		}
+		if last := lines[len(lines)-1]; last != `{"truncated":true}` {
+			t.Errorf("last line = %q, want the truncated marker", last)
+		}
+		for _, line := range lines[:len(lines)-1] {
+			var user User
+			if err := json.Unmarshal([]byte(line), &user); err != nil || user.Username == "" {
+				t.Errorf("line %q isn't a user: %v", line, err)
+			}
+		}
+		if !errors.Is(queryCtx.Err(), context.DeadlineExceeded) {
+			t.Errorf("query context err = %v, want it cancelled at the deadline", queryCtx.Err())
+		}
+	})
+
+	t.Run("fast query", func(t *testing.T) {
+		lines, _ := stream(t, 0, time.Second)
+		if len(lines) != len(matches) {
+			t.Fatalf("got %d lines, want all %d matches: %q", len(lines), len(matches), lines)
+		}
+		for _, line := range lines {
+			if strings.Contains(line, "truncated") {
+				t.Errorf("complete stream has a marker: %q", line)
+			}
+		}
+	})
+}
+
+func TestDebugSchemaReportsAppliedMigrations(t *testing.T) {
+	appliedAt := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	// Everything but the last migration, as when an optional one failed
+	recorded := migrations[:len(migrations)-1]
+	config := testConfig(t)
+	config.AdminToken = testAdminToken
+	us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+		if !strings.Contains(q.sql, "FROM schema_migrations") {
+			return stubResult{}
+		}
+		result := stubResult{columns: []string{"version", "name", "applied_at"}}
+		for _, m := range recorded {
+			result.rows = append(result.rows, []driver.Value{int64(m.version), m.name, appliedAt})
+		}
+		return result
+	})
+
+	rec := serve(us.routes(), adminRequest(http.MethodGet, "/debug/schema", ""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+	}
+	var body struct {
+		Current int `json:"current_version"`
+		Latest  int `json:"latest_version"`
+		Applied []struct {
+			Version   int    `json:"version"`
+			Name      string `json:"name"`
+			AppliedAt string `json:"applied_at"`
+		} `json:"applied"`
+		Pending []string `json:"pending"`
+	}
+	decodeBody(t, rec, &body)
+
+	last := migrations[len(migrations)-1]
+	if body.Current != recorded[len(recorded)-1].version || body.Latest != last.version {
+		t.Errorf("current %d latest %d, want %d and %d", body.Current, body.Latest, recorded[len(recorded)-1].version, last.version)
+	}
+	if len(body.Applied) != len(recorded) {
+		t.Fatalf("%d applied, want %d: %s", len(body.Applied), len(recorded), rec.Body)
+	}
+	for i, m := range recorded {
+		got := body.Applied[i]
+		if got.Version != m.version || got.Name != m.name || got.AppliedAt != "2024-05-06T07:08:09Z" {
+			t.Errorf("applied[%d] = %+v, want %04d_%s at 2024-05-06T07:08:09Z", i, got, m.version, m.name)
+		}
+	}
+	if want := []string{fmt.Sprintf("%04d_%s", last.version, last.name)}; !slices.Equal(body.Pending, want) {
+		t.Errorf("pending = %v, want %v", body.Pending, want)
+	}
+
+	if rec := serve(us.routes(), newRequest(http.MethodGet, "/debug/schema", "")); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without the admin token: status %d, want 401", rec.Code)
+	}
+}
+
+// migrationDB is a stub schema_migrations table. Each migration file run is
+// recorded in ran, and fail makes the file with that version fail.
+type migrationDB struct {
+	mutex    sync.Mutex
+	recorded map[int64]bool
+	ran      []string
+	fail     int
+}
+
+func (m *migrationDB) handle(q stubQuery) stubResult {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	switch {
+	case strings.Contains(q.sql, "CREATE TABLE IF NOT EXISTS schema_migrations"),
+		strings.Contains(q.sql, "pg_advisory"), strings.Contains(q.sql, "statement_timeout"),
+		q.sql == "BEGIN", q.sql == "COMMIT", q.sql == "ROLLBACK":
+		return stubResult{}
+	case q.sql == "SELECT version FROM schema_migrations":
+		result := stubResult{columns: []string{"version"}}
+		for _, version := range slices.Sorted(maps.Keys(m.recorded)) {
+			result.rows = append(result.rows, []driver.Value{version})
+		}
+		return result
+	case strings.HasPrefix(q.sql, "INSERT INTO schema_migrations"):
+		m.recorded[q.args[0].(int64)] = true
+		return stubResult{affected: 1}
+	}
+	for _, mig := range migrations {
+		if q.sql == strings.ReplaceAll(mig.sql, "{{id_column}}", "id SERIAL PRIMARY KEY") ||
+			q.sql == strings.ReplaceAll(mig.sql, "{{id_column}}", "id UUID PRIMARY KEY DEFAULT gen_random_uuid()") {
+			m.ran = append(m.ran, fmt.Sprintf("%04d_%s", mig.version, mig.name))
+			if mig.version == m.fail {
+				return stubResult{err: errors.New("migration failed")}
+			}
+			return stubResult{}
+		}
+	}
+	return stubResult{err: fmt.Errorf("unexpected statement %q", q.sql)}
+}
+
+func migrationNames(from int) []string {
+	var names []string
+	for _, m := range migrations {
+		if m.version >= from {
+			names = append(names, fmt.Sprintf("%04d_%s", m.version, m.name))
+		}
+	}
+	return names
+}
+
+func TestRunMigrations(t *testing.T) {
+	ctx := context.Background()
+	open := func(t *testing.T, m *migrationDB) (*sql.DB, *stubDB) {
+		stub := &stubDB{handle: m.handle}
+		db := sql.OpenDB(stub)
+		t.Cleanup(func() { db.Close() })
+		return db, stub
+	}
+
+	t.Run("fresh database then re-run", func(t *testing.T) {
+		m := &migrationDB{recorded: map[int64]bool{}}
+		db, stub := open(t, m)
+		if err := runMigrations(ctx, db, idTypeInteger); err != nil {
+			t.Fatalf("runMigrations: %v", err)
+		}
+		if want := migrationNames(0); !slices.Equal(m.ran, want) {
+			t.Errorf("ran %v, want every migration in order %v", m.ran, want)
+		}
+		if len(m.recorded) != len(migrations) {
+			t.Errorf("%d recorded, want %d", len(m.recorded), len(migrations))
+		}
+		if n := stub.count("COMMIT"); n != len(migrations) {
+			t.Errorf("%d commits, want one per migration", n)
+		}
+
+		m.ran = nil
+		stub.reset()
+		if err := runMigrations(ctx, db, idTypeInteger); err != nil {
+			t.Fatalf("re-run: %v", err)
+		}
+		if len(m.ran) != 0 || stub.count("INSERT INTO schema_migrations") != 0 {
+			t.Errorf("re-run applied %v, want a no-op", m.ran)
+		}
+	})
+
+	t.Run("lock wait outlives statement_timeout", func(t *testing.T) {
+		m := &migrationDB{recorded: map[int64]bool{}}
+		db, stub := open(t, m)
+		if err := runMigrations(ctx, db, idTypeInteger); err != nil {
+			t.Fatalf("runMigrations: %v", err)
+		}
+		// A second instance queues on the advisory lock for as long as the
+		// first one's migrations take, the pooled connection gets its
+		// timeout back afterwards
+		queries := strings.Join(stub.queries, "\n")
+		unbounded := strings.Index(queries, "SET statement_timeout = 0")
+		lock := strings.Index(queries, "pg_advisory_lock")
+		unlock := strings.Index(queries, "pg_advisory_unlock")
+		reset := strings.Index(queries, "RESET statement_timeout")
+		if unbounded < 0 || !(unbounded < lock && lock < unlock && unlock < reset) {
+			t.Errorf("queries = %q, want the lock held between lifting and restoring statement_timeout", stub.queries)
+		}
+	})
+
+	t.Run("partly migrated", func(t *testing.T) {
+		m := &migrationDB{recorded: map[int64]bool{1: true, 2: true, 3: true}}
+		db, _ := open(t, m)
+		if err := runMigrations(ctx, db, idTypeInteger); err != nil {
+			t.Fatalf("runMigrations: %v", err)
+		}
+		if want := migrationNames(4); !slices.Equal(m.ran, want) {
+			t.Errorf("ran %v, want only the missing %v", m.ran, want)
+		}
+	})
+
+	t.Run("uuid id column", func(t *testing.T) {
+		m := &migrationDB{recorded: map[int64]bool{}}
+		db, stub := open(t, m)
+		if err := runMigrations(ctx, db, idTypeUUID); err != nil {
+			t.Fatalf("runMigrations: %v", err)
+		}
+		if stub.count("id UUID PRIMARY KEY DEFAULT gen_random_uuid()") != 1 || stub.count("{{id_column}}") != 0 {
+			t.Error("users table not created with a UUID id")
+		}
+	})
+
+	t.Run("optional migration fails", func(t *testing.T) {
+		var optional migration
+		for _, m := range migrations {
+			if m.optional {
+				optional = m
+				break
+			}
+		}
+		m := &migrationDB{recorded: map[int64]bool{}, fail: optional.version}
+		db, _ := open(t, m)
+		if err := runMigrations(ctx, db, idTypeInteger); err != nil {
+			t.Fatalf("runMigrations: %v, want optional failures tolerated", err)
+		}
+		if m.recorded[int64(optional.version)] {
+			t.Error("failed optional migration recorded as applied")
+		}
+		if len(m.recorded) != len(migrations)-1 {
+			t.Errorf("%d recorded, want every other migration", len(m.recorded))
+		}
+	})
+
+	t.Run("required migration fails", func(t *testing.T) {
+		m := &migrationDB{recorded: map[int64]bool{}, fail: 2}
+		db, stub := open(t, m)
+		err := runMigrations(ctx, db, idTypeInteger)
+		if err == nil || !strings.Contains(err.Error(), migrationNames(2)[0]) {
+			t.Fatalf("runMigrations = %v, want an error naming %s", err, migrationNames(2)[0])
+		}
+		if !slices.Equal(slices.Sorted(maps.Keys(m.recorded)), []int64{1}) {
+			t.Errorf("recorded %v, want only the migration before the failure", m.recorded)
+		}
+		if len(m.ran) != 2 || stub.count("ROLLBACK") == 0 {
+			t.Errorf("ran %v, want the runner to stop and roll back at the failure", m.ran)
+		}
+	})
+}
+
+func TestUsersByIDChunksLargeLists(t *testing.T) {
+	config := testConfig(t)
+	config.IDChunkSize = 3
+	var mutex sync.Mutex
+	var chunks [][]string
+	us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+		if !strings.Contains(q.sql, "ANY($1)") {
+			return stubResult{}
+		}
+		ids := strings.Split(strings.Trim(q.args[0].(string), "{}"), ",")
+		mutex.Lock()
+		chunks = append(chunks, ids)
+		mutex.Unlock()
+		var found []User
+		for _, id := range ids {
+			// Even IDs don't exist
+			if n, _ := strconv.Atoi(strings.Trim(id, `"`)); n%2 == 1 {
+				found = append(found, User{ID: UserID(strconv.Itoa(n)), Username: "user" + strconv.Itoa(n), Active: true})
+			}
+		}
+		return userRows(found...)
+	})
+
+	var ids []UserID
+	for i := 1; i <= 8; i++ {
+		ids = append(ids, UserID(strconv.Itoa(i)))
+	}
+	users, err := us.usersByID(context.Background(), ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 3 {
+		t.Fatalf("8 IDs in chunks of 3 ran %d queries, want 3: %v", len(chunks), chunks)
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > config.IDChunkSize {
+			t.Errorf("query %d sent %d IDs, over ID_CHUNK_SIZE", i, len(chunk))
+		}
+	}
+	var got []UserID
+	for _, user := range users {
+		got = append(got, user.ID)
+	}
+	if want := []UserID{"1", "3", "5", "7"}; !slices.Equal(got, want) {
+		t.Errorf("merged result %v, want %v", got, want)
+	}
+
+	t.Setenv("ID_CHUNK_SIZE", "250")
+	if got := testConfig(t).IDChunkSize; got != 250 {
+		t.Errorf("ID_CHUNK_SIZE=250 loaded as %d", got)
+	}
+}
+
+func TestSearchUsersRejectsWildcardOnlyTerms(t *testing.T) {
+	for _, term := range []string{"", "   ", "%", "%%", "_", "% _", "*", "??"} {
+		us, stub := newTestService(t, testConfig(t), nil)
+		rec := serve(us.routes(), newRequest(http.MethodGet, "/users/search?q="+url.QueryEscape(term), ""))
+		if rec.Code != http.StatusBadRequest || errorCode(t, rec) != codeInvalidSearch {
+			t.Errorf("q=%q: status %d, body %s; want 400 %s", term, rec.Code, rec.Body, codeInvalidSearch)
+		}
+		if stub.count("FROM users") != 0 {
+			t.Errorf("q=%q reached the database", term)
+		}
+	}
+
+	for term, want := range map[string]string{"alice": "%alice%", "  al  ": "%al%", "50%off": `%50\%off%`} {
+		var pattern driver.Value
+		us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+			if strings.Contains(q.sql, "LIKE $1") {
+				pattern = q.args[0]
+			}
+			return userRows()
+		})
+		rec := serve(us.routes(), newRequest(http.MethodGet, "/users/search?q="+url.QueryEscape(term), ""))
+		if rec.Code != http.StatusOK {
+			t.Errorf("q=%q: status %d, body %s; want 200", term, rec.Code, rec.Body)
+		}
+		if pattern != want {
+			t.Errorf("q=%q searched for %q, want %q", term, pattern, want)
+		}
+	}
+}
+
+func TestRouteTimeouts(t *testing.T) {
+	config := testConfig(t)
+	config.RequestTimeout = 50 * time.Millisecond
+	config.SlowRouteTimeout = 5 * time.Second
+	us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+		result := userRows(alice)
+		result.rowDelay = 200 * time.Millisecond
+		return result
+	})
+	handler := us.routes()
+
+	for _, target := range []string{"/users/1", "/users"} {
+		rec := serve(handler, newRequest(http.MethodGet, target, ""))
+		if rec.Code != http.StatusServiceUnavailable || errorCode(t, rec) != codeQueryTimeout {
+			t.Errorf("GET %s: status %d, body %s; want 503 %s", target, rec.Code, rec.Body, codeQueryTimeout)
+		}
+		if rec.Header().Get("Retry-After") == "" {
+			t.Errorf("GET %s: 503 without Retry-After", target)
+		}
+	}
+
+	// Search runs under SLOW_ROUTE_TIMEOUT, so the same slow query finishes
+	rec := serve(handler, newRequest(http.MethodGet, "/users/search?q=alice", ""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("search: status %d, body %s; want 200", rec.Code, rec.Body)
+	}
+	if got := usernames(t, rec); !slices.Equal(got, []string{"alice"}) {
+		t.Errorf("search returned %v, want [alice]", got)
+	}
+}
+
+func TestHandlersQueryWithRequestContext(t *testing.T) {
+	config := testConfig(t)
+	config.RequestTimeout = time.Minute
+	config.DuplicatePrecheck = true
+	config.AdminToken = testAdminToken
+	config.WebhookURL = "http://127.0.0.1:1/hook"
+
+	var mutex sync.Mutex
+	var unbounded []string
+	inserting := insertingStore()
+	us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+		if _, ok := q.ctx.Deadline(); !ok && !slices.Contains([]string{"BEGIN", "COMMIT", "ROLLBACK"}, q.sql) {
+			mutex.Lock()
+			unbounded = append(unbounded, strings.Join(strings.Fields(q.sql), " "))
+			mutex.Unlock()
+		}
+		switch {
+		case strings.Contains(q.sql, "date_trunc"), strings.Contains(q.sql, "FROM webhook_deliveries"):
+			return userRows()
+		case strings.Contains(q.sql, "COUNT(*)"):
+			return scalarRow(int64(1))
+		case strings.Contains(q.sql, "SELECT EXISTS"):
+			return scalarRow(true)
+		case strings.Contains(q.sql, "SET deleted_at"), strings.Contains(q.sql, "SAVEPOINT"),
+			strings.Contains(q.sql, "INSERT INTO webhook_deliveries"):
+			return stubResult{affected: 1}
+		case strings.Contains(q.sql, "INSERT INTO users"), strings.Contains(q.sql, "CASE WHEN"):
+			return inserting(q)
+		}
+		return userRows(alice)
+	})
+	handler := us.routes()
+
+	user := `{"username":"alice","email":"alice@example.com","bio":"hello"}`
+	for _, tc := range []struct {
+		method, target, body, accept string
+		want                         int
+	}{
+		{http.MethodPost, "/users", user, "", http.StatusCreated},
+		{http.MethodGet, "/users/1", "", "", http.StatusOK},
+		{http.MethodGet, "/users", "", "", http.StatusOK},
+		{http.MethodGet, "/users?verified=true", "", "", http.StatusOK},
+		{http.MethodPut, "/users/1", user, "", http.StatusOK},
+		{http.MethodPatch, "/users/1", `{"bio":"patched"}`, "", http.StatusOK},
+		{http.MethodGet, "/users/search?q=alice", "", "", http.StatusOK},
+		{http.MethodGet, "/users/search?q=alice&count_only=true", "", "", http.StatusOK},
+		{http.MethodGet, "/users/search?q=alice", "", "application/x-ndjson", http.StatusOK},
+		{http.MethodGet, "/users/1/exists", "", "", http.StatusOK},
+		{http.MethodPut, "/users/1/bio", `{"bio":"hi"}`, "", http.StatusOK},
+		{http.MethodPost, "/users/1/deactivate", "", "", http.StatusOK},
+		{http.MethodPost, "/users/1/activate", "", "", http.StatusOK},
+		{http.MethodPost, "/users/update-batch", `[{"id":"1","fields":{"bio":"batched"}}]`, "", http.StatusOK},
+		{http.MethodGet, "/users/signups", "", "", http.StatusOK},
+		{http.MethodPost, "/cache/preload", `["1"]`, "", http.StatusOK},
+		{http.MethodGet, "/webhooks/deliveries", "", "", http.StatusOK},
+		{http.MethodDelete, "/users/1", "", "", http.StatusNoContent},
+	} {
+		us.cache.Delete("1")
+		req := adminRequest(tc.method, tc.target, tc.body)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		rec := serve(handler, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s %s: status %d, body %s; want %d", tc.method, tc.target, rec.Code, rec.Body, tc.want)
+		}
+	}
+	if len(unbounded) > 0 {
+		t.Errorf("queries run without the request's deadline:\n%s", strings.Join(unbounded, "\n"))
+	}
+}
+
+func TestLoadUserOutlivesCancelledCaller(t *testing.T) {
+	started := make(chan context.Context, 1)
+	release := make(chan struct{})
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		if !strings.Contains(q.sql, "WHERE id = $1") {
+			return userRows()
+		}
+		started <- q.ctx
+		select {
+		case <-release:
+			return userRows(alice)
+		case <-q.ctx.Done():
+			return stubResult{err: q.ctx.Err()}
+		}
+	})
+	handler := us.routes()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- serve(handler, newRequest(http.MethodGet, "/users/1", "").WithContext(ctx)) }()
+	queryCtx := <-started
+
+	cancel()
+	if rec := <-first; rec.Code != http.StatusServiceUnavailable || errorCode(t, rec) != codeRequestCancelled {
+		t.Errorf("cancelled caller: status %d, body %s; want 503 %s", rec.Code, rec.Body, codeRequestCancelled)
+	}
+	if err := queryCtx.Err(); err != nil {
+		t.Fatalf("shared query was cancelled with its first caller: %v", err)
+	}
+
+	second := make(chan *httptest.ResponseRecorder)
+	go func() { second <- serve(handler, newRequest(http.MethodGet, "/users/1", "")) }()
+	close(release)
+	if rec := <-second; rec.Code != http.StatusOK {
+		t.Errorf("second caller: status %d, body %s; want 200", rec.Code, rec.Body)
+	}
+	if _, ok := us.cache.Get("1"); !ok {
+		t.Error("the shared query's result wasn't cached")
+	}
+}
+
+func TestStatementTimeoutAnswers503(t *testing.T) {
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		return stubResult{err: &pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"}}
+	})
+	rec := serve(us.routes(), newRequest(http.MethodGet, "/users/1", ""))
+	if rec.Code != http.StatusServiceUnavailable || errorCode(t, rec) != codeQueryTimeout {
+		t.Errorf("status %d, body %s; want 503 %s", rec.Code, rec.Body, codeQueryTimeout)
+	}
+
+	config := testConfig(t)
+	config.AdminToken = testAdminToken
+	us, _ = newTestService(t, config, func(q stubQuery) stubResult {
+		return stubResult{err: &pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"}}
+	})
+	handler := us.routes()
+	for _, tc := range []struct{ method, target, body, accept string }{
+		{http.MethodGet, "/users/1/exists", "", ""},
+		{http.MethodPut, "/users/1/bio", `{"bio":"hi"}`, ""},
+		{http.MethodPost, "/users/1/deactivate", "", ""},
+		{http.MethodPatch, "/users/1", `{"bio":"patched"}`, ""},
+		{http.MethodPost, "/users/update-batch", `[{"id":"1","fields":{"bio":"batched"}}]`, ""},
+		{http.MethodGet, "/users/signups", "", ""},
+		{http.MethodGet, "/users/search?q=alice", "", "application/x-ndjson"},
+		{http.MethodPost, "/cache/preload", `["1"]`, ""},
+		{http.MethodGet, "/webhooks/deliveries", "", ""},
+	} {
+		req := adminRequest(tc.method, tc.target, tc.body)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		rec := serve(handler, req)
+		if rec.Code != http.StatusServiceUnavailable || errorCode(t, rec) != codeQueryTimeout {
+			t.Errorf("%s %s: status %d, body %s; want 503 %s", tc.method, tc.target, rec.Code, rec.Body, codeQueryTimeout)
+		}
+	}
+
+	us, _ = newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		return stubResult{err: errors.New("connection reset")}
+	})
+	rec = serve(us.routes(), newRequest(http.MethodGet, "/users/1", ""))
+	if rec.Code != http.StatusInternalServerError || errorCode(t, rec) != codeDatabaseError {
+		t.Errorf("status %d, body %s; want 500 %s", rec.Code, rec.Body, codeDatabaseError)
+	}
+}
+
+// loadConfigExits runs loadConfig in a child test process with env added,
+// reporting whether it exited and what it logged. The calling test must
+// call it first thing, the child runs the same test and stops there.
+func loadConfigExits(t *testing.T, env ...string) (bool, string) {
+	t.Helper()
+	if os.Getenv("LOAD_CONFIG_CHILD") == "1" {
+		loadConfig()
+		os.Exit(0)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$")
+	cmd.Env = append(os.Environ(), append(env, "LOAD_CONFIG_CHILD=1")...)
+	output, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatal(err)
+	}
+	return err != nil, string(output)
+}
+
+func TestStatementTimeoutDefaults(t *testing.T) {
+	for _, tc := range []struct {
+		env  map[string]string
+		want time.Duration
+	}{
+		{nil, 2 * time.Minute},
+		{map[string]string{"REQUEST_TIMEOUT": "5m"}, 5 * time.Minute},
+		{map[string]string{"SLOW_ROUTE_TIMEOUT": "10m"}, 10 * time.Minute},
+		{map[string]string{"STATEMENT_TIMEOUT": "3m"}, 3 * time.Minute},
+		{map[string]string{"STATEMENT_TIMEOUT": "0"}, 0},
+	} {
+		t.Run(fmt.Sprint(tc.env), func(t *testing.T) {
+			for name, value := range tc.env {
+				t.Setenv(name, value)
+			}
+			if got := loadConfig().StatementTimeout; got != tc.want {
+				t.Errorf("StatementTimeout = %s, want %s", got, tc.want)
+			}
+		})
+	}
+
+	if got := statementTimeoutOption(90 * time.Second); got != " statement_timeout=90000" {
+		t.Errorf("option for 90s = %q, want statement_timeout in milliseconds", got)
+	}
+	if got := statementTimeoutOption(0); got != "" {
+		t.Errorf("option for 0 = %q, want none", got)
+	}
+}
+
+func TestStatementTimeoutBelowRouteTimeoutIsFatal(t *testing.T) {
+	exited, output := loadConfigExits(t, "STATEMENT_TIMEOUT=30s", "SLOW_ROUTE_TIMEOUT=2m")
+	if !exited || !strings.Contains(output, "Invalid STATEMENT_TIMEOUT") {
+		t.Errorf("STATEMENT_TIMEOUT under SLOW_ROUTE_TIMEOUT: exited %t, output %q; want a fatal error", exited, output)
+	}
+	if exited, output := loadConfigExits(t, "STATEMENT_TIMEOUT=2m", "SLOW_ROUTE_TIMEOUT=2m"); exited {
+		t.Errorf("STATEMENT_TIMEOUT equal to SLOW_ROUTE_TIMEOUT exited: %s", output)
+	}
+}
+
+// serverTiming parses a Server-Timing header into durations by metric name.
+func serverTiming(t *testing.T, header string) map[string]time.Duration {
+	t.Helper()
+	metrics := make(map[string]time.Duration)
+	for _, part := range strings.Split(header, ",") {
+		name, dur, ok := strings.Cut(strings.TrimSpace(part), ";dur=")
+		ms, err := strconv.ParseFloat(dur, 64)
+		if !ok || err != nil {
+			t.Fatalf("Server-Timing %q: malformed metric %q", header, part)
+		}
+		metrics[name] = time.Duration(ms * float64(time.Millisecond))
+	}
+	return metrics
+}
+
+func TestServerTimingHeader(t *testing.T) {
+	const queryTime = 20 * time.Millisecond
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		result := userRows(alice)
+		result.rowDelay = queryTime
+		return result
+	})
+	handler := us.routes()
+
+	rec := serve(handler, newRequest(http.MethodGet, "/users/1", ""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s; want 200", rec.Code, rec.Body)
+	}
+	miss := serverTiming(t, rec.Header().Get("Server-Timing"))
+	if len(miss) != 3 {
+		t.Errorf("metrics = %v, want db, cache and total", miss)
+	}
+	if miss["db"] < queryTime {
+		t.Errorf("db = %s, want at least the %s query", miss["db"], queryTime)
+	}
+	if miss["total"] < miss["db"]+miss["cache"] {
+		t.Errorf("total %s is less than db %s plus cache %s", miss["total"], miss["db"], miss["cache"])
+	}
+
+	// The lookup is cached now, so the next one never reaches the DB
+	hit := serverTiming(t, serve(handler, newRequest(http.MethodGet, "/users/1", "")).Header().Get("Server-Timing"))
+	if hit["db"] != 0 {
+		t.Errorf("cache hit db = %s, want 0", hit["db"])
+	}
+	if _, ok := hit["cache"]; !ok {
+		t.Errorf("cache hit metrics = %v, want a cache span", hit)
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	get := func(t *testing.T, config *Config, target string) *httptest.ResponseRecorder {
+		t.Helper()
+		us, _ := newTestService(t, config, func(q stubQuery) stubResult { return userRows(alice) })
+		rec := serve(us.routes(), newRequest(http.MethodGet, target, ""))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d, body %s; want 200", target, rec.Code, rec.Body)
+		}
+		return rec
+	}
+
+	compact := get(t, testConfig(t), "/users/1").Body.Bytes()
+	if bytes.Count(compact, []byte("\n")) != 1 {
+		t.Errorf("default body %q, want compact JSON on one line", compact)
+	}
+	var want bytes.Buffer
+	if err := json.Indent(&want, compact, "", "  "); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, testConfig(t), "/users/1?pretty=true").Body.String(); got != want.String() {
+		t.Errorf("pretty body = %q, want %q", got, want.String())
+	}
+
+	// NDJSON is one document per line whatever the query asks for
+	r := newRequest(http.MethodGet, "/users/search?q=alice&pretty=true", "")
+	r.Header.Set("Accept", "application/x-ndjson")
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult { return userRows(alice) })
+	rec := serve(us.routes(), r)
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if rec.Code != http.StatusOK || len(lines) == 0 || !strings.Contains(lines[0], `"alice"`) {
+		t.Fatalf("NDJSON search: status %d, body %q; want alice streamed", rec.Code, rec.Body)
+	}
+	for _, line := range lines {
+		if !json.Valid([]byte(line)) {
+			t.Errorf("NDJSON line %q isn't a whole document", line)
+		}
+	}
+
+	t.Setenv("JSON_ALLOW_PRETTY", "false")
+	if got := get(t, testConfig(t), "/users/1?pretty=true").Body.Bytes(); !bytes.Equal(got, compact) {
+		t.Errorf("JSON_ALLOW_PRETTY=false body = %q, want compact %q", got, compact)
+	}
+}
+
+func TestPreloadCacheRejectsInvalidUTF8(t *testing.T) {
+	config := testConfig(t)
+	config.AdminToken = testAdminToken
+	config.InvalidUTF8 = invalidUTF8Reject
+	us, stub := newTestService(t, config, storedUsers(map[UserID]User{"1": alice}))
+
+	rec := serve(us.routes(), adminRequest("POST", "/cache/preload", "[\"1\", \"caf\xe9\"]"))
+	if rec.Code != http.StatusUnprocessableEntity || errorCode(t, rec) != codeInvalidUTF8 {
+		t.Errorf("status = %d, body %s; want 422 %s", rec.Code, rec.Body, codeInvalidUTF8)
+	}
+	if stub.count("ANY($1)") != 0 {
+		t.Error("a rejected preload reached the database")
+	}
+}
+
+func TestUpdateBatchIDAsString(t *testing.T) {
+	config := testConfig(t)
+	config.AdminToken = testAdminToken
+	us, _ := newTestService(t, config, func(q stubQuery) stubResult {
+		switch {
+		case strings.Contains(q.sql, "FOR UPDATE") && fmt.Sprint(q.args[0]) == "1":
+			return userRows(alice)
+		case strings.HasPrefix(q.sql, "UPDATE users SET username=$1"):
+			updated := alice
+			updated.Bio = q.args[2].(string)
+			return userRows(updated)
+		}
+		return stubResult{columns: userFields}
+	})
+
+	body := `[{"id": "1", "fields": {"bio": "again"}}, {"id": "99", "fields": {"bio": "nobody"}}]`
+	for query, want := range map[string]string{"": `1`, "?id_as_string=true": `"1"`} {
+		rec := serve(us.routes(), adminRequest(http.MethodPost, "/users/update-batch"+query, body))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%q: status %d, body %s", query, rec.Code, rec.Body)
+		}
+		var results []struct {
+			ID   json.RawMessage `json:"id"`
+			User *struct {
+				ID json.RawMessage `json:"id"`
+			} `json:"user"`
+		}
+		decodeBody(t, rec, &results)
+		if len(results) != 2 || results[0].User == nil {
+			t.Fatalf("%q: body %s, want an updated user and a miss", query, rec.Body)
+		}
+		if string(results[0].ID) != want || string(results[0].User.ID) != want {
+			t.Errorf("%q: item id %s, user id %s; want %s", query, results[0].ID, results[0].User.ID, want)
+		}
+		if results[1].User != nil || (query != "" && string(results[1].ID) != `"99"`) {
+			t.Errorf("%q: missing item = %s", query, rec.Body)
+		}
+	}
+}
+
+// editableStore answers reads of the users in stored by ID and echoes
+// UPDATEs back with the written columns.
+func editableStore(stored map[string]User) func(q stubQuery) stubResult {
+	return func(q stubQuery) stubResult {
+		switch {
+		case strings.HasPrefix(q.sql, "UPDATE users SET username=$1"):
+			updated := stored[fmt.Sprint(q.args[3])]
+			updated.Username, updated.Email, updated.Bio = q.args[0].(string), q.args[1].(string), q.args[2].(string)
+			return userRows(updated)
+		case strings.Contains(q.sql, "WHERE id = $1"):
+			if user, ok := stored[fmt.Sprint(q.args[0])]; ok {
+				return userRows(user)
+			}
+		}
+		return stubResult{columns: userFields}
+	}
+}
+
+func TestReservedUsernameHoldersCanEdit(t *testing.T) {
+	admin := User{ID: "1", Username: "admin", Email: "admin@example.com", Active: true}
+	bob := User{ID: "2", Username: "bob", Email: "bob@example.com", Active: true}
+	config := testConfig(t)
+	config.AdminToken = testAdminToken
+	us, _ := newTestService(t, config, editableStore(map[string]User{"1": admin, "2": bob}))
+	handler := us.routes()
+
+	for _, tc := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{http.MethodPut, "/users/1", `{"username":"admin","email":"admin@example.com","bio":"new bio"}`, http.StatusOK},
+		{http.MethodPatch, "/users/1", `{"bio":"patched bio"}`, http.StatusOK},
+		{http.MethodPut, "/users/2", `{"username":"support","email":"bob@example.com"}`, http.StatusUnprocessableEntity},
+		{http.MethodPatch, "/users/2", `{"username":"root"}`, http.StatusUnprocessableEntity},
+		{http.MethodPatch, "/users/1", `{"username":"ADMIN"}`, http.StatusUnprocessableEntity},
+	} {
+		if rec := serve(handler, newRequest(tc.method, tc.target, tc.body)); rec.Code != tc.want {
+			t.Errorf("%s %s %s: status %d, body %s; want %d", tc.method, tc.target, tc.body, rec.Code, rec.Body, tc.want)
+		}
+	}
+
+	rec := serve(handler, adminRequest(http.MethodPost, "/users/update-batch", `[{"id":"1","fields":{"bio":"batch bio"}},{"id":"2","fields":{"username":"staff"}}]`))
+	var results []BatchResult
+	decodeBody(t, rec, &results)
+	if len(results) != 2 || results[0].Status != http.StatusOK || results[1].Status != http.StatusUnprocessableEntity {
+		t.Errorf("batch results = %s, want admin's bio edit applied and bob's rename refused", rec.Body)
+	}
+}
+
+func TestDisposableEmailHoldersCanEdit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disposable.txt")
+	if err := os.WriteFile(path, []byte("mailinator.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("REJECT_DISPOSABLE_EMAILS", "true")
+	t.Setenv("DISPOSABLE_EMAIL_DOMAINS_FILE", path)
+	carol := User{ID: "1", Username: "carol", Email: "carol@mailinator.com", Active: true}
+	config := testConfig(t)
+	config.AdminToken = testAdminToken
+	us, _ := newTestService(t, config, editableStore(map[string]User{"1": carol, "2": alice}))
+	handler := us.routes()
+
+	for _, tc := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{http.MethodPut, "/users/1", `{"username":"carol","email":"carol@mailinator.com","bio":"new bio"}`, http.StatusOK},
+		{http.MethodPatch, "/users/1", `{"bio":"patched bio"}`, http.StatusOK},
+		{http.MethodPatch, "/users/1", `{"email":"carol2@mailinator.com"}`, http.StatusUnprocessableEntity},
+		{http.MethodPut, "/users/2", `{"username":"alice","email":"alice@mailinator.com"}`, http.StatusUnprocessableEntity},
+	} {
+		if rec := serve(handler, newRequest(tc.method, tc.target, tc.body)); rec.Code != tc.want {
+			t.Errorf("%s %s %s: status %d, body %s; want %d", tc.method, tc.target, tc.body, rec.Code, rec.Body, tc.want)
+		}
+	}
+
+	rec := serve(handler, adminRequest(http.MethodPost, "/users/update-batch", `[{"id":"1","fields":{"bio":"batch bio"}}]`))
+	var results []BatchResult
+	decodeBody(t, rec, &results)
+	if len(results) != 1 || results[0].Status != http.StatusOK {
+		t.Errorf("batch results = %s, want the bio edit applied", rec.Body)
+	}
+}
+
+func TestSearchCountOnlyIsCapped(t *testing.T) {
+	var limit driver.Value
+	matching := int64(0)
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		limit = q.args[len(q.args)-1]
+		return scalarRow(min(matching, limit.(int64)))
+	})
+	us.config.SearchMaxCount = 50
+
+	for _, tc := range []struct {
+		matching int64
+		want     string
+	}{
+		{3, `{"count":3}`},
+		{50, `{"count":50}`},
+		{5000, `{"capped":true,"count":50}`},
+	} {
+		matching = tc.matching
+		rec := serve(us.routes(), newRequest(http.MethodGet, "/users/search?q=ali&count_only=true", ""))
+		if got := strings.TrimSpace(rec.Body.String()); rec.Code != http.StatusOK || got != tc.want {
+			t.Errorf("%d matches: status %d, body %s; want %s", tc.matching, rec.Code, got, tc.want)
+		}
+		if limit != int64(51) {
+			t.Errorf("count was limited to %v rows, want SEARCH_MAX_COUNT+1", limit)
+		}
+	}
+
+	t.Setenv("SEARCH_MAX_COUNT", "250")
+	if got := loadConfig().SearchMaxCount; got != 250 {
+		t.Errorf("SEARCH_MAX_COUNT=250 loaded as %d", got)
+	}
+}
+
+func TestShutdownReleasesInFlightWebhookBatch(t *testing.T) {
+	entered, stop := make(chan struct{}), make(chan struct{})
+	var mutex sync.Mutex
+	var sent []string
+	var stalled bool
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := r.Header.Get("X-Webhook-Event")
+		mutex.Lock()
+		stall := event == "b" && !stalled
+		stalled = stalled || stall
+		mutex.Unlock()
+		// The first send of b is still in flight when shutdown begins
+		if stall {
+			close(entered)
+			select {
+			case <-r.Context().Done():
+			case <-stop:
+			}
+			return
+		}
+		mutex.Lock()
+		sent = append(sent, event)
+		mutex.Unlock()
+	}))
+	defer endpoint.Close()
+	defer close(stop)
+
+	config := testConfig(t)
+	config.WebhookURL = endpoint.URL
+	config.WebhookInterval = 10 * time.Millisecond
+	config.CacheWarmLimit = 0
+	table := &fakeWebhookTable{rows: []*webhookRow{
+		{id: 1, event: "a", status: webhookPending},
+		{id: 2, event: "b", status: webhookPending},
+		{id: 3, event: "c", status: webhookPending},
+	}}
+	us, _ := newTestService(t, config, table.handle)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	us.startBackground(ctx)
+	done := make(chan error, 1)
+	go func() { done <- us.run(ctx, us.newServer(http.NotFoundHandler()), listener) }()
+	<-entered
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	for id := int64(1); id <= 3; id++ {
+		if row := table.row(id); row.status != webhookDelivered || row.attempts != 1 {
+			t.Errorf("delivery %d = %+v, want delivered on its first recorded attempt", id, row)
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !slices.Equal(sent, []string{"a", "b", "c"}) {
+		t.Errorf("sent %v, want the interrupted batch finished by the shutdown flush", sent)
+	}
+}
+
+func TestDeletedUsersFreeTheirUsernameAndEmail(t *testing.T) {
+	// Only live rows are held to uniqueness, by the pre-check and the schema
+	var precheck string
+	us, _ := newTestService(t, testConfig(t), func(q stubQuery) stubResult {
+		if strings.Contains(q.sql, "CASE WHEN") {
+			precheck = q.sql
+			return stubResult{columns: []string{"field"}}
+		}
+		return insertingStore()(q)
+	})
+	us.config.DuplicatePrecheck = true
+	rec := serve(us.routes(), newRequest(http.MethodPost, "/users", `{"username":"alice","email":"alice@example.com"}`))
+	if rec.Code != http.StatusCreated {
+		t.Errorf("status %d, body %s; want 201", rec.Code, rec.Body)
+	}
+	if !strings.Contains(precheck, "deleted_at IS NULL") {
+		t.Errorf("pre-check %q counts soft-deleted users", precheck)
+	}
+
+	var schema strings.Builder
+	for _, m := range migrations {
+		schema.WriteString(m.sql)
+	}
+	for _, index := range []string{
+		"ON users (username) WHERE deleted_at IS NULL",
+		"ON users (email) WHERE deleted_at IS NULL",
+		"ON users (LOWER(email)) WHERE deleted_at IS NULL",
+		"DROP CONSTRAINT IF EXISTS users_username_key",
+		"DROP CONSTRAINT IF EXISTS users_email_key",
+		"DROP INDEX IF EXISTS users_email_lower_idx",
+	} {
+		if !strings.Contains(schema.String(), index) {
+			t.Errorf("migrations don't include %q", index)
+		}
+	}
+}
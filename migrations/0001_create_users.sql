@@ -0,0 +1,9 @@
+-- The id column is SERIAL or UUID depending on ID_TYPE. It only shapes a
+-- new table, an existing one keeps its id column.
+CREATE TABLE IF NOT EXISTS users (
+	{{id_column}},
+	username VARCHAR(50) UNIQUE NOT NULL,
+	email VARCHAR(100) UNIQUE NOT NULL,
+	bio TEXT,
+	created TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
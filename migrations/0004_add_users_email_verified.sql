@@ -0,0 +1,2 @@
+-- Set once a user confirms their email address
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,2 @@
+-- Set by soft deletes, NULL for live users; see PurgeDeleted
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
@@ -0,0 +1,4 @@
+-- optional
+-- Emails differing only in case belong to the same person. Existing
+-- case-duplicates block the index, which is reported but not fatal.
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_idx ON users (LOWER(email));
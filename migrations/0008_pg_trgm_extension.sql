@@ -0,0 +1,4 @@
+-- optional
+-- Trigram support for fuzzy search is optional, search falls back to
+-- substring matching without it
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
@@ -0,0 +1,2 @@
+-- optional
+CREATE INDEX IF NOT EXISTS users_username_trgm_idx ON users USING GIN (username gin_trgm_ops);
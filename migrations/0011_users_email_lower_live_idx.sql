@@ -0,0 +1,5 @@
+-- optional
+-- Narrows users_email_lower_idx to live rows like 0010. It is optional for
+-- the same reason: existing case-duplicates block the index.
+DROP INDEX IF EXISTS users_email_lower_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_live_idx ON users (LOWER(email)) WHERE deleted_at IS NULL;